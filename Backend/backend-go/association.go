@@ -0,0 +1,334 @@
+package main
+
+import (
+	"backend-go/models"
+	"context"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ASSOCIAZIONE TRA AGENZIE
+//Con più sorgenti (USGS, EMSC, INGV, ...) lo stesso terremoto arriva più volte,
+//con ID diversi. Dopo ogni scrittura cerchiamo, per ogni origine nuova o modificata,
+//le origini di altre agenzie vicine nel tempo, nello spazio e nella magnitudo:
+//insieme formano un evento logico, con un'origine preferita che lo rappresenta
+//in /api/events e l'elenco di tutte le origini che vi contribuiscono.
+//L'associazione non rallenta i worker: le origini salvate vengono messe in coda
+//e associate da una goroutine a parte (vedi associationQueue).
+
+// Associator raggruppa le origini dello stesso terremoto
+type Associator struct {
+	Window        time.Duration // Differenza massima tra i tempi di origine
+	MaxDistanceKm float64       // Distanza massima tra gli epicentri
+	MaxMagDiff    float64       // Differenza massima di magnitudo
+	Priority      []string      // Agenzie in ordine di preferenza per l'origine preferita
+
+	//Le associazioni vengono calcolate una alla volta: due worker che salvano
+	//origini dello stesso terremoto non devono creare due eventi logici
+	mu sync.Mutex
+}
+
+// Crea l'Associator leggendo la configurazione (nil se ASSOCIATION_ENABLED=false).
+// Le tolleranze di default sono quelle usate di solito per confrontare i cataloghi
+// globali: le localizzazioni di agenzie diverse differiscono di qualche secondo
+// e di qualche decina di km, le magnitudo (spesso di tipo diverso) di qualche decimo.
+func newAssociatorFromEnv() *Associator {
+	if !envBool("ASSOCIATION_ENABLED", true) {
+		return nil
+	}
+	var priority []string
+	for _, name := range strings.Split(envString("ASSOCIATION_PRIORITY", "ingv,emsc,usgs"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			priority = append(priority, name)
+		}
+	}
+	return &Associator{
+		Window:        envDuration("ASSOCIATION_TIME_WINDOW", 16*time.Second),
+		MaxDistanceKm: envFloat("ASSOCIATION_MAX_DISTANCE_KM", 100),
+		MaxMagDiff:    envFloat("ASSOCIATION_MAX_MAG_DIFF", 0.7),
+		Priority:      priority,
+	}
+}
+
+// Origini salvate in attesa di essere associate. I worker le aggiungono senza
+// aspettare; la goroutine di associazione le prende tutte insieme ad ogni giro.
+// Un'origine salvata più volte prima del suo turno viene associata una volta sola.
+type associationQueue struct {
+	mu      sync.Mutex
+	pending map[string]models.Earthquake // Ultima versione salvata di ogni origine
+	order   []string                     // ID in ordine di arrivo
+	closed  bool
+	wake    chan struct{} // Segnala alla goroutine che ci sono origini (capacità 1)
+	done    chan struct{} // Chiuso quando la goroutine ha finito
+}
+
+func newAssociationQueue() *associationQueue {
+	return &associationQueue{
+		pending: make(map[string]models.Earthquake),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// Aggiunge le origini create o aggiornate da un blocco di scrittura
+func (q *associationQueue) push(results []models.UpsertResult) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	added := false
+	for _, r := range results {
+		if r.Outcome == models.OutcomeUnchanged || r.Event.IsSimulatedEvent() {
+			continue
+		}
+		if _, queued := q.pending[r.ID]; !queued {
+			q.order = append(q.order, r.ID)
+		}
+		q.pending[r.ID] = r.Event
+		added = true
+	}
+	if added {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Prende tutte le origini in attesa, in ordine di arrivo
+func (q *associationQueue) take() []models.Earthquake {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := make([]models.Earthquake, 0, len(q.order))
+	for _, id := range q.order {
+		events = append(events, q.pending[id])
+	}
+	q.pending, q.order = make(map[string]models.Earthquake), nil
+	return events
+}
+
+// Chiude la coda: la goroutine associa le origini rimaste e termina
+func (q *associationQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+	}
+}
+
+// Mette in coda per l'associazione le origini create o aggiornate da un blocco di scrittura
+func (app *App) associate(results []models.UpsertResult) {
+	if app.associations != nil {
+		app.associations.push(results)
+	}
+}
+
+// Avvia la goroutine che associa le origini in coda (se l'associazione è attiva).
+// Come il dispatcher delle notifiche vive quanto i worker: shutdown la chiude dopo di loro.
+// Un errore viene solo segnalato: gli eventi sono comunque salvati,
+// e verranno riassociati alla prossima modifica loro o di un'origine vicina.
+func (app *App) startAssociation() {
+	if app.Associator == nil {
+		return
+	}
+	q := newAssociationQueue()
+	app.associations = q
+	go func() {
+		defer close(q.done)
+		for range q.wake {
+			for {
+				events := q.take()
+				if len(events) == 0 {
+					break
+				}
+				for _, ev := range events {
+					if err := app.Associator.Associate(context.Background(), app.Store, ev); err != nil {
+						log.Printf("Associazione dell'evento %s non riuscita: %v", ev.ID, err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Associate ricalcola l'evento logico di un'origine appena salvata:
+// l'origine viene raggruppata con la più vicina di ogni altra agenzia entro le tolleranze.
+// Gli eventi logici di cui facevano parte le origini coinvolte vengono ricalcolati
+// senza di loro (con una sola origine rimasta, quella torna un evento a sé).
+func (a *Associator) Associate(ctx context.Context, store EventStore, ev models.Earthquake) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lon, lat, ok := ev.LonLat()
+	if !ok {
+		return nil
+	}
+	simulated := false
+	window := a.Window.Milliseconds()
+	start, end := ev.Time-window, ev.Time+window
+	candidates, err := store.Near(ctx, lat, lon, a.MaxDistanceKm, models.EventFilter{
+		StartTime: &start,
+		EndTime:   &end,
+		Simulated: &simulated,
+	}, 0)
+	if err != nil {
+		return err
+	}
+
+	//La versione salvata dell'origine, con l'associazione attuale
+	current := ev
+	//Per ogni altra agenzia teniamo l'origine più vicina (tempo e distanza, pesati sulle tolleranze)
+	best := map[string]models.NearbyEvent{}
+	bestScore := map[string]float64{}
+	for _, c := range candidates {
+		if c.ID == ev.ID {
+			current = c.Earthquake
+			continue
+		}
+		agency := c.Agency()
+		if agency == ev.Agency() || math.Abs(c.Magnitude-ev.Magnitude) > a.MaxMagDiff {
+			continue
+		}
+		score := math.Abs(float64(c.Time-ev.Time))/float64(max(window, 1)) + c.DistanceKm/math.Max(a.MaxDistanceKm, 1)
+		if s, seen := bestScore[agency]; !seen || score < s || (score == s && c.ID < best[agency].ID) {
+			best[agency], bestScore[agency] = c, score
+		}
+	}
+
+	//Origine senza corrispondenze e mai associata: non c'è niente da aggiornare
+	if len(best) == 0 && current.LogicalID == "" {
+		return nil
+	}
+
+	members := []models.Earthquake{current}
+	agencies := make([]string, 0, len(best))
+	for agency := range best {
+		agencies = append(agencies, agency)
+	}
+	sort.Slice(agencies, func(i, j int) bool { return bestScore[agencies[i]] < bestScore[agencies[j]] })
+	for _, agency := range agencies {
+		members = append(members, best[agency].Earthquake)
+	}
+
+	//Eventi logici di cui facevano parte le origini coinvolte
+	var previous []string
+	for _, m := range members {
+		if m.LogicalID != "" && !slices.Contains(previous, m.LogicalID) {
+			previous = append(previous, m.LogicalID)
+		}
+	}
+
+	//L'ID dell'evento logico resta quello che aveva già (di preferenza quello
+	//dell'origine appena salvata), così non cambia quando si aggiunge un'altra agenzia.
+	//Per un evento logico nuovo è l'ID dell'origine salvata per prima
+	var groups []models.EventGroup
+	logicalID := ""
+	if len(members) > 1 {
+		logicalID = earliestSaved(members).ID
+		if len(previous) > 0 {
+			logicalID = previous[0]
+		}
+	}
+	groups = append(groups, a.group(logicalID, members))
+
+	//Le origini rimaste negli eventi logici precedenti
+	inGroup := map[string]bool{}
+	for _, m := range members {
+		inGroup[m.ID] = true
+	}
+	for _, id := range previous {
+		earlier, err := a.logicalMembers(ctx, store, id, ev.Time)
+		if err != nil {
+			return err
+		}
+		var rest []models.Earthquake
+		for _, m := range earlier {
+			if !inGroup[m.ID] {
+				rest = append(rest, m)
+			}
+		}
+		switch {
+		case len(rest) == 0:
+		case len(rest) == 1:
+			groups = append(groups, a.group("", rest))
+		case id == logicalID:
+			//L'ID è passato al nuovo gruppo: quello vecchio prende l'ID di una sua origine
+			groups = append(groups, a.group(rest[0].ID, rest))
+		default:
+			groups = append(groups, a.group(id, rest))
+		}
+	}
+	return store.Associate(ctx, groups)
+}
+
+// L'origine salvata per prima: quella con UpdatedAt più vecchio (a parità, l'ID minore).
+// UpdatedAt è il momento dell'ultima revisione, che per origini mai associate
+// è quasi sempre quello di arrivo: un'agenzia corregge di rado un evento nei
+// pochi secondi in cui arrivano le altre.
+func earliestSaved(members []models.Earthquake) models.Earthquake {
+	first := members[0]
+	for _, m := range members[1:] {
+		if m.UpdatedAt < first.UpdatedAt || (m.UpdatedAt == first.UpdatedAt && m.ID < first.ID) {
+			first = m
+		}
+	}
+	return first
+}
+
+// Origini salvate di un evento logico. Sono tutte entro poche finestre di tempo
+// dall'origine associata, quindi limitiamo la ricerca a quell'intervallo.
+func (a *Associator) logicalMembers(ctx context.Context, store EventStore, logicalID string, around int64) ([]models.Earthquake, error) {
+	span := 3 * a.Window.Milliseconds()
+	start, end := around-span, around+span
+	return store.Query(ctx, models.EventFilter{LogicalID: logicalID, StartTime: &start, EndTime: &end}, 0)
+}
+
+// Costruisce il gruppo scegliendo l'origine preferita
+func (a *Associator) group(logicalID string, members []models.Earthquake) models.EventGroup {
+	g := models.EventGroup{LogicalID: logicalID}
+	for _, m := range members {
+		g.Members = append(g.Members, m.ID)
+	}
+	if logicalID == "" {
+		return g
+	}
+
+	sorted := append([]models.Earthquake(nil), members...)
+	sort.SliceStable(sorted, func(i, j int) bool { return a.prefer(sorted[i], sorted[j]) })
+	g.Preferred = sorted[0].ID
+	for _, m := range sorted {
+		ref := models.RefOf(m)
+		ref.Preferred = m.ID == g.Preferred
+		g.Origins = append(g.Origins, ref)
+	}
+	return g
+}
+
+// Dice se l'origine x è da preferire a y: prima l'agenzia con la priorità più alta
+// (quelle non elencate in ASSOCIATION_PRIORITY vengono dopo), poi la più recente
+func (a *Associator) prefer(x, y models.Earthquake) bool {
+	px, py := a.rank(x.Agency()), a.rank(y.Agency())
+	if px != py {
+		return px < py
+	}
+	if x.UpdatedAt != y.UpdatedAt {
+		return x.UpdatedAt > y.UpdatedAt
+	}
+	return x.ID < y.ID
+}
+
+func (a *Associator) rank(agency string) int {
+	for i, name := range a.Priority {
+		if name == agency {
+			return i
+		}
+	}
+	return len(a.Priority)
+}
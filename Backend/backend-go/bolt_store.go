@@ -0,0 +1,765 @@
+package main
+
+import (
+	"backend-go/models"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore è un'implementazione di EventStore su file, basata su bbolt
+// (database chiave/valore embedded scritto in Go puro).
+// Non richiede nessun server: tutto sta in un singolo file, quindi è adatto
+// alle stazioni sul campo dove un container MongoDB sarebbe troppo pesante.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// Nomi dei bucket (l'equivalente delle collection)
+// Oltre al bucket principale teniamo degli indici secondari, in cui la chiave
+// è ordinabile byte per byte e il valore è vuoto: ci basta scorrere le chiavi.
+var (
+	bucketEvents  = []byte("events")        // ID -> evento in JSON
+	bucketByTime  = []byte("idx_time")      // tempo + ID
+	bucketByMag   = []byte("idx_magnitude") // magnitudo + ID
+	bucketByIsSim = []byte("idx_simulated") // ID degli eventi simulati
+	bucketHistory = []byte("history")       // ID + revisione -> revisione in JSON
+	bucketArchive = []byte("archive")       // ID -> evento archiviato in JSON
+	bucketQuarant = []byte("quarantine")    // ID -> evento in quarantena in JSON
+)
+
+// Costruttore del BoltStore: apre (o crea) il file del database
+// e si assicura che esistano tutti i bucket
+func NewBoltStore(path string) (*BoltStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	//Il timeout evita di restare bloccati se un altro processo tiene il lock sul file
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketEvents, bucketByTime, bucketByMag, bucketByIsSim, bucketHistory, bucketArchive, bucketQuarant} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Inserisce o sostituisce un evento aggiornando anche gli indici.
+// Tutto avviene in un'unica transazione, quindi gli indici non restano mai
+// disallineati rispetto ai dati.
+func (b *BoltStore) Upsert(ctx context.Context, event models.Earthquake) (models.UpsertResult, error) {
+	results, errs := b.UpsertMany(ctx, []models.Earthquake{event})
+	return results[0], errs[0]
+}
+
+// Versione a blocchi di Upsert: tutti gli eventi vengono scritti nella stessa
+// transazione, quindi paghiamo una sola scrittura su disco (fsync) per blocco.
+// Ogni modifica viene salvata anche nello storico delle revisioni.
+// Restituisce un errore per ogni evento (nil se è andato a buon fine).
+func (b *BoltStore) UpsertMany(ctx context.Context, events []models.Earthquake) ([]models.UpsertResult, []error) {
+	results := make([]models.UpsertResult, len(events))
+	errs := make([]error, len(events))
+	now := time.Now().UnixMilli()
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketEvents)
+		for i, ev := range events {
+			var current *models.Earthquake
+			if raw := data.Get([]byte(ev.ID)); raw != nil {
+				var cur models.Earthquake
+				if err := json.Unmarshal(raw, &cur); err != nil {
+					errs[i] = err
+					continue
+				}
+				current = &cur
+			}
+
+			next, revisions, result := nextRevision(current, lastHistoryRevision(tx, ev.ID), ev, now)
+			results[i] = result
+			if len(revisions) == 0 {
+				continue
+			}
+
+			//Un evento non serializzabile non deve far fallire gli altri
+			encoded, err := json.Marshal(next)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			if err := putRevisions(tx, revisions); err != nil {
+				return err
+			}
+			if err := putEvent(tx, next, encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	//Se la transazione fallisce non è stato scritto nulla
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return results, errs
+}
+
+// Salva le revisioni nello storico
+func putRevisions(tx *bolt.Tx, revisions []models.EventRevision) error {
+	history := tx.Bucket(bucketHistory)
+	for _, r := range revisions {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err := history.Put(historyKey(r.EventID, r.Revision), raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ultima revisione di un evento nello storico (0 se non ce ne sono).
+// Le revisioni di un ID sono in ordine, quindi cerchiamo l'ultima chiave con il suo prefisso.
+func lastHistoryRevision(tx *bolt.Tx, id string) int {
+	prefix := append([]byte(id), 0)
+	c := tx.Bucket(bucketHistory).Cursor()
+	k, _ := c.Seek(append(prefix, 0xff, 0xff, 0xff, 0xff))
+	if k == nil {
+		k, _ = c.Last()
+	} else if !bytes.HasPrefix(k, prefix) {
+		k, _ = c.Prev()
+	}
+	if k == nil || len(k) != len(prefix)+4 || !bytes.HasPrefix(k, prefix) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(k[len(prefix):]))
+}
+
+// Restituisce tutte le revisioni di un evento, dalla più vecchia alla più recente.
+// Le chiavi dello storico iniziano con l'ID, quindi basta una ricerca per prefisso.
+func (b *BoltStore) History(ctx context.Context, id string) ([]models.EventRevision, error) {
+	revisions := []models.EventRevision{}
+	prefix := append([]byte(id), 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketHistory).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var r models.EventRevision
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			revisions = append(revisions, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// Ricostruisce il catalogo com'era al momento asOf: per ogni evento prendiamo
+// l'ultima revisione ricevuta entro quel momento. Lo storico è ordinato per ID
+// e poi per revisione, quindi le revisioni di un evento sono tutte vicine.
+func (b *BoltStore) catalogAsOf(ctx context.Context, filter models.EventFilter, limit int64) ([]models.Earthquake, error) {
+	var candidates []models.Earthquake
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var currentID []byte
+		var group []models.EventRevision
+		closeGroup := func() {
+			if ev, ok := revisionAsOf(group, *filter.AsOf); ok {
+				candidates = append(candidates, ev)
+			}
+			group = group[:0]
+		}
+
+		c := tx.Bucket(bucketHistory).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			id := k[:len(k)-historySuffixLen]
+			if !bytes.Equal(id, currentID) {
+				closeGroup()
+				currentID = append(currentID[:0], id...)
+			}
+			var r models.EventRevision
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			group = append(group, r)
+		}
+		closeGroup()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return selectEvents(candidates, filter, limit), nil
+}
+
+// Legge gli eventi archiviati. L'archivio non ha indici secondari:
+// viene consultato raramente, quindi lo scorriamo tutto e filtriamo in memoria.
+func (b *BoltStore) catalogArchive(ctx context.Context, filter models.EventFilter, limit int64) ([]models.Earthquake, error) {
+	var candidates []models.Earthquake
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketArchive).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var ev models.Earthquake
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			candidates = append(candidates, ev)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return selectEvents(candidates, filter, limit), nil
+}
+
+// Per AsOf e per l'archivio non possiamo usare gli indici del catalogo attuale:
+// il risultato viene costruito in memoria
+func (b *BoltStore) materialized(ctx context.Context, filter models.EventFilter, limit int64) ([]models.Earthquake, error) {
+	if filter.AsOf != nil {
+		return b.catalogAsOf(ctx, filter, limit)
+	}
+	return b.catalogArchive(ctx, filter, limit)
+}
+
+// Scrive un evento nel bucket principale, sostituendo le voci degli indici
+func putEvent(tx *bolt.Tx, event models.Earthquake, data []byte) error {
+	events := tx.Bucket(bucketEvents)
+
+	//Se l'evento esisteva già, rimuoviamo le vecchie voci degli indici
+	if old := events.Get([]byte(event.ID)); old != nil {
+		var prev models.Earthquake
+		if err := json.Unmarshal(old, &prev); err != nil {
+			return err
+		}
+		if err := deleteIndexes(tx, prev); err != nil {
+			return err
+		}
+	}
+
+	if err := events.Put([]byte(event.ID), data); err != nil {
+		return err
+	}
+	return putIndexes(tx, event)
+}
+
+// Restituisce gli eventi che rispettano il filtro, nell'ordine richiesto.
+// Sceglie l'indice più conveniente: se l'ordinamento coincide con un indice lo
+// scorriamo nella direzione giusta e ci fermiamo appena raggiunto il limite.
+// Se invece si ordina per tempo senza limite ma con un filtro sul magnitudo,
+// leggiamo solo quella porzione dell'indice sul magnitudo e poi riordiniamo.
+func (b *BoltStore) Query(ctx context.Context, filter models.EventFilter, limit int64) ([]models.Earthquake, error) {
+	if filter.AsOf != nil || filter.Archived {
+		return b.materialized(ctx, filter, limit)
+	}
+	events := []models.Earthquake{}
+
+	bySort := filter.Sort == models.SortMagnitudeAsc || filter.Sort == models.SortMagnitudeDesc
+	hasMagRange := (filter.MinMagnitude != nil && *filter.MinMagnitude > 0) || filter.MaxMagnitude != nil
+
+	//L'indice dà già l'ordine giusto: possiamo usare direttamente lo stream
+	if bySort || limit > 0 || !hasMagRange {
+		err := b.Stream(ctx, filter, limit, func(ev models.Earthquake) error {
+			events = append(events, ev)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		lo, hi := indexBounds(filter, true)
+		return scanRange(tx.Bucket(bucketByMag), lo, hi, nil, false, func(key []byte) (bool, error) {
+			ev, ok, err := loadMatching(ctx, tx, key[8:], filter)
+			if ok {
+				events = append(events, ev)
+			}
+			return err == nil, err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//Con l'indice sul magnitudo ma ordinamento per tempo dobbiamo riordinare
+	sort.Slice(events, func(i, j int) bool {
+		return filter.Sort.Less(events[i], events[j])
+	})
+	return events, nil
+}
+
+// Dimensione dei blocchi letti da Stream in ogni transazione
+const boltStreamChunk = 256
+
+// Passa gli eventi uno alla volta alla funzione fn, nell'ordine richiesto.
+// Leggiamo l'indice a blocchi: ogni blocco è una transazione di lettura breve,
+// poi chiamiamo fn fuori dalla transazione. Così la memoria resta costante e
+// un client lento non tiene aperta una transazione per tutto il download.
+func (b *BoltStore) Stream(ctx context.Context, filter models.EventFilter, limit int64, fn func(models.Earthquake) error) error {
+	//Il catalogo del passato va ricostruito dallo storico e l'archivio non ha indici
+	if filter.AsOf != nil || filter.Archived {
+		events, err := b.materialized(ctx, filter, limit)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	byMag := filter.Sort == models.SortMagnitudeAsc || filter.Sort == models.SortMagnitudeDesc
+	bucket := bucketByTime
+	descending := filter.Sort != models.SortTimeAsc
+	if byMag {
+		bucket = bucketByMag
+		descending = filter.Sort != models.SortMagnitudeAsc
+	}
+	lo, hi := indexBounds(filter, byMag)
+
+	//Con il cursore di una pagina ripartiamo subito dopo la sua chiave nell'indice
+	var after []byte
+	if c := filter.After; c != nil {
+		if byMag {
+			after = append(floatKey(c.Magnitude), c.ID...)
+		} else {
+			after = append(timeKey(c.Time), c.ID...)
+		}
+	}
+	var sent int64
+	for {
+		chunk := make([]models.Earthquake, 0, boltStreamChunk)
+		done := true
+
+		err := b.db.View(func(tx *bolt.Tx) error {
+			return scanRange(tx.Bucket(bucket), lo, hi, after, descending, func(key []byte) (bool, error) {
+				//Copiamo la chiave: i byte restituiti da bbolt valgono solo dentro la transazione
+				after = append(after[:0], key...)
+				ev, ok, err := loadMatching(ctx, tx, key[8:], filter)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					chunk = append(chunk, ev)
+				}
+				if len(chunk) == boltStreamChunk {
+					done = false
+					return false, nil
+				}
+				return true, nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, ev := range chunk {
+			if limit > 0 && sent >= limit {
+				return nil
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+			sent++
+		}
+		if done || (limit > 0 && sent >= limit) {
+			return nil
+		}
+	}
+}
+
+// Carica un evento dal bucket principale e dice se rispetta il filtro
+func loadMatching(ctx context.Context, tx *bolt.Tx, id []byte, filter models.EventFilter) (models.Earthquake, bool, error) {
+	var ev models.Earthquake
+	if err := ctx.Err(); err != nil {
+		return ev, false, err
+	}
+	raw := tx.Bucket(bucketEvents).Get(id)
+	if raw == nil {
+		return ev, false, nil
+	}
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return ev, false, err
+	}
+	return ev, filter.Matches(ev), nil
+}
+
+// Calcola gli estremi (codificati) da usare sull'indice del magnitudo o del tempo
+func indexBounds(filter models.EventFilter, magnitude bool) (lo, hi []byte) {
+	if magnitude {
+		if filter.MinMagnitude != nil {
+			lo = floatKey(*filter.MinMagnitude)
+		}
+		if filter.MaxMagnitude != nil {
+			hi = floatKey(*filter.MaxMagnitude)
+		}
+		return lo, hi
+	}
+	if filter.StartTime != nil {
+		lo = timeKey(*filter.StartTime)
+	}
+	if filter.EndTime != nil {
+		hi = timeKey(*filter.EndTime)
+	}
+	return lo, hi
+}
+
+// Cerca gli eventi entro radiusKm dal punto (lat, lon), dal più vicino al più lontano
+func (b *BoltStore) Near(ctx context.Context, lat, lon, radiusKm float64, filter models.EventFilter, limit int64) ([]models.NearbyEvent, error) {
+	return nearByScan(ctx, b.Stream, lat, lon, radiusKm, filter, limit)
+}
+
+// Aggiorna i campi dell'associazione sulle origini di ogni gruppo, in un'unica transazione
+func (b *BoltStore) Associate(ctx context.Context, groups []models.EventGroup) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketEvents)
+		for _, g := range groups {
+			for _, id := range g.Members {
+				raw := data.Get([]byte(id))
+				if raw == nil {
+					continue
+				}
+				var ev models.Earthquake
+				if err := json.Unmarshal(raw, &ev); err != nil {
+					return err
+				}
+				encoded, err := json.Marshal(g.Apply(ev))
+				if err != nil {
+					return err
+				}
+				//Tempo e magnitudo non cambiano: gli indici restano validi
+				if err := data.Put([]byte(id), encoded); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Sposta gli eventi indicati nell'archivio, togliendoli dal catalogo e dagli indici.
+// Tutto avviene in un'unica transazione; lo storico resta com'è.
+func (b *BoltStore) Archive(ctx context.Context, ids []string) (int64, error) {
+	var moved int64
+	now := time.Now().UnixMilli()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		archive := tx.Bucket(bucketArchive)
+		for _, id := range ids {
+			ev, ok, err := removeEvent(tx, id)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			ev.ArchivedAt = now
+			raw, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if err := archive.Put([]byte(id), raw); err != nil {
+				return err
+			}
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// Cancella definitivamente gli eventi indicati, insieme al loro storico
+func (b *BoltStore) Delete(ctx context.Context, ids []string) (int64, error) {
+	var deleted int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(bucketHistory)
+		for _, id := range ids {
+			_, ok, err := removeEvent(tx, id)
+			if err != nil {
+				return err
+			}
+			if ok {
+				deleted++
+			}
+
+			//Prima raccogliamo le chiavi dello storico, poi cancelliamo:
+			//modificare un bucket mentre lo si scorre con un cursore non è sicuro
+			var keys [][]byte
+			prefix := append([]byte(id), 0)
+			c := history.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			for _, k := range keys {
+				if err := history.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// Toglie un evento dal bucket principale e dagli indici.
+// ok è false se l'evento non c'era.
+func removeEvent(tx *bolt.Tx, id string) (models.Earthquake, bool, error) {
+	var ev models.Earthquake
+	data := tx.Bucket(bucketEvents)
+	raw := data.Get([]byte(id))
+	if raw == nil {
+		return ev, false, nil
+	}
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return ev, false, err
+	}
+	if err := deleteIndexes(tx, ev); err != nil {
+		return ev, false, err
+	}
+	return ev, true, data.Delete([]byte(id))
+}
+
+// Mette un evento in quarantena, sostituendo quello con lo stesso ID
+func (b *BoltStore) Quarantine(ctx context.Context, q models.QuarantinedEvent) error {
+	raw, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketQuarant).Put([]byte(q.Event.ID), raw)
+	})
+}
+
+// Elenca gli eventi in quarantena, dal più recente.
+// La quarantena è piccola per definizione, quindi la leggiamo tutta e ordiniamo in memoria.
+func (b *BoltStore) ListQuarantine(ctx context.Context, limit int64) ([]models.QuarantinedEvent, error) {
+	list := []models.QuarantinedEvent{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketQuarant).ForEach(func(k, v []byte) error {
+			var q models.QuarantinedEvent
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			list = append(list, q)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortQuarantine(list, limit), nil
+}
+
+// Toglie un evento dalla quarantena e lo restituisce (ok false se non c'era)
+func (b *BoltStore) TakeQuarantined(ctx context.Context, id string) (models.QuarantinedEvent, bool, error) {
+	var q models.QuarantinedEvent
+	var ok bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketQuarant)
+		raw := bucket.Get([]byte(id))
+		if raw == nil {
+			return nil
+		}
+		if err := json.Unmarshal(raw, &q); err != nil {
+			return err
+		}
+		ok = true
+		return bucket.Delete([]byte(id))
+	})
+	return q, ok, err
+}
+
+// Chiude il file del database (libera il lock sul file)
+func (b *BoltStore) Close(ctx context.Context) error {
+	return b.db.Close()
+}
+
+// Cerca un evento per ID: prima nel catalogo, poi nell'archivio
+func (b *BoltStore) Get(ctx context.Context, id string) (models.Earthquake, error) {
+	var ev models.Earthquake
+	found := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketEvents, bucketArchive} {
+			if raw := tx.Bucket(name).Get([]byte(id)); raw != nil {
+				found = true
+				return json.Unmarshal(raw, &ev)
+			}
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return ev, err
+}
+
+// Restituisce tutto il contenuto dello store senza limiti
+func (b *BoltStore) GetAll(ctx context.Context) ([]models.Earthquake, error) {
+	return b.Query(ctx, models.EventFilter{}, 0)
+}
+
+//GESTIONE DEGLI INDICI
+
+// Aggiunge le voci degli indici secondari per un evento
+func putIndexes(tx *bolt.Tx, ev models.Earthquake) error {
+	id := []byte(ev.ID)
+	if err := tx.Bucket(bucketByTime).Put(append(timeKey(ev.Time), id...), nil); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketByMag).Put(append(floatKey(ev.Magnitude), id...), nil); err != nil {
+		return err
+	}
+	if ev.IsSimulated {
+		return tx.Bucket(bucketByIsSim).Put(id, nil)
+	}
+	return nil
+}
+
+// Rimuove le voci degli indici secondari per un evento
+func deleteIndexes(tx *bolt.Tx, ev models.Earthquake) error {
+	id := []byte(ev.ID)
+	if err := tx.Bucket(bucketByTime).Delete(append(timeKey(ev.Time), id...)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketByMag).Delete(append(floatKey(ev.Magnitude), id...)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketByIsSim).Delete(id)
+}
+
+// Scorre le chiavi di un indice comprese tra lo e hi (estremi inclusi, nil = illimitato).
+// Le chiavi sono formate da 8 byte di valore seguiti dall'ID dell'evento.
+// Se after non è nil la scansione riparte subito dopo quella chiave (esclusa).
+// La funzione fn riceve la chiave e restituisce false per interrompere la scansione.
+func scanRange(bucket *bolt.Bucket, lo, hi, after []byte, descending bool, fn func(key []byte) (bool, error)) error {
+	c := bucket.Cursor()
+
+	var k []byte
+	if descending {
+		switch {
+		case after != nil:
+			//Ci posizioniamo sulla chiave di ripresa (o sulla successiva) e torniamo indietro
+			if k, _ = c.Seek(after); k == nil {
+				k, _ = c.Last()
+			}
+			if k != nil && bytes.Compare(k, after) >= 0 {
+				k, _ = c.Prev()
+			}
+		case hi == nil || binary.BigEndian.Uint64(hi) == math.MaxUint64:
+			k, _ = c.Last()
+		default:
+			//Ci posizioniamo subito dopo l'ultima chiave con valore <= hi e torniamo indietro
+			seek := make([]byte, 8)
+			binary.BigEndian.PutUint64(seek, binary.BigEndian.Uint64(hi)+1)
+			if k, _ = c.Seek(seek); k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+		}
+		for ; k != nil; k, _ = c.Prev() {
+			if lo != nil && bytes.Compare(k[:8], lo) < 0 {
+				break
+			}
+			more, err := fn(k)
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch {
+	case after != nil:
+		if k, _ = c.Seek(after); k != nil && bytes.Equal(k, after) {
+			k, _ = c.Next()
+		}
+	case lo == nil:
+		k, _ = c.First()
+	default:
+		k, _ = c.Seek(lo)
+	}
+	for ; k != nil; k, _ = c.Next() {
+		if hi != nil && bytes.Compare(k[:8], hi) > 0 {
+			break
+		}
+		more, err := fn(k)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// Le chiavi dello storico sono l'ID, un byte 0 di separazione e 4 byte di revisione
+const historySuffixLen = 5
+
+// Costruisce la chiave dello storico per una revisione
+func historyKey(id string, revision int) []byte {
+	key := make([]byte, len(id)+historySuffixLen)
+	copy(key, id)
+	binary.BigEndian.PutUint32(key[len(id)+1:], uint32(revision))
+	return key
+}
+
+// Codifica un timestamp in 8 byte ordinabili: invertiamo il bit del segno
+// così anche i tempi negativi (prima del 1970) restano nell'ordine giusto
+func timeKey(t int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t)^(1<<63))
+	return key
+}
+
+// Codifica un float64 in 8 byte ordinabili: per i positivi invertiamo il bit
+// del segno, per i negativi invertiamo tutti i bit
+func floatKey(f float64) []byte {
+	bits := math.Float64bits(f)
+	if f >= 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, bits)
+	return key
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+//CONFIGURAZIONE DA VARIABILI D'AMBIENTE
+//Piccole funzioni di supporto per leggere la configurazione con un valore di default.
+//Se il valore è presente ma non valido lo segnaliamo nel log e usiamo il default,
+//così un errore di battitura non blocca l'avvio del servizio.
+
+// Legge una stringa, con valore di default se la variabile non è impostata
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// Legge un intero positivo
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Valore non valido per %s (%q), uso il default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// Legge un numero decimale non negativo
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		log.Printf("Valore non valido per %s (%q), uso il default %g", key, v, def)
+		return def
+	}
+	return f
+}
+
+// Legge una durata nel formato di Go (es. "500ms", "5m", "1h")
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Valore non valido per %s (%q), uso il default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// Legge un booleano (true/false, 1/0, ...)
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Valore non valido per %s (%q), uso il default %t", key, v, def)
+		return def
+	}
+	return b
+}
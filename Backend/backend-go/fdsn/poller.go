@@ -0,0 +1,198 @@
+package fdsn
+
+import (
+	"backend-go/models"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// URL del servizio event di alcune agenzie, usabili in FDSN_SOURCES con il solo nome.
+// Altre agenzie (IRIS, GFZ, ...) si configurano con "nome=url".
+var KnownSources = map[string]string{
+	"ingv": "https://webservices.ingv.it/fdsnws/event/1/query?format=text",
+	"emsc": "https://www.seismicportal.eu/fdsnws/event/1/query?format=text",
+	"usgs": "https://earthquake.usgs.gov/fdsnws/event/1/query?format=text",
+}
+
+// Il catalogo di un mese di una grande agenzia pesa qualche decina di MB
+const maxCatalogSize = 256 << 20
+
+// Source è un servizio FDSN event da interrogare
+type Source struct {
+	Name string `json:"name"` // Agenzia, usata come prefisso dell'ID e come Source degli eventi
+	URL  string `json:"url"`
+}
+
+// ParseSources legge un elenco di sorgenti separate da virgole, nella forma
+// "nome=url" oppure solo "nome" per le agenzie di KnownSources
+// (es. "ingv,emsc,iris=https://service.iris.edu/fdsnws/event/1/query?format=text").
+func ParseSources(spec string) ([]Source, error) {
+	var sources []Source
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		//Spezziamo sul primo "=": l'URL può contenere altri "=" nella query
+		name, rawURL, hasURL := strings.Cut(item, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !hasURL {
+			known, ok := KnownSources[name]
+			if !ok {
+				return nil, fmt.Errorf("sorgente FDSN %q sconosciuta: indicare nome=url", name)
+			}
+			rawURL = known
+		}
+		rawURL = strings.TrimSpace(rawURL)
+		if name == "" || strings.ContainsAny(name, ":/ ") {
+			return nil, fmt.Errorf("nome della sorgente FDSN non valido: %q", name)
+		}
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("URL della sorgente FDSN %s non valido: %q", name, rawURL)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("sorgente FDSN %s ripetuta", name)
+		}
+		seen[name] = true
+		sources = append(sources, Source{Name: name, URL: rawURL})
+	}
+	return sources, nil
+}
+
+// ErrUnknownSource indica un nome di sorgente non configurato
+var ErrUnknownSource = errors.New("sorgente FDSN sconosciuta")
+
+// Sink riceve gli eventi letti da una sorgente (es. per metterli nella coda dei worker)
+type Sink func(ctx context.Context, source string, events []models.Earthquake) error
+
+// Result è l'esito di un download
+type Result struct {
+	Source    string    `json:"source"`
+	URL       string    `json:"url"`
+	Events    int       `json:"events"`  // Eventi passati al Sink
+	Skipped   int       `json:"skipped"` // Righe scartate perché incomplete
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// Poller interroga le sorgenti configurate e passa gli eventi al Sink.
+// A differenza dei feed USGS i servizi FDSN non supportano le richieste
+// condizionali: ad ogni giro chiediamo gli eventi degli ultimi Lookback
+// (se l'URL non indica già uno starttime). Gli eventi già salvati e non
+// cambiati vengono riconosciuti dallo store e non riscritti.
+type Poller struct {
+	Sources  []Source
+	Client   *http.Client
+	Sink     Sink
+	Lookback time.Duration
+}
+
+// New crea un Poller con un client HTTP con timeout
+func New(sources []Source, lookback time.Duration, sink Sink) *Poller {
+	return &Poller{
+		Sources:  sources,
+		Client:   &http.Client{Timeout: 60 * time.Second},
+		Sink:     sink,
+		Lookback: lookback,
+	}
+}
+
+// Fetch scarica il catalogo di una sorgente e passa gli eventi al Sink
+func (p *Poller) Fetch(ctx context.Context, name string) (Result, error) {
+	var src *Source
+	for i := range p.Sources {
+		if p.Sources[i].Name == name {
+			src = &p.Sources[i]
+		}
+	}
+	if src == nil {
+		return Result{}, fmt.Errorf("%w: %q", ErrUnknownSource, name)
+	}
+	now := time.Now().UTC()
+	result := Result{Source: src.Name, URL: queryURL(src.URL, now.Add(-p.Lookback)), FetchedAt: now}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, result.URL, nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Accept", "text/plain")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		//Lo standard FDSN risponde 204 quando nessun evento soddisfa la richiesta
+		return result, nil
+	case http.StatusOK:
+	default:
+		return result, fmt.Errorf("sorgente %s: risposta HTTP %d", src.Name, resp.StatusCode)
+	}
+
+	events, skipped, err := ParseText(io.LimitReader(resp.Body, maxCatalogSize), src.Name)
+	if err != nil {
+		return result, fmt.Errorf("sorgente %s: %w", src.Name, err)
+	}
+	for _, s := range skipped {
+		log.Printf("FDSN %s: %v", src.Name, s)
+	}
+	result.Skipped = len(skipped)
+
+	if err := p.Sink(ctx, src.Name, events); err != nil {
+		return result, err
+	}
+	result.Events = len(events)
+	return result, nil
+}
+
+// Aggiunge starttime all'URL, a meno che non sia già indicato
+func queryURL(raw string, start time.Time) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	q := u.Query()
+	for key := range q {
+		if strings.EqualFold(key, "starttime") || strings.EqualFold(key, "start") {
+			return raw
+		}
+	}
+	q.Set("starttime", start.Format("2006-01-02T15:04:05"))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Run interroga tutte le sorgenti ogni interval, finché il contesto non viene annullato.
+// Il primo giro parte subito; una sorgente che non risponde non blocca le altre.
+func (p *Poller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, src := range p.Sources {
+			if ctx.Err() != nil {
+				return
+			}
+			result, err := p.Fetch(ctx, src.Name)
+			if err != nil {
+				log.Printf("FDSN %s: errore %v", src.Name, err)
+				continue
+			}
+			log.Printf("FDSN %s: %d eventi in coda, %d scartati", src.Name, result.Events, result.Skipped)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
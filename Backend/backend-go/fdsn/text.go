@@ -0,0 +1,165 @@
+// Package fdsn scarica i cataloghi pubblicati dai servizi FDSN event
+// (INGV, EMSC, USGS e le altre agenzie che implementano lo standard)
+// nel formato testo, una riga per evento con i campi separati da "|":
+//
+//	#EventID|Time|Latitude|Longitude|Depth/km|Author|Catalog|Contributor|ContributorID|MagType|Magnitude|MagAuthor|EventLocationName|EventType
+//	37346241|2024-08-02T01:02:03.100000|43.6|13.5|8.1|SURVEY-INGV||||ML|2.3|--|Costa Marchigiana Anconetana (Ancona)|earthquake
+//
+// Ogni evento viene etichettato con l'agenzia da cui arriva: l'ID diventa
+// "<agenzia>:<EventID>" (es. "ingv:37346241") e il campo Source vale "<agenzia>".
+// TextWriter scrive lo stesso formato, per il nostro servizio FDSN event.
+package fdsn
+
+import (
+	"backend-go/models"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Colonne standard del formato testo, nell'ordine usato quando manca l'intestazione
+var standardColumns = []string{
+	"eventid", "time", "latitude", "longitude", "depth/km", "author", "catalog",
+	"contributor", "contributorid", "magtype", "magnitude", "magauthor", "eventlocationname", "eventtype",
+}
+
+// LineError descrive una riga scartata perché incompleta o non leggibile
+type LineError struct {
+	Line int    // Numero di riga nel documento (da 1)
+	ID   string // ID dell'evento, se presente
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("riga %d (%s): %v", e.Line, e.ID, e.Err)
+}
+
+// ParseText legge un catalogo in formato testo FDSN e restituisce i terremoti validi,
+// etichettati con source (l'agenzia, es. "ingv"). Le righe incomplete vengono scartate
+// e riportate in skipped; err è diverso da nil solo se il documento non è leggibile.
+// Le colonne vengono riconosciute dall'intestazione (la riga che inizia con "#"),
+// così l'ordine o le colonne in più di alcune agenzie non sono un problema.
+func ParseText(r io.Reader, source string) (events []models.Earthquake, skipped []LineError, err error) {
+	columns := columnIndex(standardColumns)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "#") {
+			columns = columnIndex(strings.Split(strings.TrimPrefix(text, "#"), "|"))
+			continue
+		}
+
+		fields := strings.Split(text, "|")
+		ev, err := rowToEarthquake(fields, columns, source)
+		if err != nil {
+			skipped = append(skipped, LineError{Line: line, ID: ev.ID, Err: err})
+			continue
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("catalogo FDSN non leggibile: %w", err)
+	}
+	return events, skipped, nil
+}
+
+// Posizione di ogni colonna, per nome in minuscolo
+func columnIndex(names []string) map[string]int {
+	columns := make(map[string]int, len(names))
+	for i, name := range names {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	return columns
+}
+
+// Converte una riga. Come per il GeoJSON, il luogo mancante diventa "Unknown"
+// e la magnitudo e la profondità mancanti diventano 0.
+func rowToEarthquake(fields []string, columns map[string]int, source string) (models.Earthquake, error) {
+	get := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	ev := models.Earthquake{Place: "Unknown", Source: source}
+	id := get("eventid")
+	if id == "" {
+		return ev, errors.New("manca EventID")
+	}
+	ev.ID = id
+	if source != "" {
+		ev.ID = source + ":" + id
+	}
+	if get("eventtype") == "not existing" {
+		return ev, errors.New("evento annullato dall'agenzia (EventType \"not existing\")")
+	}
+
+	t, err := parseTime(get("time"))
+	if err != nil {
+		return ev, err
+	}
+	ev.Time = t.UnixMilli()
+
+	lat, err := parseFloat("Latitude", get("latitude"), true)
+	if err != nil {
+		return ev, err
+	}
+	lon, err := parseFloat("Longitude", get("longitude"), true)
+	if err != nil {
+		return ev, err
+	}
+	depth, err := parseFloat("Depth/km", get("depth/km"), false)
+	if err != nil {
+		return ev, err
+	}
+	ev.Coordinates = []float64{lon, lat, depth}
+
+	if ev.Magnitude, err = parseFloat("Magnitude", get("magnitude"), false); err != nil {
+		return ev, err
+	}
+	if place := get("eventlocationname"); place != "" {
+		ev.Place = place
+	}
+	return ev, nil
+}
+
+// Legge un numero; se il campo è vuoto e non è obbligatorio vale 0
+func parseFloat(name, s string, required bool) (float64, error) {
+	if s == "" {
+		if required {
+			return 0, fmt.Errorf("manca %s", name)
+		}
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s non valido: %q", name, s)
+	}
+	return f, nil
+}
+
+// Le agenzie scrivono il tempo ISO 8601 con o senza "Z" (senza si intende UTC)
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("manca Time")
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Time non valido: %q", s)
+}
@@ -0,0 +1,165 @@
+package fdsn
+
+import (
+	"backend-go/models"
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseFile(t *testing.T, name, source string) ([]models.Earthquake, []LineError) {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, skipped, err := ParseText(f, source)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return events, skipped
+}
+
+func ms(s string) int64 {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		panic(err)
+	}
+	return t.UnixMilli()
+}
+
+func TestParseText(t *testing.T) {
+	events, skipped := parseFile(t, "ingv.txt", "ingv")
+
+	//ID con il prefisso dell'agenzia; profondità e magnitudo vuote valgono 0, il luogo vuoto "Unknown"
+	want := []models.Earthquake{
+		{
+			ID: "ingv:37346241", Source: "ingv", Place: "3 km SW Norcia (PG)", Magnitude: 3.4,
+			Time: ms("2024-08-02T01:02:03.46Z"), Coordinates: []float64{13.0612, 42.7701, 8.1},
+		},
+		{
+			ID: "ingv:37346250", Source: "ingv", Place: "Costa Marchigiana Anconetana (Ancona)", Magnitude: 2.3,
+			Time: ms("2024-08-02T01:20:44.12Z"), Coordinates: []float64{13.5, 43.6, 0},
+		},
+		{
+			ID: "ingv:37346261", Source: "ingv", Place: "Stretto di Messina", Magnitude: 0,
+			Time: ms("2024-08-02T01:31:10Z"), Coordinates: []float64{15.6, 38.2, 10.4},
+		},
+		{
+			ID: "ingv:37346270", Source: "ingv", Place: "Unknown", Magnitude: 1.1,
+			Time: ms("2024-08-02T01:45:00Z"), Coordinates: []float64{10.2, 44.1, 5},
+		},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("eventi letti:\n%+v\nattesi:\n%+v", events, want)
+	}
+
+	//Le righe scartate sono riportate con il numero di riga (la riga vuota conta)
+	wantSkipped := []struct {
+		line int
+		id   string
+		err  string
+	}{
+		{7, "ingv:37346300", "not existing"},
+		{8, "ingv:37346310", "Latitude non valido"},
+		{9, "ingv:37346320", "manca Time"},
+		{10, "", "manca EventID"},
+		{11, "ingv:37346340", "Time non valido"},
+		{12, "ingv:37346350", "manca Longitude"},
+		{13, "ingv:37346360", "Depth/km non valido"},
+	}
+	if len(skipped) != len(wantSkipped) {
+		t.Fatalf("righe scartate: %v", skipped)
+	}
+	for i, w := range wantSkipped {
+		s := skipped[i]
+		if s.Line != w.line || s.ID != w.id || !strings.Contains(s.Err.Error(), w.err) {
+			t.Errorf("riga scartata %d: %v, attesa riga %d (%s): %s", i, s, w.line, w.id, w.err)
+		}
+	}
+}
+
+func TestParseTextColumnsFromHeader(t *testing.T) {
+	//Colonne in un altro ordine, con spazi, una colonna in più e righe CRLF
+	events, skipped := parseFile(t, "emsc.txt", "emsc")
+	if len(skipped) != 0 {
+		t.Fatalf("righe scartate: %v", skipped)
+	}
+	want := []models.Earthquake{
+		{
+			ID: "emsc:20240802_0000042", Source: "emsc", Place: "DODECANESE ISLANDS, GREECE", Magnitude: 4.7,
+			Time: ms("2024-08-02T03:44:10.1Z"), Coordinates: []float64{28.51, 36.42, 12},
+		},
+		{
+			ID: "emsc:20240802_0000043", Source: "emsc", Place: "SOUTHERN ITALY", Magnitude: 2.9,
+			Time: ms("2024-08-02T04:01:02.5Z"), Coordinates: []float64{14.14, 40.83, 0},
+		},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("eventi letti:\n%+v\nattesi:\n%+v", events, want)
+	}
+}
+
+func TestParseTextWithoutHeader(t *testing.T) {
+	//Senza intestazione valgono le colonne standard; senza agenzia l'ID resta com'è
+	events, skipped := parseFile(t, "noheader.txt", "")
+	if len(skipped) != 0 || len(events) != 1 {
+		t.Fatalf("eventi %+v, scartati %v", events, skipped)
+	}
+	ev := events[0]
+	if ev.ID != "us7000n0ab" || ev.Source != "" || ev.Magnitude != 4.9 ||
+		!reflect.DeepEqual(ev.Coordinates, []float64{-178.123, -24.567, 540.2}) {
+		t.Fatalf("evento letto: %+v", ev)
+	}
+}
+
+func TestTextWriterRoundTrip(t *testing.T) {
+	events, _ := parseFile(t, "ingv.txt", "")
+
+	var buf bytes.Buffer
+	w := NewTextWriter(&buf)
+	for _, ev := range events {
+		if err := w.Write(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), textHeader) {
+		t.Fatalf("manca l'intestazione:\n%s", buf.String())
+	}
+
+	again, skipped, err := ParseText(&buf, "")
+	if err != nil || len(skipped) != 0 {
+		t.Fatalf("documento scritto non valido: %v, %v", err, skipped)
+	}
+	if !reflect.DeepEqual(again, events) {
+		t.Fatalf("dopo la riscrittura:\n%+v\nattesi:\n%+v", again, events)
+	}
+}
+
+func TestTextWriterEmptyAndSeparator(t *testing.T) {
+	//Anche senza eventi il documento ha l'intestazione
+	var buf bytes.Buffer
+	if err := NewTextWriter(&buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != textHeader {
+		t.Fatalf("documento vuoto: %q", buf.String())
+	}
+
+	//Il separatore nel nome del luogo non deve spostare le colonne
+	buf.Reset()
+	w := NewTextWriter(&buf)
+	w.Write(models.Earthquake{ID: "x1", Place: "Tra A|B", Time: ms("2024-08-02T00:00:00Z"), Coordinates: []float64{1, 2, 3}})
+	w.Close()
+	events, skipped, _ := ParseText(&buf, "")
+	if len(skipped) != 0 || len(events) != 1 || events[0].Place != "Tra A B" {
+		t.Fatalf("eventi %+v, scartati %v", events, skipped)
+	}
+}
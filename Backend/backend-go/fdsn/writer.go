@@ -0,0 +1,77 @@
+package fdsn
+
+import (
+	"backend-go/models"
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Intestazione del formato testo che scriviamo (le colonne standard)
+const textHeader = "#EventID|Time|Latitude|Longitude|Depth/km|Author|Catalog|Contributor|ContributorID|MagType|Magnitude|MagAuthor|EventLocationName|EventType\n"
+
+// Il tempo come lo scrivono le agenzie: UTC, senza fuso, al microsecondo
+const textTimeLayout = "2006-01-02T15:04:05.000000"
+
+// TextWriter scrive un catalogo nel formato testo FDSN, un evento alla volta.
+// Il documento si rilegge con ParseText.
+type TextWriter struct {
+	w       *bufio.Writer
+	started bool
+}
+
+// NewTextWriter crea un TextWriter. Le righe passano da un buffer: arrivano a w
+// quando il buffer è pieno e, per l'ultima parte, con Close
+func NewTextWriter(w io.Writer) *TextWriter {
+	return &TextWriter{w: bufio.NewWriter(w)}
+}
+
+// Write aggiunge la riga di un evento. Autore e contributore sono l'agenzia
+// da cui arriva l'origine; il tipo di magnitudo non lo conserviamo, quindi resta vuoto.
+func (t *TextWriter) Write(ev models.Earthquake) error {
+	if !t.started {
+		t.started = true
+		if _, err := io.WriteString(t.w, textHeader); err != nil {
+			return err
+		}
+	}
+	var lat, lon, depth string
+	if len(ev.Coordinates) >= 2 {
+		lon, lat = formatFloat(ev.Coordinates[0]), formatFloat(ev.Coordinates[1])
+	}
+	if len(ev.Coordinates) >= 3 {
+		depth = formatFloat(ev.Coordinates[2])
+	}
+	agency := strings.ToUpper(ev.Agency())
+	fields := []string{
+		ev.ID,
+		time.UnixMilli(ev.Time).UTC().Format(textTimeLayout),
+		lat, lon, depth,
+		agency, "", agency, ev.ID,
+		"", formatFloat(ev.Magnitude), agency,
+		ev.Place, "earthquake",
+	}
+	for i, f := range fields {
+		//Il separatore non può comparire nei campi (es. nel nome del luogo)
+		fields[i] = strings.ReplaceAll(f, "|", " ")
+	}
+	_, err := io.WriteString(t.w, strings.Join(fields, "|")+"\n")
+	return err
+}
+
+// Close scrive l'intestazione se non c'erano eventi e svuota il buffer. Non chiude w.
+func (t *TextWriter) Close() error {
+	if !t.started {
+		t.started = true
+		if _, err := io.WriteString(t.w, textHeader); err != nil {
+			return err
+		}
+	}
+	return t.w.Flush()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
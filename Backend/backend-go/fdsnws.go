@@ -0,0 +1,497 @@
+package main
+
+import (
+	"backend-go/fdsn"
+	"backend-go/models"
+	"backend-go/quakeml"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//SERVIZIO FDSN EVENT
+//Gli strumenti di sismologia (ObsPy, i client di SeisComP, ...) interrogano i cataloghi
+//con l'interfaccia standard fdsnws-event: /fdsnws/event/1/query con i parametri e
+//i codici di risposta definiti dalla specifica FDSN (versione 1.2). Qui la implementiamo
+//sopra EventStore, così il backend può fare da server di catalogo per quegli strumenti.
+//Come in /api/events restituiamo gli eventi reali, un'origine (la preferita) per evento logico.
+
+const fdsnwsVersion = "1.2.0"
+
+// Una ricerca per distanza il cui cerchio contiene più di FDSNMaxEvents eventi
+var errFDSNCircleTooLarge = errors.New("il cerchio contiene troppi eventi")
+
+// Abbreviazioni dei parametri ammesse dalla specifica
+var fdsnAliases = map[string]string{
+	"start":   "starttime",
+	"end":     "endtime",
+	"minlat":  "minlatitude",
+	"maxlat":  "maxlatitude",
+	"minlon":  "minlongitude",
+	"maxlon":  "maxlongitude",
+	"lat":     "latitude",
+	"lon":     "longitude",
+	"minmag":  "minmagnitude",
+	"maxmag":  "maxmagnitude",
+	"magtype": "magnitudetype",
+}
+
+// Parametri supportati, con il nome completo
+var fdsnParams = map[string]bool{
+	"starttime": true, "endtime": true,
+	"minlatitude": true, "maxlatitude": true, "minlongitude": true, "maxlongitude": true,
+	"latitude": true, "longitude": true, "minradius": true, "maxradius": true,
+	"mindepth": true, "maxdepth": true, "minmagnitude": true, "maxmagnitude": true,
+	"orderby": true, "limit": true, "offset": true, "eventid": true,
+	"format": true, "nodata": true,
+	"includeallorigins": true, "includeallmagnitudes": true, "includearrivals": true,
+}
+
+// Parametri della specifica che non possiamo rispettare: non conserviamo il tipo
+// di magnitudo, il catalogo di provenienza né il momento dell'ultimo aggiornamento
+// come campo interrogabile. Meglio un 400 che una risposta che li ignora.
+var fdsnUnsupported = map[string]bool{
+	"magnitudetype": true, "catalog": true, "contributor": true, "updatedafter": true, "eventtype": true,
+}
+
+// Una richiesta a /query già validata
+type fdsnRequest struct {
+	filter models.EventFilter
+
+	//Ricerca per distanza (gradi) dal punto lat, lon; radial false se non richiesta
+	radial               bool
+	lat, lon             float64
+	minRadius, maxRadius float64
+
+	limit   int64 // 0 = nessun limite (fino a FDSNMaxEvents)
+	offset  int64 // Posizione del primo evento, da 1
+	eventID string
+	format  string // xml o text
+	nodata  int    // 204 o 404
+}
+
+// Legge i parametri di /query. I nomi non distinguono maiuscole e minuscole,
+// le abbreviazioni valgono quanto i nomi completi; un parametro sconosciuto
+// o ripetuto è un errore, come chiede la specifica.
+func parseFDSNRequest(values url.Values) (fdsnRequest, error) {
+	req := fdsnRequest{offset: 1, format: "xml", nodata: http.StatusNoContent}
+	params := make(map[string]string)
+	for key, vals := range values {
+		name := strings.ToLower(key)
+		if full, ok := fdsnAliases[name]; ok {
+			name = full
+		}
+		if fdsnUnsupported[name] {
+			return req, fmt.Errorf("il parametro %s non è supportato da questo servizio", key)
+		}
+		if !fdsnParams[name] {
+			return req, fmt.Errorf("parametro sconosciuto: %s", key)
+		}
+		if _, seen := params[name]; seen || len(vals) > 1 {
+			return req, fmt.Errorf("il parametro %s è indicato più volte", name)
+		}
+		params[name] = strings.TrimSpace(vals[0])
+	}
+
+	//Legge un numero nell'intervallo [min, max]; nil se il parametro manca
+	float := func(name string, min, max float64) (*float64, error) {
+		raw, ok := params[name]
+		if !ok {
+			return nil, nil
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(v) || v < min || v > max {
+			return nil, fmt.Errorf("parametro %s non valido: %q (deve essere compreso tra %g e %g)", name, raw, min, max)
+		}
+		return &v, nil
+	}
+	var err error
+	f := &req.filter
+
+	//Tempi in ISO 8601, in UTC (anche solo la data)
+	for name, dst := range map[string]**int64{"starttime": &f.StartTime, "endtime": &f.EndTime} {
+		raw, ok := params[name]
+		if !ok {
+			continue
+		}
+		t, err := parseISOTime(raw)
+		if err != nil {
+			return req, fmt.Errorf("parametro %s non valido: %q (serve un tempo ISO 8601, es. 2024-08-02T01:02:03)", name, raw)
+		}
+		ms := t.UnixMilli()
+		*dst = &ms
+	}
+	if f.StartTime != nil && f.EndTime != nil && *f.EndTime < *f.StartTime {
+		return req, fmt.Errorf("endtime è precedente a starttime")
+	}
+
+	//Rettangolo: i limiti mancanti valgono quelli del globo
+	box := models.BoundingBox{MinLat: -90, MaxLat: 90, MinLon: -180, MaxLon: 180}
+	boxParams := []struct {
+		name     string
+		min, max float64
+		dst      *float64
+	}{
+		{"minlatitude", -90, 90, &box.MinLat},
+		{"maxlatitude", -90, 90, &box.MaxLat},
+		{"minlongitude", -180, 180, &box.MinLon},
+		{"maxlongitude", -180, 180, &box.MaxLon},
+	}
+	for _, p := range boxParams {
+		v, err := float(p.name, p.min, p.max)
+		if err != nil {
+			return req, err
+		}
+		if v != nil {
+			*p.dst = *v
+			f.BBox = &box
+		}
+	}
+	if box.MinLat > box.MaxLat {
+		return req, fmt.Errorf("minlatitude è maggiore di maxlatitude")
+	}
+
+	//Cerchio: centro di default (0, 0) e raggio in gradi tra minradius e maxradius
+	req.maxRadius = 180
+	radialParams := []struct {
+		name     string
+		min, max float64
+		dst      *float64
+	}{
+		{"latitude", -90, 90, &req.lat},
+		{"longitude", -180, 180, &req.lon},
+		{"minradius", 0, 180, &req.minRadius},
+		{"maxradius", 0, 180, &req.maxRadius},
+	}
+	for _, p := range radialParams {
+		v, err := float(p.name, p.min, p.max)
+		if err != nil {
+			return req, err
+		}
+		if v != nil {
+			*p.dst = *v
+			req.radial = true
+		}
+	}
+	if req.minRadius > req.maxRadius {
+		return req, fmt.Errorf("minradius è maggiore di maxradius")
+	}
+
+	if f.MinDepth, err = float("mindepth", -math.MaxFloat64, math.MaxFloat64); err != nil {
+		return req, err
+	}
+	if f.MaxDepth, err = float("maxdepth", -math.MaxFloat64, math.MaxFloat64); err != nil {
+		return req, err
+	}
+	if f.MinDepth != nil && f.MaxDepth != nil && *f.MinDepth > *f.MaxDepth {
+		return req, fmt.Errorf("mindepth è maggiore di maxdepth")
+	}
+	if f.MinMagnitude, err = float("minmagnitude", -math.MaxFloat64, math.MaxFloat64); err != nil {
+		return req, err
+	}
+	if f.MaxMagnitude, err = float("maxmagnitude", -math.MaxFloat64, math.MaxFloat64); err != nil {
+		return req, err
+	}
+	if f.MinMagnitude != nil && f.MaxMagnitude != nil && *f.MinMagnitude > *f.MaxMagnitude {
+		return req, fmt.Errorf("minmagnitude è maggiore di maxmagnitude")
+	}
+
+	var ok bool
+	if f.Sort, ok = sortOrders[params["orderby"]]; !ok {
+		return req, fmt.Errorf("parametro orderby non valido: %q (valori ammessi: time, time-asc, magnitude, magnitude-asc)", params["orderby"])
+	}
+
+	if raw, ok := params["limit"]; ok {
+		if req.limit, err = strconv.ParseInt(raw, 10, 64); err != nil || req.limit < 1 {
+			return req, fmt.Errorf("parametro limit non valido: %q (serve un intero positivo)", raw)
+		}
+	}
+	if raw, ok := params["offset"]; ok {
+		if req.offset, err = strconv.ParseInt(raw, 10, 64); err != nil || req.offset < 1 {
+			return req, fmt.Errorf("parametro offset non valido: %q (il primo evento è 1)", raw)
+		}
+	}
+
+	switch params["format"] {
+	case "", "xml":
+	case "text":
+		req.format = "text"
+	default:
+		return req, fmt.Errorf("parametro format non valido: %q (valori ammessi: xml, text)", params["format"])
+	}
+	switch params["nodata"] {
+	case "", "204":
+	case "404":
+		req.nodata = http.StatusNotFound
+	default:
+		return req, fmt.Errorf("parametro nodata non valido: %q (valori ammessi: 204, 404)", params["nodata"])
+	}
+
+	//Accettati per compatibilità: ogni evento ha una sola origine e una sola
+	//magnitudo nella risposta, e non conserviamo le fasi
+	for _, name := range []string{"includeallorigins", "includeallmagnitudes", "includearrivals"} {
+		if raw, ok := params[name]; ok {
+			if _, err := strconv.ParseBool(raw); err != nil {
+				return req, fmt.Errorf("parametro %s non valido: %q", name, raw)
+			}
+		}
+	}
+
+	req.eventID = params["eventid"]
+	simulated := false
+	f.Simulated = &simulated
+	f.Preferred = true
+	return req, nil
+}
+
+// Gradi di arco sulla superficie terrestre in km
+func degreesToKm(deg float64) float64 {
+	return deg * math.Pi / 180 * models.EarthRadiusKm
+}
+
+// Handler di /fdsnws/event/1/query
+func (app *App) fdsnQuery(c *gin.Context) {
+	req, err := parseFDSNRequest(c.Request.URL.Query())
+	if err != nil {
+		fdsnError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	//Con limit oltre il massimo la risposta sarebbe comunque troppo grande
+	if req.limit > app.FDSNMaxEvents {
+		fdsnError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("limit supera il numero massimo di eventi per richiesta (%d)", app.FDSNMaxEvents))
+		return
+	}
+
+	events, err := app.fdsnEvents(c, req)
+	if errors.Is(err, errFDSNCircleTooLarge) {
+		fdsnError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("il cerchio contiene più di %d eventi: ridurre maxradius o restringere gli altri filtri", app.FDSNMaxEvents))
+		return
+	}
+	if err != nil {
+		log.Printf("Errore nella query FDSN: %v", err)
+		fdsnError(c, http.StatusInternalServerError, "errore nella lettura del catalogo")
+		return
+	}
+	//Senza limit leggiamo un evento in più del massimo per sapere se la risposta lo supera
+	if req.limit == 0 && int64(len(events)) > app.FDSNMaxEvents {
+		fdsnError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("la richiesta restituirebbe più di %d eventi: restringere i filtri o usare limit e offset", app.FDSNMaxEvents))
+		return
+	}
+	if len(events) == 0 {
+		if req.nodata == http.StatusNotFound {
+			fdsnError(c, http.StatusNotFound, "nessun evento soddisfa la richiesta")
+			return
+		}
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	var writer interface {
+		Write(models.Earthquake) error
+		Close() error
+	}
+	if req.format == "text" {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		writer = fdsn.NewTextWriter(c.Writer)
+	} else {
+		c.Header("Content-Type", "application/xml")
+		writer = quakeml.NewWriter(c.Writer, quakeml.DefaultAuthority)
+	}
+	c.Status(http.StatusOK)
+	//Lo stato 200 è già partito: se la scrittura si interrompe chiudiamo la connessione,
+	//così il client non scambia un catalogo troncato per la risposta completa
+	for _, ev := range events {
+		if err := writer.Write(ev); err != nil {
+			log.Printf("Risposta FDSN interrotta: %v", err)
+			abortConnection(c)
+			return
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Risposta FDSN interrotta: %v", err)
+		abortConnection(c)
+	}
+}
+
+// Legge dallo store gli eventi della richiesta, già saltati i primi offset-1.
+// Prima di scrivere la risposta dobbiamo sapere se è vuota (204) o troppo grande (413),
+// quindi gli eventi vengono caricati in memoria: al massimo FDSNMaxEvents+1.
+func (app *App) fdsnEvents(c *gin.Context, req fdsnRequest) ([]models.Earthquake, error) {
+	ctx := c.Request.Context()
+	if req.eventID != "" {
+		return app.fdsnEvent(c, req)
+	}
+
+	skip := req.offset - 1
+	want := req.limit
+	if want == 0 {
+		want = app.FDSNMaxEvents + 1
+	}
+
+	var events []models.Earthquake
+	if !req.radial {
+		var err error
+		if events, err = app.Store.Query(ctx, req.filter, skip+want); err != nil {
+			return nil, err
+		}
+	} else {
+		//Near ordina per distanza, la risposta invece per tempo o magnitudo (orderby non
+		//ammette la distanza): i primi skip+want eventi più vicini non sono i primi
+		//nell'ordine richiesto, quindi non possiamo passare a Near il limite della pagina.
+		//Leggiamo il cerchio fino a FDSNMaxEvents+1 eventi e lo riordiniamo; se ne contiene
+		//di più rispondiamo 413 invece di caricarlo tutto in memoria
+		readLimit := app.FDSNMaxEvents + 1
+		nearby, err := app.Store.Near(ctx, req.lat, req.lon, degreesToKm(req.maxRadius), req.filter, readLimit)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(nearby)) >= readLimit {
+			return nil, errFDSNCircleTooLarge
+		}
+		minKm := degreesToKm(req.minRadius)
+		for _, n := range nearby {
+			if n.DistanceKm >= minKm {
+				events = append(events, n.Earthquake)
+			}
+		}
+		sort.Slice(events, func(i, j int) bool { return req.filter.Sort.Less(events[i], events[j]) })
+	}
+
+	if int64(len(events)) <= skip {
+		return nil, nil
+	}
+	events = events[skip:]
+	if int64(len(events)) > want {
+		events = events[:want]
+	}
+	return events, nil
+}
+
+// Evento richiesto con eventid. Come per le altre richieste rispondiamo con l'evento
+// logico: se l'ID è quello di un'origine secondaria restituiamo l'origine preferita
+// del suo evento logico. Gli eventi archiviati o simulati, o che non rispettano
+// gli altri filtri della richiesta, non vengono restituiti.
+func (app *App) fdsnEvent(c *gin.Context, req fdsnRequest) ([]models.Earthquake, error) {
+	ctx := c.Request.Context()
+	ev, err := app.Store.Get(ctx, req.eventID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ev.ArchivedAt > 0 {
+		return nil, nil
+	}
+	if ev.Secondary && ev.LogicalID != "" {
+		preferred, err := app.Store.Query(ctx, models.EventFilter{LogicalID: ev.LogicalID, Preferred: true}, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(preferred) > 0 {
+			ev = preferred[0]
+		}
+	}
+	if !req.filter.Matches(ev) {
+		return nil, nil
+	}
+	return []models.Earthquake{ev}, nil
+}
+
+// Risposta di errore nel formato della specifica: testo semplice con il codice,
+// la descrizione, la richiesta e la versione del servizio
+func fdsnError(c *gin.Context, status int, detail string) {
+	body := fmt.Sprintf("Error %d: %s\n\n%s\n\nUsage details are available from /fdsnws/event/1/application.wadl\n\nRequest:\n%s\n\nRequest Submitted:\n%s\n\nService version:\n%s\n",
+		status, http.StatusText(status), detail, c.Request.URL.RequestURI(),
+		time.Now().UTC().Format("2006-01-02T15:04:05.000000"), fdsnwsVersion)
+	c.Data(status, "text/plain; charset=utf-8", []byte(body))
+}
+
+// Handler di /fdsnws/event/1/version
+func fdsnVersion(c *gin.Context) {
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(fdsnwsVersion))
+}
+
+// Handler di /fdsnws/event/1/application.wadl. I client (es. ObsPy) leggono
+// la descrizione del servizio per sapere quali parametri sono supportati.
+func fdsnWADL(c *gin.Context) {
+	c.Data(http.StatusOK, "application/xml", []byte(fdsnWADLDocument))
+}
+
+const fdsnWADLDocument = `<?xml version="1.0" encoding="UTF-8"?>
+<application xmlns="http://wadl.dev.java.net/2009/02" xmlns:xsd="http://www.w3.org/2001/XMLSchema">
+  <resources base="/fdsnws/event/1">
+    <resource path="query">
+      <method name="GET" id="query">
+        <request>
+          <param name="starttime" style="query" type="xsd:dateTime"/>
+          <param name="endtime" style="query" type="xsd:dateTime"/>
+          <param name="minlatitude" style="query" type="xsd:double" default="-90.0"/>
+          <param name="maxlatitude" style="query" type="xsd:double" default="90.0"/>
+          <param name="minlongitude" style="query" type="xsd:double" default="-180.0"/>
+          <param name="maxlongitude" style="query" type="xsd:double" default="180.0"/>
+          <param name="latitude" style="query" type="xsd:double" default="0.0"/>
+          <param name="longitude" style="query" type="xsd:double" default="0.0"/>
+          <param name="minradius" style="query" type="xsd:double" default="0.0"/>
+          <param name="maxradius" style="query" type="xsd:double" default="180.0"/>
+          <param name="mindepth" style="query" type="xsd:double"/>
+          <param name="maxdepth" style="query" type="xsd:double"/>
+          <param name="minmagnitude" style="query" type="xsd:double"/>
+          <param name="maxmagnitude" style="query" type="xsd:double"/>
+          <param name="includeallorigins" style="query" type="xsd:boolean" default="false"/>
+          <param name="includeallmagnitudes" style="query" type="xsd:boolean" default="false"/>
+          <param name="includearrivals" style="query" type="xsd:boolean" default="false"/>
+          <param name="eventid" style="query" type="xsd:string"/>
+          <param name="limit" style="query" type="xsd:int"/>
+          <param name="offset" style="query" type="xsd:int" default="1"/>
+          <param name="orderby" style="query" type="xsd:string" default="time">
+            <option value="time"/>
+            <option value="time-asc"/>
+            <option value="magnitude"/>
+            <option value="magnitude-asc"/>
+          </param>
+          <param name="format" style="query" type="xsd:string" default="xml">
+            <option value="xml" mediaType="application/xml"/>
+            <option value="text" mediaType="text/plain"/>
+          </param>
+          <param name="nodata" style="query" type="xsd:int" default="204">
+            <option value="204"/>
+            <option value="404"/>
+          </param>
+        </request>
+        <response status="200">
+          <representation mediaType="application/xml"/>
+          <representation mediaType="text/plain"/>
+        </response>
+        <response status="204 400 404 413 500"/>
+      </method>
+    </resource>
+    <resource path="version">
+      <method name="GET">
+        <response>
+          <representation mediaType="text/plain"/>
+        </response>
+      </method>
+    </resource>
+    <resource path="application.wadl">
+      <method name="GET">
+        <response>
+          <representation mediaType="application/xml"/>
+        </response>
+      </method>
+    </resource>
+  </resources>
+</application>
+`
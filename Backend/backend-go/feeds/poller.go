@@ -0,0 +1,196 @@
+// Package feeds scarica i feed GeoJSON "summary" di USGS direttamente dal backend Go,
+// senza passare dal sensor agent Python. Usa le richieste condizionali
+// (ETag / Last-Modified): se il feed non è cambiato USGS risponde 304
+// e non scarichiamo né riprocessiamo nulla.
+package feeds
+
+import (
+	"backend-go/geojson"
+	"backend-go/models"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Indirizzo di default dei feed summary di USGS
+const DefaultBaseURL = "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary"
+
+// Feed disponibili, con gli stessi nomi usati dal frontend e dal sensor agent
+var DefaultFeeds = map[string]string{
+	"hour":   "all_hour.geojson",
+	"day":    "all_day.geojson",
+	"7days":  "all_week.geojson",
+	"30days": "all_month.geojson",
+}
+
+// Il feed mensile pesa qualche decina di MB: oltre questo limite qualcosa non va
+const maxFeedSize = 256 << 20
+
+// Attesa massima di default tra due tentativi dopo una serie di errori
+const DefaultMaxBackoff = 15 * time.Minute
+
+// ErrUnknownFeed indica un nome di feed non configurato
+var ErrUnknownFeed = errors.New("feed sconosciuto")
+
+// Sink riceve gli eventi letti da un feed (es. per metterli nella coda dei worker).
+// Se restituisce un errore il feed verrà riscaricato per intero al giro successivo.
+type Sink func(ctx context.Context, feed string, events []models.Earthquake) error
+
+// Result è l'esito di un download
+type Result struct {
+	Feed        string    `json:"feed"`
+	URL         string    `json:"url"`
+	NotModified bool      `json:"not_modified"` // USGS ha risposto 304
+	Events      int       `json:"events"`       // Eventi passati al Sink
+	Skipped     int       `json:"skipped"`      // Feature scartate perché incomplete
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// Poller scarica i feed configurati e passa gli eventi al Sink
+type Poller struct {
+	URLs   map[string]string // Nome del feed -> URL
+	Client *http.Client
+	Sink   Sink
+
+	//Dopo un errore Run aspetta il doppio dell'intervallo, poi il quadruplo, ...
+	//fino a MaxBackoff, così un feed che non risponde non viene interrogato di continuo
+	MaxBackoff time.Duration
+
+	//ETag e Last-Modified dell'ultimo download riuscito, per URL
+	mu         sync.Mutex
+	validators map[string]validator
+}
+
+type validator struct {
+	etag         string
+	lastModified string
+}
+
+// New crea un Poller con un client HTTP con timeout
+func New(urls map[string]string, sink Sink) *Poller {
+	return &Poller{
+		URLs:       urls,
+		Client:     &http.Client{Timeout: 60 * time.Second},
+		Sink:       sink,
+		MaxBackoff: DefaultMaxBackoff,
+		validators: make(map[string]validator),
+	}
+}
+
+// URLsFromBase costruisce gli URL dei feed di default a partire da un indirizzo base
+// (es. un server locale con dei file di prova)
+func URLsFromBase(base string) map[string]string {
+	urls := make(map[string]string, len(DefaultFeeds))
+	for name, file := range DefaultFeeds {
+		urls[name] = base + "/" + file
+	}
+	return urls
+}
+
+// Fetch scarica un feed con una richiesta condizionale e passa gli eventi al Sink
+func (p *Poller) Fetch(ctx context.Context, feed string) (Result, error) {
+	url, ok := p.URLs[feed]
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %q", ErrUnknownFeed, feed)
+	}
+	result := Result{Feed: feed, URL: url, FetchedAt: time.Now().UTC()}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Accept", "application/geo+json, application/json")
+	p.mu.Lock()
+	v := p.validators[url]
+	p.mu.Unlock()
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		result.NotModified = true
+		return result, nil
+	case http.StatusOK:
+	default:
+		return result, fmt.Errorf("feed %s: risposta HTTP %d", feed, resp.StatusCode)
+	}
+
+	events, skipped, err := geojson.ParseFeatureCollection(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return result, fmt.Errorf("feed %s: %w", feed, err)
+	}
+	for _, s := range skipped {
+		log.Printf("Feed %s: %v", feed, s)
+	}
+	result.Skipped = len(skipped)
+
+	if err := p.Sink(ctx, feed, events); err != nil {
+		return result, err
+	}
+	result.Events = len(events)
+
+	//Salviamo i validatori solo dopo che il Sink ha accettato tutto:
+	//altrimenti un 304 ci farebbe perdere gli eventi non consegnati
+	p.mu.Lock()
+	p.validators[url] = validator{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	p.mu.Unlock()
+	return result, nil
+}
+
+// Run scarica il feed indicato ogni interval, finché il contesto non viene annullato.
+// Il primo download parte subito. Dopo un errore l'attesa cresce (vedi Backoff)
+// e torna a interval al primo download riuscito.
+func (p *Poller) Run(ctx context.Context, feed string, interval time.Duration) {
+	failures := 0
+	for {
+		delay := interval
+		result, err := p.Fetch(ctx, feed)
+		switch {
+		case err != nil:
+			failures++
+			delay = p.Backoff(interval, failures)
+			log.Printf("Feed %s: errore %v (nuovo tentativo tra %s)", feed, err, delay)
+		case !result.NotModified:
+			failures = 0
+			log.Printf("Feed %s: %d eventi in coda, %d scartati", feed, result.Events, result.Skipped)
+		default:
+			failures = 0
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Backoff è l'attesa dopo failures errori consecutivi: interval raddoppiato
+// ad ogni errore, al massimo MaxBackoff (ma mai meno di interval)
+func (p *Poller) Backoff(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return max(interval, min(delay, p.MaxBackoff))
+}
@@ -0,0 +1,233 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"backend-go/models"
+)
+
+// Server di prova che pubblica il feed di testdata con ETag e Last-Modified
+// e risponde 304 alle richieste condizionali, come USGS.
+// failures indica quante richieste iniziali devono fallire con 503.
+type feedServer struct {
+	t        *testing.T
+	body     []byte
+	etag     string
+	failures int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	times    []time.Time
+}
+
+const fixtureLastModified = "Fri, 02 Aug 2024 01:02:03 GMT"
+
+func newFeedServer(t *testing.T) (*feedServer, *httptest.Server) {
+	t.Helper()
+	body, err := os.ReadFile("testdata/all_hour.geojson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &feedServer{t: t, body: body, etag: `"v1"`}
+	srv := httptest.NewServer(fs)
+	t.Cleanup(srv.Close)
+	return fs, srv
+}
+
+func (fs *feedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	fs.requests = append(fs.requests, r)
+	fs.times = append(fs.times, time.Now())
+	fail := len(fs.requests) <= fs.failures
+	etag := fs.etag
+	fs.mu.Unlock()
+
+	if fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fixtureLastModified)
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(fs.body)
+}
+
+func (fs *feedServer) request(i int) *http.Request {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.requests[i]
+}
+
+// Sink che conta le consegne; se err non è nil le rifiuta
+type countingSink struct {
+	mu     sync.Mutex
+	calls  int
+	events []models.Earthquake
+	err    error
+	got    chan struct{}
+}
+
+func newCountingSink() *countingSink {
+	return &countingSink{got: make(chan struct{}, 16)}
+}
+
+func (s *countingSink) sink(ctx context.Context, feed string, events []models.Earthquake) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	s.events = events
+	s.got <- struct{}{}
+	return s.err
+}
+
+func TestFetchConditionalRequests(t *testing.T) {
+	fs, srv := newFeedServer(t)
+	sink := newCountingSink()
+	p := New(map[string]string{"hour": srv.URL + "/all_hour.geojson"}, sink.sink)
+	ctx := context.Background()
+
+	//Primo download: niente validatori, il feed viene letto e consegnato
+	result, err := p.Fetch(ctx, "hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NotModified || result.Events != 2 || result.Skipped != 1 {
+		t.Fatalf("primo download: %+v", result)
+	}
+	if h := fs.request(0).Header; h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		t.Fatalf("la prima richiesta non deve essere condizionale: %v", h)
+	}
+	if sink.calls != 1 || sink.events[0].ID != "nc75012345" || sink.events[1].Tsunami != 1 {
+		t.Fatalf("eventi consegnati: %+v", sink.events)
+	}
+
+	//Secondo download: richiesta condizionale, 304, nessuna nuova consegna
+	result, err = p.Fetch(ctx, "hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.NotModified || result.Events != 0 {
+		t.Fatalf("secondo download: %+v", result)
+	}
+	h := fs.request(1).Header
+	if h.Get("If-None-Match") != `"v1"` || h.Get("If-Modified-Since") != fixtureLastModified {
+		t.Fatalf("validatori non inviati: %v", h)
+	}
+	if sink.calls != 1 {
+		t.Fatalf("un 304 non deve arrivare al sink (consegne: %d)", sink.calls)
+	}
+
+	//Il feed cambia: nuovo ETag, il feed viene riletto
+	fs.mu.Lock()
+	fs.etag = `"v2"`
+	fs.mu.Unlock()
+	if result, err = p.Fetch(ctx, "hour"); err != nil || result.NotModified {
+		t.Fatalf("feed cambiato: %+v, %v", result, err)
+	}
+	if sink.calls != 2 {
+		t.Fatalf("consegne: %d, attese 2", sink.calls)
+	}
+}
+
+func TestFetchSinkErrorKeepsFeedPending(t *testing.T) {
+	fs, srv := newFeedServer(t)
+	sink := newCountingSink()
+	sink.err = errors.New("coda piena")
+	p := New(map[string]string{"hour": srv.URL + "/all_hour.geojson"}, sink.sink)
+
+	if _, err := p.Fetch(context.Background(), "hour"); err == nil {
+		t.Fatal("atteso l'errore del sink")
+	}
+	//Il sink non ha accettato gli eventi: il giro dopo non deve ricevere un 304
+	sink.err = nil
+	result, err := p.Fetch(context.Background(), "hour")
+	if err != nil || result.NotModified || result.Events != 2 {
+		t.Fatalf("secondo download: %+v, %v", result, err)
+	}
+	if h := fs.request(1).Header; h.Get("If-None-Match") != "" {
+		t.Fatalf("dopo un errore del sink la richiesta non deve essere condizionale: %v", h)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	fs, srv := newFeedServer(t)
+	fs.failures = 1
+	p := New(map[string]string{"hour": srv.URL + "/all_hour.geojson"}, newCountingSink().sink)
+
+	if _, err := p.Fetch(context.Background(), "hour"); err == nil {
+		t.Fatal("atteso un errore per la risposta 503")
+	}
+	if _, err := p.Fetch(context.Background(), "week"); !errors.Is(err, ErrUnknownFeed) {
+		t.Fatalf("atteso ErrUnknownFeed, ottenuto %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := &Poller{MaxBackoff: time.Minute}
+	for _, tc := range []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{10 * time.Second, 0, 10 * time.Second},
+		{10 * time.Second, 1, 20 * time.Second},
+		{10 * time.Second, 2, 40 * time.Second},
+		{10 * time.Second, 3, time.Minute},
+		{10 * time.Second, 50, time.Minute},
+		//Un intervallo già più lungo del massimo non viene accorciato
+		{5 * time.Minute, 2, 5 * time.Minute},
+	} {
+		if got := p.Backoff(tc.interval, tc.failures); got != tc.want {
+			t.Errorf("Backoff(%s, %d) = %s, atteso %s", tc.interval, tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestRunBacksOffAfterErrors(t *testing.T) {
+	fs, srv := newFeedServer(t)
+	fs.failures = 2
+	sink := newCountingSink()
+	p := New(map[string]string{"hour": srv.URL + "/all_hour.geojson"}, sink.sink)
+	p.MaxBackoff = time.Second
+
+	interval := 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, "hour", interval)
+		close(done)
+	}()
+
+	//Due errori e poi il download riuscito
+	select {
+	case <-sink.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("il feed non è stato consegnato dopo gli errori")
+	}
+	cancel()
+	<-done
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(fs.times) < 3 {
+		t.Fatalf("richieste: %d, attese almeno 3", len(fs.times))
+	}
+	//Dopo il primo errore si aspetta 2*interval, dopo il secondo 4*interval
+	if gap := fs.times[1].Sub(fs.times[0]); gap < 2*interval {
+		t.Errorf("attesa dopo il primo errore %s, attesa almeno %s", gap, 2*interval)
+	}
+	if gap := fs.times[2].Sub(fs.times[1]); gap < 4*interval {
+		t.Errorf("attesa dopo il secondo errore %s, attesa almeno %s", gap, 4*interval)
+	}
+}
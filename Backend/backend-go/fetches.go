@@ -0,0 +1,207 @@
+package main
+
+import (
+	"backend-go/models"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//ESITO DEI FETCH
+//Un fetch è un gruppo di eventi arrivati insieme: un blocco di /api/ingest/batch,
+//un download di un feed USGS o la ripresa del WAL all'avvio. Lo seguiamo fino
+//al salvataggio dell'ultimo evento e contiamo quanti sono nuovi, aggiornati o invariati:
+//così si vede subito se il giro giornaliero ha portato qualcosa di nuovo.
+
+// Numero di fetch recenti consultabili da /api/fetches
+const recentFetches = 50
+
+// FetchReport riassume un fetch
+type FetchReport struct {
+	ID         int64      `json:"id"`
+	Source     string     `json:"source"` // batch, feed:<nome>, fdsn:<agenzia>, import:quakeml, wal
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"` // nil finché ci sono eventi da salvare
+	Queued     int        `json:"queued"`                // Eventi messi in coda
+	Created    int        `json:"created"`
+	Updated    int        `json:"updated"`
+	Unchanged  int        `json:"unchanged"`
+	Failed     int        `json:"failed"` // Non salvati dai worker (restano nel WAL)
+
+	//Il server si è spento prima che tutti gli eventi fossero elaborati:
+	//quelli mancanti dai conteggi restano nel WAL (o sono persi se è disattivato)
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// Un fetch in corso. pending parte da 1 (il fetch è ancora aperto):
+// il fetch è concluso quando è stato chiuso con seal e tutti gli eventi sono stati elaborati
+type fetchRun struct {
+	tracker *fetchTracker
+	mu      sync.Mutex
+	report  FetchReport
+	pending int
+}
+
+// Tiene i fetch recenti e passa gli esiti ai notifier
+type fetchTracker struct {
+	mu     sync.Mutex
+	nextID int64
+	recent []*fetchRun // Dal più vecchio al più recente
+
+	notify *dispatcher
+}
+
+func newFetchTracker(notifiers ...Notifier) *fetchTracker {
+	return &fetchTracker{nextID: 1, notify: newDispatcher(notifiers)}
+}
+
+// Apre un nuovo fetch
+func (t *fetchTracker) begin(source string) *fetchRun {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	run := &fetchRun{
+		tracker: t,
+		report:  FetchReport{ID: t.nextID, Source: source, StartedAt: time.Now()},
+		pending: 1,
+	}
+	t.nextID++
+	t.recent = append(t.recent, run)
+	if len(t.recent) > recentFetches {
+		t.recent[0] = nil
+		t.recent = t.recent[1:]
+	}
+	return run
+}
+
+// Copia dei fetch recenti, dal più recente
+func (t *fetchTracker) list(limit int) []FetchReport {
+	t.mu.Lock()
+	runs := append([]*fetchRun(nil), t.recent...)
+	t.mu.Unlock()
+
+	reports := make([]FetchReport, 0, len(runs))
+	for i := len(runs) - 1; i >= 0; i-- {
+		runs[i].mu.Lock()
+		reports = append(reports, runs[i].report)
+		runs[i].mu.Unlock()
+		if limit > 0 && len(reports) == limit {
+			break
+		}
+	}
+	return reports
+}
+
+// Chiude come interrotti i fetch ancora aperti (eventi nel canale, nello spill o
+// non salvati dai worker allo spegnimento), così anche per loro arriva la notifica.
+// Restituisce il numero di fetch interrotti.
+func (t *fetchTracker) interrupt() int {
+	t.mu.Lock()
+	runs := append([]*fetchRun(nil), t.recent...)
+	t.mu.Unlock()
+
+	interrupted := 0
+	for _, r := range runs {
+		r.mu.Lock()
+		open := r.report.FinishedAt == nil
+		if open {
+			now := time.Now()
+			r.report.FinishedAt = &now
+			r.report.Interrupted = true
+		}
+		report := r.report
+		r.mu.Unlock()
+		if open {
+			interrupted++
+			t.notify.send(notification{fetch: &report})
+		}
+	}
+	return interrupted
+}
+
+// Passa ai notifier gli eventi creati o aggiornati da un blocco di scrittura
+func (t *fetchTracker) changed(results []models.UpsertResult) {
+	var changes []models.UpsertResult
+	for _, r := range results {
+		if r.Outcome != models.OutcomeUnchanged {
+			changes = append(changes, r)
+		}
+	}
+	if len(changes) > 0 {
+		t.notify.send(notification{changes: changes})
+	}
+}
+
+// Le funzioni di fetchRun accettano un fetch nil (eventi singoli non legati a un fetch)
+
+// Registra n eventi messi in coda (negativo per quelli rifiutati dalla coda)
+func (r *fetchRun) add(n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.report.Queued += n
+	r.mu.Unlock()
+	r.done(-n)
+}
+
+// Chiude il fetch: non arriveranno altri eventi
+func (r *fetchRun) seal() {
+	r.done(1)
+}
+
+// Registra l'esito del salvataggio di un evento (err != nil se non è stato salvato)
+func (r *fetchRun) record(result models.UpsertResult, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	switch {
+	case err != nil:
+		r.report.Failed++
+	case result.Outcome == models.OutcomeCreated:
+		r.report.Created++
+	case result.Outcome == models.OutcomeUpdated:
+		r.report.Updated++
+	default:
+		r.report.Unchanged++
+	}
+	r.mu.Unlock()
+	r.done(1)
+}
+
+// Toglie n elementi da quelli in sospeso; a zero il fetch è concluso.
+// Un fetch già chiuso da interrupt non viene notificato una seconda volta.
+func (r *fetchRun) done(n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.pending -= n
+	finished := r.pending == 0 && r.report.FinishedAt == nil
+	if finished {
+		now := time.Now()
+		r.report.FinishedAt = &now
+	}
+	report := r.report
+	r.mu.Unlock()
+
+	if finished {
+		r.tracker.notify.send(notification{fetch: &report})
+	}
+}
+
+// Elenca i fetch recenti con i conteggi di eventi nuovi, aggiornati e invariati
+func (app *App) getFetches(c *gin.Context) {
+	limit, err := optionalIntQuery(c, "limit")
+	if err != nil || (limit != nil && *limit < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "parametro limit non valido"})
+		return
+	}
+	n := 0
+	if limit != nil {
+		n = int(*limit)
+	}
+	c.JSON(http.StatusOK, app.Fetches.list(n))
+}
@@ -0,0 +1,145 @@
+// Package geojson legge i FeatureCollection GeoJSON pubblicati da USGS
+// (feed summary e API FDSN con format=geojson) e li converte in models.Earthquake.
+// Fa la stessa "T" di Transform che faceva il sensor agent Python.
+// Writer fa il contrario: scrive i nostri eventi come un feed USGS.
+package geojson
+
+import (
+	"backend-go/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FeatureCollection è la radice di un documento GeoJSON
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Features []Feature `json:"features"`
+	BBox     []float64 `json:"bbox,omitempty"` // [minLon, minLat, minDepth, maxLon, maxLat, maxDepth]
+}
+
+// Metadata sono le informazioni che USGS aggiunge al feed
+type Metadata struct {
+	Generated int64  `json:"generated,omitempty"` // Timestamp Unix in ms
+	URL       string `json:"url,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Status    int    `json:"status,omitempty"` // Codice HTTP della risposta
+	Count     int    `json:"count"`
+}
+
+// Feature è un singolo terremoto del feed
+type Feature struct {
+	Type       string      `json:"type"`
+	ID         string      `json:"id"`
+	Properties *Properties `json:"properties"`
+	Geometry   *Geometry   `json:"geometry"`
+}
+
+// Properties contiene i campi del feed che ci servono.
+// I puntatori distinguono un valore assente (null nel feed) dallo zero.
+// In lettura usiamo solo luogo, magnitudo, tempo e tsunami; gli altri campi
+// li scriviamo noi (vedi FromEarthquake), con lo stesso significato che hanno nel feed USGS.
+type Properties struct {
+	Place   *string  `json:"place"`
+	Mag     *float64 `json:"mag"`
+	Time    *int64   `json:"time"`
+	Updated *int64   `json:"updated,omitempty"`
+	Tsunami *int     `json:"tsunami"`
+	Net     string   `json:"net,omitempty"`     // Agenzia dell'origine
+	Code    string   `json:"code,omitempty"`    // ID dell'evento presso l'agenzia
+	IDs     string   `json:"ids,omitempty"`     // ID di tutte le origini, es. ",us7000abcd,ingv:37346241,"
+	Sources string   `json:"sources,omitempty"` // Agenzie di tutte le origini, es. ",usgs,ingv,"
+	Type    string   `json:"type,omitempty"`
+	Title   string   `json:"title,omitempty"`
+
+	//Non fa parte del feed USGS: distingue le nostre simulazioni
+	IsSimulated bool `json:"is_simulated,omitempty"`
+}
+
+// Geometry è il punto [Longitudine, Latitudine, Profondità]
+type Geometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// FeatureError descrive una feature scartata perché incompleta
+type FeatureError struct {
+	Index int    // Posizione nel feed
+	ID    string // ID della feature, se presente
+	Err   error
+}
+
+func (e FeatureError) Error() string {
+	return fmt.Sprintf("feature %d (%s): %v", e.Index, e.ID, e.Err)
+}
+
+// ParseFeatureCollection legge un FeatureCollection e restituisce i terremoti validi.
+// Le feature incomplete vengono scartate e riportate in skipped, senza bloccare
+// le altre; err è diverso da nil solo se il documento intero non è leggibile.
+func ParseFeatureCollection(r io.Reader) (events []models.Earthquake, skipped []FeatureError, err error) {
+	fc, err := DecodeFeatureCollection(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events = make([]models.Earthquake, 0, len(fc.Features))
+	for i, f := range fc.Features {
+		ev, err := FeatureToEarthquake(f)
+		if err != nil {
+			skipped = append(skipped, FeatureError{Index: i, ID: f.ID, Err: err})
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, skipped, nil
+}
+
+// DecodeFeatureCollection legge il documento senza convertire le feature,
+// per chi deve sapere l'esito di ognuna (es. l'ingest a blocchi)
+func DecodeFeatureCollection(r io.Reader) (*FeatureCollection, error) {
+	var fc FeatureCollection
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, fmt.Errorf("GeoJSON non valido: %w", err)
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("GeoJSON non valido: atteso FeatureCollection, trovato %q", fc.Type)
+	}
+	return &fc, nil
+}
+
+// FeatureToEarthquake converte una singola feature.
+// Come nel sensor agent: il luogo mancante diventa "Unknown",
+// magnitudo, tempo e tsunami mancanti diventano 0.
+func FeatureToEarthquake(f Feature) (models.Earthquake, error) {
+	if f.ID == "" {
+		return models.Earthquake{}, errors.New("manca l'id")
+	}
+	if f.Properties == nil || f.Geometry == nil {
+		return models.Earthquake{}, errors.New("dati evento incompleti (mancano properties o geometry)")
+	}
+	if len(f.Geometry.Coordinates) < 2 {
+		return models.Earthquake{}, errors.New("coordinate mancanti")
+	}
+
+	p := f.Properties
+	ev := models.Earthquake{
+		ID:          f.ID,
+		Place:       "Unknown",
+		Coordinates: f.Geometry.Coordinates,
+	}
+	if p.Place != nil {
+		ev.Place = *p.Place
+	}
+	if p.Mag != nil {
+		ev.Magnitude = *p.Mag
+	}
+	if p.Time != nil {
+		ev.Time = *p.Time
+	}
+	if p.Tsunami != nil {
+		ev.Tsunami = *p.Tsunami
+	}
+	return ev, nil
+}
@@ -0,0 +1,152 @@
+package geojson
+
+import (
+	"backend-go/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Writer scrive un FeatureCollection un evento alla volta, come quakeml.Writer,
+// così un export grande non deve stare tutto in memoria. Metadata e bbox dipendono
+// da tutti gli eventi, quindi li scriviamo dopo le feature (in JSON l'ordine dei campi non conta).
+type Writer struct {
+	w       io.Writer
+	meta    Metadata
+	started bool
+
+	//Estremi delle geometrie scritte: [minLon, minLat, minDepth, maxLon, maxLat, maxDepth]
+	bbox    [6]float64
+	located int  // Feature con una geometria
+	noDepth bool // Almeno una geometria senza profondità: bbox a due dimensioni
+}
+
+// NewWriter crea un Writer; Count e Generated dei metadata vengono calcolati dal Writer
+func NewWriter(w io.Writer, meta Metadata) *Writer {
+	return &Writer{w: w, meta: meta}
+}
+
+// Write aggiunge un evento al documento
+func (w *Writer) Write(ev models.Earthquake) error {
+	sep := ","
+	if !w.started {
+		w.started = true
+		sep = `{"type":"FeatureCollection","features":[`
+	}
+	f := FromEarthquake(ev)
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if f.Geometry != nil {
+		w.extend(f.Geometry.Coordinates)
+	}
+	w.meta.Count++
+	if _, err := io.WriteString(w.w, sep); err != nil {
+		return err
+	}
+	_, err = w.w.Write(data)
+	return err
+}
+
+// Allarga il bbox per comprendere il punto
+func (w *Writer) extend(c []float64) {
+	if w.located == 0 {
+		w.bbox = [6]float64{c[0], c[1], math.Inf(1), c[0], c[1], math.Inf(-1)}
+	}
+	w.located++
+	w.bbox[0], w.bbox[3] = math.Min(w.bbox[0], c[0]), math.Max(w.bbox[3], c[0])
+	w.bbox[1], w.bbox[4] = math.Min(w.bbox[1], c[1]), math.Max(w.bbox[4], c[1])
+	if len(c) < 3 {
+		w.noDepth = true
+		return
+	}
+	w.bbox[2], w.bbox[5] = math.Min(w.bbox[2], c[2]), math.Max(w.bbox[5], c[2])
+}
+
+// Close scrive metadata e bbox e chiude il documento (anche se non contiene eventi).
+// Non chiude w.
+func (w *Writer) Close() error {
+	if !w.started {
+		w.started = true
+		if _, err := io.WriteString(w.w, `{"type":"FeatureCollection","features":[`); err != nil {
+			return err
+		}
+	}
+	w.meta.Generated = time.Now().UnixMilli()
+	meta, err := json.Marshal(w.meta)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w.w, `],"metadata":%s`, meta); err != nil {
+		return err
+	}
+	//Senza geometrie il bbox non ha senso e lo omettiamo
+	if w.located > 0 {
+		bbox := w.bbox[:]
+		if w.noDepth {
+			bbox = []float64{w.bbox[0], w.bbox[1], w.bbox[3], w.bbox[4]}
+		}
+		data, err := json.Marshal(bbox)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w.w, `,"bbox":%s`, data); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w.w, "}")
+	return err
+}
+
+// FromEarthquake converte un evento in una feature con le proprietà del feed USGS.
+// Senza coordinate valide la geometria è null, come ammette GeoJSON.
+// Per un evento logico ids e sources elencano tutte le origini delle varie agenzie.
+func FromEarthquake(ev models.Earthquake) Feature {
+	place, mag, t, tsunami := ev.Place, ev.Magnitude, ev.Time, ev.Tsunami
+	agency := ev.Agency()
+	p := &Properties{
+		Place:       &place,
+		Mag:         &mag,
+		Time:        &t,
+		Tsunami:     &tsunami,
+		Net:         agency,
+		Code:        strings.TrimPrefix(ev.ID, agency+":"),
+		Type:        "earthquake",
+		Title:       fmt.Sprintf("M %.1f - %s", mag, place),
+		IsSimulated: ev.IsSimulatedEvent(),
+	}
+	if ev.UpdatedAt > 0 {
+		updated := ev.UpdatedAt
+		p.Updated = &updated
+	}
+
+	ids, sources := []string{ev.ID}, []string{agency}
+	if len(ev.Origins) > 0 {
+		ids, sources = nil, nil
+		for _, o := range ev.Origins {
+			ids = append(ids, o.ID)
+			if !slices.Contains(sources, o.Source) {
+				sources = append(sources, o.Source)
+			}
+		}
+	}
+	//Come USGS, gli elenchi iniziano e finiscono con la virgola
+	p.IDs = "," + strings.Join(ids, ",") + ","
+	p.Sources = "," + strings.Join(sources, ",") + ","
+
+	f := Feature{Type: "Feature", ID: ev.ID, Properties: p}
+	if _, _, ok := ev.LonLat(); ok {
+		//Longitudine, latitudine e (se c'è) profondità: eventuali valori in più non fanno parte del punto
+		coords := ev.Coordinates
+		if len(coords) > 3 {
+			coords = coords[:3]
+		}
+		f.Geometry = &Geometry{Type: "Point", Coordinates: append([]float64(nil), coords...)}
+	}
+	return f
+}
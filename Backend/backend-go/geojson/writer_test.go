@@ -0,0 +1,164 @@
+package geojson
+
+import (
+	"backend-go/models"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Scrive gli eventi con Writer e rilegge il documento
+func writeCollection(t *testing.T, events []models.Earthquake) (*FeatureCollection, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Metadata{Title: "Catalogo di prova", Status: 200})
+	for _, ev := range events {
+		if err := w.Write(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//Il documento deve essere JSON valido anche scritto a pezzi
+	if !json.Valid(buf.Bytes()) {
+		t.Fatalf("documento non valido:\n%s", buf.String())
+	}
+	fc, err := DecodeFeatureCollection(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	return fc, buf.String()
+}
+
+func event(id string, coords ...float64) models.Earthquake {
+	return models.Earthquake{
+		ID:          id,
+		Place:       "10km N of Test",
+		Magnitude:   3.2,
+		Time:        1722560523000,
+		Coordinates: coords,
+	}
+}
+
+func TestWriterBBoxAndMetadata(t *testing.T) {
+	fc, _ := writeCollection(t, []models.Earthquake{
+		event("us1000aaaa", 13.5, 43.6, 8.1),
+		event("us1000bbbb", -122.4, 37.8, 12.5),
+		event("us1000cccc", 142.1, -20.3, 0.5),
+	})
+	want := []float64{-122.4, -20.3, 0.5, 142.1, 43.6, 12.5}
+	if !reflect.DeepEqual(fc.BBox, want) {
+		t.Fatalf("bbox %v, atteso %v", fc.BBox, want)
+	}
+	if fc.Metadata == nil || fc.Metadata.Count != 3 || fc.Metadata.Generated == 0 {
+		t.Fatalf("metadata: %+v", fc.Metadata)
+	}
+	//I metadata passati a NewWriter restano, Count e Generated li calcola il Writer
+	if fc.Metadata.Title != "Catalogo di prova" || fc.Metadata.Status != 200 {
+		t.Fatalf("metadata: %+v", fc.Metadata)
+	}
+	if len(fc.Features) != 3 || fc.Features[1].ID != "us1000bbbb" {
+		t.Fatalf("feature: %+v", fc.Features)
+	}
+}
+
+func TestWriterCoordinates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		events   []models.Earthquake
+		bbox     []float64
+		geometry [][]float64 // Coordinate di ogni feature, nil per geometria null
+	}{
+		{
+			//Una geometria senza profondità rende il bbox a due dimensioni
+			name:     "due dimensioni",
+			events:   []models.Earthquake{event("us1000aaaa", 13.5, 43.6, 8.1), event("us1000bbbb", 15.2, 40.1)},
+			bbox:     []float64{13.5, 40.1, 15.2, 43.6},
+			geometry: [][]float64{{13.5, 43.6, 8.1}, {15.2, 40.1}},
+		},
+		{
+			//Senza coordinate valide la geometria è null e non entra nel bbox
+			name:     "geometria null",
+			events:   []models.Earthquake{event("us1000aaaa"), event("us1000bbbb", 13.5, 43.6, 8.1), event("us1000cccc", 200, 95, 10)},
+			bbox:     []float64{13.5, 43.6, 8.1, 13.5, 43.6, 8.1},
+			geometry: [][]float64{nil, {13.5, 43.6, 8.1}, nil},
+		},
+		{
+			name:     "solo geometrie null",
+			events:   []models.Earthquake{event("us1000aaaa"), event("us1000bbbb", 13.5)},
+			geometry: [][]float64{nil, nil},
+		},
+		{
+			//I valori oltre la profondità non fanno parte del punto
+			name:     "valori in più",
+			events:   []models.Earthquake{event("us1000aaaa", 13.5, 43.6, 8.1, 99)},
+			bbox:     []float64{13.5, 43.6, 8.1, 13.5, 43.6, 8.1},
+			geometry: [][]float64{{13.5, 43.6, 8.1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fc, raw := writeCollection(t, tc.events)
+			if !reflect.DeepEqual(fc.BBox, tc.bbox) {
+				t.Fatalf("bbox %v, atteso %v", fc.BBox, tc.bbox)
+			}
+			if tc.bbox == nil && strings.Contains(raw, `"bbox"`) {
+				t.Fatalf("bbox senza geometrie:\n%s", raw)
+			}
+			if fc.Metadata.Count != len(tc.events) || len(fc.Features) != len(tc.events) {
+				t.Fatalf("count %d, %d feature: attesi %d", fc.Metadata.Count, len(fc.Features), len(tc.events))
+			}
+			for i, f := range fc.Features {
+				var got []float64
+				if f.Geometry != nil {
+					got = f.Geometry.Coordinates
+				}
+				if !reflect.DeepEqual(got, tc.geometry[i]) {
+					t.Fatalf("feature %s: coordinate %v, attese %v", f.ID, got, tc.geometry[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWriterEmptyCollection(t *testing.T) {
+	fc, raw := writeCollection(t, nil)
+	if !strings.HasPrefix(raw, `{"type":"FeatureCollection","features":[]`) {
+		t.Fatalf("documento vuoto:\n%s", raw)
+	}
+	if len(fc.Features) != 0 || fc.BBox != nil || fc.Metadata == nil || fc.Metadata.Count != 0 {
+		t.Fatalf("documento vuoto: %+v", fc)
+	}
+	//Il count va scritto anche quando è 0
+	if !strings.Contains(raw, `"count":0`) {
+		t.Fatalf("count mancante:\n%s", raw)
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	events := []models.Earthquake{event("us1000aaaa", 13.5, 43.6, 8.1), event("us1000bbbb", -122.4, 37.8, 12.5)}
+	events[1].Tsunami = 1
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Metadata{})
+	for _, ev := range events {
+		if err := w.Write(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again, skipped, err := ParseFeatureCollection(&buf)
+	if err != nil || len(skipped) > 0 {
+		t.Fatalf("%v, scartate %v", err, skipped)
+	}
+	for i := range events {
+		got, want := again[i], events[i]
+		if got.ID != want.ID || got.Magnitude != want.Magnitude || got.Time != want.Time ||
+			got.Tsunami != want.Tsunami || got.Place != want.Place || !reflect.DeepEqual(got.Coordinates, want.Coordinates) {
+			t.Fatalf("evento %d: %+v, atteso %+v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"backend-go/models"
+	"sort"
+)
+
+//STORICO DELLE REVISIONI
+//Funzioni comuni a tutti gli store per gestire le versioni degli eventi.
+
+// Confronta l'evento ricevuto con la versione attuale (nil se non esiste)
+// e prepara la nuova versione con il numero di revisione aggiornato.
+// lastRevision è l'ultima revisione nello storico (0 se non ce ne sono): un evento
+// archiviato esce dal catalogo ma il suo storico resta, e se lo stesso ID arriva
+// di nuovo la numerazione deve continuare da lì invece di ripartire da 1.
+// Restituisce le revisioni da aggiungere allo storico: nessuna se l'evento
+// non è cambiato, quindi non c'è niente da scrivere. Il risultato dice
+// se l'evento è nuovo, aggiornato (con i campi cambiati) o invariato.
+func nextRevision(current *models.Earthquake, lastRevision int, incoming models.Earthquake, now int64) (models.Earthquake, []models.EventRevision, models.UpsertResult) {
+	var revisions []models.EventRevision
+	result := models.UpsertResult{ID: incoming.ID, Outcome: models.OutcomeCreated}
+
+	//I campi dell'associazione li gestisce lo store: teniamo quelli salvati
+	incoming.LogicalID, incoming.Secondary, incoming.Origins = "", false, nil
+	incoming.Revision = lastRevision + 1
+	if current != nil {
+		incoming.LogicalID, incoming.Secondary, incoming.Origins = current.LogicalID, current.Secondary, current.Origins
+		changed := models.ChangedFields(*current, incoming)
+		if len(changed) == 0 {
+			result.Outcome, result.Revision, result.Event = models.OutcomeUnchanged, current.Revision, *current
+			return *current, nil, result
+		}
+		result.Outcome, result.Changed = models.OutcomeUpdated, changed
+
+		//Eventi salvati prima che esistesse lo storico: li registriamo come
+		//revisione 1, con la loro data di aggiornamento (0 se sconosciuta)
+		if current.Revision == 0 {
+			legacy := *current
+			legacy.Revision = 1
+			revisions = append(revisions, models.EventRevision{
+				EventID:    legacy.ID,
+				Revision:   1,
+				IngestedAt: legacy.UpdatedAt,
+				Event:      legacy,
+			})
+			incoming.Revision = 2
+		} else {
+			incoming.Revision = current.Revision + 1
+		}
+	}
+	incoming.UpdatedAt = now
+
+	revisions = append(revisions, models.EventRevision{
+		EventID:    incoming.ID,
+		Revision:   incoming.Revision,
+		IngestedAt: now,
+		Event:      incoming,
+	})
+	result.Revision, result.Event = incoming.Revision, incoming
+	return incoming, revisions, result
+}
+
+// Numero dell'ultima revisione di uno storico in ordine (0 se è vuoto)
+func lastRevision(revisions []models.EventRevision) int {
+	if len(revisions) == 0 {
+		return 0
+	}
+	return revisions[len(revisions)-1].Revision
+}
+
+// Due revisioni sono la stessa se hanno lo stesso numero e lo stesso contenuto.
+// La data di ricezione non conta: un retry ricalcola la revisione in un altro momento.
+func sameRevision(a, b models.EventRevision) bool {
+	return a.EventID == b.EventID && a.Revision == b.Revision && len(models.ChangedFields(a.Event, b.Event)) == 0
+}
+
+// Sceglie, tra le revisioni di un evento, l'ultima ricevuta entro asOf.
+// ok è false se in quel momento l'evento non era ancora arrivato.
+func revisionAsOf(revisions []models.EventRevision, asOf int64) (models.Earthquake, bool) {
+	var best *models.EventRevision
+	for i := range revisions {
+		r := &revisions[i]
+		if r.IngestedAt <= asOf && (best == nil || r.Revision > best.Revision) {
+			best = r
+		}
+	}
+	if best == nil {
+		return models.Earthquake{}, false
+	}
+	return best.Event, true
+}
+
+// Applica filtro, ordinamento e limite a un catalogo ricostruito in memoria
+func selectEvents(events []models.Earthquake, filter models.EventFilter, limit int64) []models.Earthquake {
+	selected := []models.Earthquake{}
+	for _, ev := range events {
+		if filter.Matches(ev) {
+			selected = append(selected, ev)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return filter.Sort.Less(selected[i], selected[j])
+	})
+	if limit > 0 && int64(len(selected)) > limit {
+		selected = selected[:limit]
+	}
+	return selected
+}
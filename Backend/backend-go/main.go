@@ -1,28 +1,41 @@
 package main
 
 import (
-	"backend-go/models" //Qui ho la definizio della struct "Earthquake"
-	"bytes"             //Mi serve per manipolare slice di byte
-	"context"           //Mi serve per gestire la concorrenza e i timeout
-	"encoding/csv"      //Mi serve per leggere e scrivere i file CSV
-	"encoding/json"     //Mi serve per la codifica e decodifica dei JSON
-	"fmt"               //Pacchetto standard per l'I/O formattato
-	"io"                //Pacchetto per le primitive dell'I/O
-	"log"               //Pacchetto di base per il logging
-	"math/rand"         //Generatore di numeri pseudo-casuali
-	"net/http"          //Mi serve per le implementazioni client/server HTTP
-	"os"                //Interfaccia verso l'SO
-	"strconv"           //Mi serve per la conversione di stringhe in tipi base come float o interi
-	"sync"              //Mi serve per la sincronizzazione della memoria
-	"time"              //Mi serve per la gestione del tempo
+	"backend-go/fdsn"       //Download dei cataloghi FDSN di altre agenzie
+	"backend-go/feeds"      //Download dei feed USGS
+	"backend-go/geojson"    //Lettura e scrittura dei FeatureCollection GeoJSON
+	"backend-go/migrations" //Schema e indici di MongoDB
+	"backend-go/models"     //Qui ho la definizio della struct "Earthquake"
+	"backend-go/quakeml"    //Lettura e scrittura dei cataloghi QuakeML
+	"backend-go/wal"        //Write-ahead log degli eventi in coda
+	"bytes"                 //Mi serve per manipolare slice di byte
+	"context"               //Mi serve per gestire la concorrenza e i timeout
+	"encoding/csv"          //Mi serve per leggere e scrivere i file CSV
+	"encoding/json"         //Mi serve per la codifica e decodifica dei JSON
+	"errors"                //Mi serve per ispezionare gli errori
+	"fmt"                   //Pacchetto standard per l'I/O formattato
+	"io"                    //Pacchetto per le primitive dell'I/O
+	"log"                   //Pacchetto di base per il logging
+	"math"                  //Funzioni matematiche
+	"math/rand"             //Generatore di numeri pseudo-casuali
+	"net/http"              //Mi serve per le implementazioni client/server HTTP
+	"os"                    //Interfaccia verso l'SO
+	"os/signal"             //Mi serve per intercettare SIGINT e SIGTERM
+	"regexp"                //Mi serve per le espressioni regolari
+	"strconv"               //Mi serve per la conversione di stringhe in tipi base come float o interi
+	"strings"               //Funzioni per manipolare le stringhe
+	"sync"                  //Mi serve per la sincronizzazione della memoria
+	"syscall"               //Costanti dei segnali (SIGTERM)
+	"time"                  //Mi serve per la gestione del tempo
 
 	//Driver ufficiali del framework Gin
 	"github.com/gin-gonic/gin"
 
 	//Driver ufficiali per MongoDB
-	"go.mongodb.org/mongo-driver/bson"          //E' il tipo di formato usato da Mongo per salvare i dati nel DB
-	"go.mongodb.org/mongo-driver/mongo"         //Mi serve per connettermi al DB e gestirlo
-	"go.mongodb.org/mongo-driver/mongo/options" //Mi serve per configurare le query
+	"go.mongodb.org/mongo-driver/bson"           //E' il tipo di formato usato da Mongo per salvare i dati nel DB
+	"go.mongodb.org/mongo-driver/bson/primitive" //Tipi BSON specifici, come le regex
+	"go.mongodb.org/mongo-driver/mongo"          //Mi serve per connettermi al DB e gestirlo
+	"go.mongodb.org/mongo-driver/mongo/options"  //Mi serve per configurare le query
 )
 
 //DEFINIZIONE TIPI ED ENUMERAZIONI
@@ -66,19 +79,62 @@ func CalculateRisk(mag float64) RiskLevel {
 //Questo ci permette di disaccoppiare la logica di business dal DB specifico (MongoDB).
 //Utile per per cambiare tecnologia senza rifare tutto il codice.
 
+// ErrNotFound indica che l'evento cercato non esiste né nel catalogo né nell'archivio
+var ErrNotFound = errors.New("evento non trovato")
+
 // EventStore definisce il contratto
 // Significa che chiunque implementi questa interfaccia
 // deve conoscere (da contratto) i metodi definiti al suo interno
 type EventStore interface {
-	Upsert(ctx context.Context, event models.Earthquake) error
-	Query(ctx context.Context, filter interface{}, limit int64) ([]models.Earthquake, error)
-	DeleteOld(ctx context.Context, cutoffTime int64) (int64, error)
+	Upsert(ctx context.Context, event models.Earthquake) (models.UpsertResult, error)
+	UpsertMany(ctx context.Context, events []models.Earthquake) ([]models.UpsertResult, []error)
+	//Cerca un evento per ID, prima nel catalogo e poi nell'archivio (ErrNotFound se non c'è)
+	Get(ctx context.Context, id string) (models.Earthquake, error)
+	Query(ctx context.Context, filter models.EventFilter, limit int64) ([]models.Earthquake, error)
+	Stream(ctx context.Context, filter models.EventFilter, limit int64, fn func(models.Earthquake) error) error
+	Archive(ctx context.Context, ids []string) (int64, error)
+	Delete(ctx context.Context, ids []string) (int64, error)
 	GetAll(ctx context.Context) ([]models.Earthquake, error)
+	Near(ctx context.Context, lat, lon, radiusKm float64, filter models.EventFilter, limit int64) ([]models.NearbyEvent, error)
+	History(ctx context.Context, id string) ([]models.EventRevision, error)
+
+	//Salva l'associazione tra le origini dello stesso terremoto (vedi association.go)
+	Associate(ctx context.Context, groups []models.EventGroup) error
+
+	//Quarantena: eventi sospetti messi da parte invece di entrare nel catalogo
+	Quarantine(ctx context.Context, q models.QuarantinedEvent) error
+	ListQuarantine(ctx context.Context, limit int64) ([]models.QuarantinedEvent, error)
+	TakeQuarantined(ctx context.Context, id string) (models.QuarantinedEvent, bool, error)
+
+	//Chiude la connessione (o il file) allo spegnimento del server
+	Close(ctx context.Context) error
 }
 
 // MongoStore è l'implementazione concreta di EventStore per MongoDB
 type MongoStore struct {
 	collection *mongo.Collection
+	//Storico delle revisioni: un documento per ogni versione ricevuta di un evento
+	history *mongo.Collection
+	//Eventi spostati dalla politica di conservazione, con la stessa forma di collection
+	archive *mongo.Collection
+	//Eventi sospetti in attesa di revisione, uno per ID
+	quarantine *mongo.Collection
+}
+
+// Collection da cui leggono Query, Stream e Near: il catalogo attuale o l'archivio
+func (m *MongoStore) source(filter models.EventFilter) *mongo.Collection {
+	if filter.Archived {
+		return m.archive
+	}
+	return m.collection
+}
+
+// Documento dello storico: l'_id è "ID evento#revisione", così se due worker
+// provano a salvare la stessa revisione dello stesso evento, il secondo fallisce
+// invece di creare un duplicato
+type mongoRevision struct {
+	ID                   string `bson:"_id"`
+	models.EventRevision `bson:",inline"`
 }
 
 //Implementazione dei metodi definiti nell'interfaccia sopra
@@ -89,33 +145,348 @@ type MongoStore struct {
 
 // Usiamo un Pointer Receiver (m *MongoStore) per evitare la copia della struct
 // ad ogni chiamata, anche se non modifichiamo i campi interni della struct MongoStore
-func (m *MongoStore) Upsert(ctx context.Context, event models.Earthquake) error {
+// Se l'evento è cambiato rispetto alla versione salvata, la nuova versione
+// viene aggiunta allo storico invece di buttare via quella precedente.
+func (m *MongoStore) Upsert(ctx context.Context, event models.Earthquake) (models.UpsertResult, error) {
+	results, errs := m.UpsertMany(ctx, []models.Earthquake{event})
+	return results[0], errs[0]
+}
+
+// Versione a blocchi di Upsert: tutti gli eventi vengono scritti con una sola
+// BulkWrite, cioè un unico viaggio verso il DB invece di uno per evento.
+// Restituisce, per ogni evento, l'esito (creato, aggiornato o invariato) e l'errore
+// (nil se è andato a buon fine), così chi chiama può ancora sapere quale evento è fallito.
+// Gli eventi invariati non vengono riscritti.
+// I passi sono tre: leggiamo le versioni attuali di tutti gli eventi del blocco,
+// salviamo le nuove revisioni nello storico e infine aggiorniamo gli eventi.
+// Lo storico viene scritto prima del catalogo: se il passo 3 fallisce, il retry
+// (o il replay del WAL) ricalcola la stessa revisione e trova nello storico quella
+// già salvata, che non è un errore (vedi leftoverRevisions).
+func (m *MongoStore) UpsertMany(ctx context.Context, events []models.Earthquake) ([]models.UpsertResult, []error) {
+	results := make([]models.UpsertResult, len(events))
+	errs := make([]error, len(events))
+	if len(events) == 0 {
+		return results, errs
+	}
+	failAll := func(err error) ([]models.UpsertResult, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return results, errs
+	}
 
-	//Qui sto cercando un elemento che abbia l'ID uguale a quello passato nella funzione
-	filter := bson.M{"_id": event.ID}
+	//1. Versioni attuali, con una sola query
+	ids := make([]string, 0, len(events))
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+	}
+	cursor, err := m.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return failAll(err)
+	}
+	var stored []models.Earthquake
+	if err := cursor.All(ctx, &stored); err != nil {
+		return failAll(err)
+	}
+	current := make(map[string]models.Earthquake, len(stored))
+	for _, ev := range stored {
+		current[ev.ID] = ev
+	}
+	//Per gli ID che non sono nel catalogo (nuovi o archiviati) ci serve
+	//l'ultima revisione dello storico, da cui riprende la numerazione
+	var missing []string
+	for _, id := range ids {
+		if _, ok := current[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	lastRevisions, err := m.lastRevisions(ctx, missing)
+	if err != nil {
+		return failAll(err)
+	}
 
-	//Questa mi serve per usare l'Upsert
-	//Senza questa riga, se l'evento non ci fosse nel DB, l'operazione fallirebbe
-	opts := options.Replace().SetUpsert(true)
+	//Calcoliamo le nuove revisioni. Lo stesso ID può comparire più volte nel blocco:
+	//aggiornando la mappa "current" ogni versione viene confrontata con la precedente,
+	//e alla fine scriviamo solo l'ultima
+	now := time.Now().UnixMilli()
+	var revisionDocs []interface{}
+	var revisionOwner []int      // Indice dell'evento a cui appartiene ogni revisione
+	owners := map[string][]int{} // Indici degli eventi del blocco per ogni ID modificato
+	var changedIDs []string      // ID modificati, nell'ordine in cui li incontriamo
+	for i, ev := range events {
+		var cur *models.Earthquake
+		if c, ok := current[ev.ID]; ok {
+			cur = &c
+		}
+		next, revisions, result := nextRevision(cur, lastRevisions[ev.ID], ev, now)
+		results[i] = result
+		if len(revisions) == 0 {
+			continue
+		}
+		//Salviamo anche il punto GeoJSON per l'indice geospaziale,
+		//così funziona anche sul catalogo ricostruito con as_of
+		next = next.WithLocation()
+		for _, r := range revisions {
+			r.Event = r.Event.WithLocation()
+			revisionDocs = append(revisionDocs, mongoRevision{
+				ID:            fmt.Sprintf("%s#%d", r.EventID, r.Revision),
+				EventRevision: r,
+			})
+			revisionOwner = append(revisionOwner, i)
+		}
+		if _, seen := owners[ev.ID]; !seen {
+			changedIDs = append(changedIDs, ev.ID)
+		}
+		owners[ev.ID] = append(owners[ev.ID], i)
+		current[ev.ID] = next
+	}
+	if len(changedIDs) == 0 {
+		return results, errs
+	}
 
-	//Eseguo l'operazione, non mi interessa il primo valore di ritorno
-	//Ma il secondo si, che sarebbe il caso in cui torna errore
-	_, err := m.collection.ReplaceOne(ctx, filter, event, opts)
-	return err
+	//2. Storico. Con Ordered(false) una revisione che fallisce non blocca le altre
+	if _, err := m.history.InsertMany(ctx, revisionDocs, options.InsertMany().SetOrdered(false)); err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			return failAll(err)
+		}
+		leftover, err := m.leftoverRevisions(ctx, revisionDocs, bulkErr.WriteErrors)
+		if err != nil {
+			return failAll(err)
+		}
+		for _, we := range bulkErr.WriteErrors {
+			if we.Index >= 0 && we.Index < len(revisionOwner) && !leftover[we.Index] {
+				errs[revisionOwner[we.Index]] = we
+			}
+		}
+	}
+
+	//3. Eventi: una UpdateOne con upsert per ogni ID modificato,
+	//saltando quelli la cui revisione non è stata salvata.
+	//Non sostituiamo il documento intero: l'associazione viene scritta da Associate
+	//in un altro momento e una ReplaceOne riscriverebbe quella letta al passo 1
+	var writes []mongo.WriteModel
+	var writeIDs []string
+	for _, id := range changedIDs {
+		failed := false
+		for _, i := range owners[id] {
+			failed = failed || errs[i] != nil
+		}
+		if failed {
+			continue
+		}
+		update, err := eventUpdate(current[id])
+		if err != nil {
+			for _, i := range owners[id] {
+				errs[i] = err
+			}
+			continue
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(update).
+			SetUpsert(true))
+		writeIDs = append(writeIDs, id)
+	}
+	if len(writes) == 0 {
+		return results, errs
+	}
+
+	//Con Ordered(false) un evento che fallisce non blocca gli altri del blocco
+	_, err = m.collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err == nil {
+		return results, errs
+	}
+
+	//Se l'errore riguarda singole scritture, MongoDB ci dice l'indice della scrittura fallita
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+		for _, we := range bulkErr.WriteErrors {
+			if we.Index >= 0 && we.Index < len(writeIDs) {
+				for _, i := range owners[writeIDs[we.Index]] {
+					errs[i] = we
+				}
+			}
+		}
+		return results, errs
+	}
+
+	//Altrimenti (es. DB non raggiungibile) è fallito tutto il blocco
+	return failAll(err)
 }
 
-// Funzione che si occupa di recuperare la lista dei terremoti dal database
-func (m *MongoStore) Query(ctx context.Context, filter interface{}, limit int64) ([]models.Earthquake, error) {
+// Ultima revisione nello storico per ciascuno degli ID (assente se non ce ne sono)
+func (m *MongoStore) lastRevisions(ctx context.Context, ids []string) (map[string]int, error) {
+	last := make(map[string]int)
+	if len(ids) == 0 {
+		return last, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"event_id": bson.M{"$in": ids}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$event_id", "revision": bson.M{"$max": "$revision"}}}},
+	}
+	cursor, err := m.history.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID       string `bson:"_id"`
+		Revision int    `bson:"revision"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		last[r.ID] = r.Revision
+	}
+	return last, nil
+}
+
+// Tra le revisioni rifiutate per chiave duplicata cerca quelle già salvate con lo
+// stesso contenuto: sono di un tentativo precedente che ha scritto lo storico ma
+// non il catalogo, e l'evento può essere aggiornato. Restituisce gli indici di revisionDocs.
+func (m *MongoStore) leftoverRevisions(ctx context.Context, revisionDocs []interface{}, writeErrors []mongo.BulkWriteError) (map[int]bool, error) {
+	byID := make(map[string]int)
+	var ids []string
+	for _, we := range writeErrors {
+		if we.Code != mongoDuplicateKey || we.Index < 0 || we.Index >= len(revisionDocs) {
+			continue
+		}
+		id := revisionDocs[we.Index].(mongoRevision).ID
+		byID[id] = we.Index
+		ids = append(ids, id)
+	}
+	leftover := make(map[int]bool)
+	if len(ids) == 0 {
+		return leftover, nil
+	}
+	cursor, err := m.history.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var stored []mongoRevision
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+	for _, doc := range stored {
+		i := byID[doc.ID]
+		if sameRevision(doc.EventRevision, revisionDocs[i].(mongoRevision).EventRevision) {
+			leftover[i] = true
+		}
+	}
+	return leftover, nil
+}
+
+// Codice di errore di MongoDB per una chiave duplicata
+const mongoDuplicateKey = 11000
+
+// Campi dell'associazione: li scrive solo Associate
+var associationFields = []string{"logical_id", "secondary", "origins"}
+
+// Campi omessi dal documento quando sono vuoti: con $set resterebbe il valore
+// precedente, quindi se mancano nella nuova versione li togliamo con $unset
+var omittedFields = []string{"source", "revision", "updated_at", "archived_at", "location"}
+
+// Update che porta il documento alla nuova versione dell'evento lasciando
+// com'è l'associazione salvata
+func eventUpdate(ev models.Earthquake) (bson.M, error) {
+	raw, err := bson.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	delete(doc, "_id")
+	for _, f := range associationFields {
+		delete(doc, f)
+	}
+	update := bson.M{"$set": doc}
+	unset := bson.M{}
+	for _, f := range omittedFields {
+		if _, ok := doc[f]; !ok {
+			unset[f] = ""
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
+
+// Cerca un evento per ID: prima nel catalogo, poi nell'archivio
+func (m *MongoStore) Get(ctx context.Context, id string) (models.Earthquake, error) {
+	var ev models.Earthquake
+	for _, coll := range []*mongo.Collection{m.collection, m.archive} {
+		err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&ev)
+		if err == nil {
+			return ev, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return ev, err
+		}
+	}
+	return ev, ErrNotFound
+}
+
+// Restituisce tutte le revisioni di un evento, dalla più vecchia alla più recente
+func (m *MongoStore) History(ctx context.Context, id string) ([]models.EventRevision, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "revision", Value: 1}})
+	cursor, err := m.history.Find(ctx, bson.M{"event_id": id}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	revisions := []models.EventRevision{}
+	for cursor.Next(ctx) {
+		var doc mongoRevision
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, doc.EventRevision)
+	}
+	return revisions, cursor.Err()
+}
+
+// Apre il cursore per Query e Stream.
+// Normalmente è una Find sulla collection degli eventi; con filter.AsOf invece
+// ricostruiamo il catalogo dallo storico con una aggregation pipeline:
+// per ogni evento teniamo l'ultima revisione ricevuta entro AsOf,
+// e su quella applichiamo lo stesso filtro della Find.
+func (m *MongoStore) find(ctx context.Context, filter models.EventFilter, limit int64) (*mongo.Cursor, error) {
+	if filter.AsOf == nil {
+		//Imposto l'ordinamento richiesto dal filtro (di default dal più nuovo al più vecchio)
+		opts := options.Find().SetSort(mongoSort(filter.Sort))
+		if limit > 0 {
+			//Imposto il limite di elementi che voglio ricevere nella chiamata
+			opts.SetLimit(limit)
+		}
+		return m.source(filter).Find(ctx, mongoFilter(filter), opts)
+	}
 
-	//Imposto l'ordinamento dal più nuovo al più vecchio
-	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"ingested_at": bson.M{"$lte": *filter.AsOf}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "event_id", Value: 1}, {Key: "revision", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$event_id", "event": bson.M{"$first": "$event"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$event"}}},
+		{{Key: "$match", Value: mongoFilter(filter)}},
+		{{Key: "$sort", Value: mongoSort(filter.Sort)}},
+	}
 	if limit > 0 {
-		//Imposto il limite di elementi che voglio ricevere nella chiamata
-		opts.SetLimit(limit)
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
 	}
+	//Lo storico può essere grande: permettiamo a MongoDB di usare il disco per ordinare
+	return m.history.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+}
+
+// Funzione che si occupa di recuperare la lista dei terremoti dal database
+func (m *MongoStore) Query(ctx context.Context, filter models.EventFilter, limit int64) ([]models.Earthquake, error) {
+
 	//Eseguo la chiamata al DB. Il valore di ritorno non sono i dati
 	//Ma un cursor, ovvero il puntatore al flusso di dati sul database.
-	cursor, err := m.collection.Find(ctx, filter, opts)
+	cursor, err := m.find(ctx, filter, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -142,252 +513,1636 @@ func (m *MongoStore) Query(ctx context.Context, filter interface{}, limit int64)
 	if events == nil {
 		events = []models.Earthquake{}
 	}
-	return events, nil
+	return events, nil
+}
+
+// Come Query, ma invece di caricare tutti i risultati in una slice
+// passa un evento alla volta alla funzione fn, man mano che arrivano dal cursore.
+// Così la memoria resta costante qualunque sia la dimensione del catalogo.
+// Se fn restituisce un errore, o se il contesto viene annullato (es. il client
+// chiude il download), la lettura si interrompe e l'errore viene restituito.
+func (m *MongoStore) Stream(ctx context.Context, filter models.EventFilter, limit int64, fn func(models.Earthquake) error) error {
+	cursor, err := m.find(ctx, filter, limit)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	//Next scarica i documenti a blocchi (batch) dal DB,
+	//quindi in memoria abbiamo sempre al massimo un batch
+	for cursor.Next(ctx) {
+		var ev models.Earthquake
+		if err := cursor.Decode(&ev); err != nil {
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Sposta gli eventi indicati nell'archivio e restituisce quanti ne ha spostati.
+// Prima copiamo gli eventi in events_archive, poi li togliamo dal catalogo:
+// se il processo si interrompe a metà, al prossimo giro la copia viene
+// semplicemente sovrascritta, quindi non si perde nulla.
+// Lo storico delle revisioni resta com'è: se l'ID arriva di nuovo, UpsertMany
+// riprende la numerazione dall'ultima revisione salvata.
+func (m *MongoStore) Archive(ctx context.Context, ids []string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	cursor, err := m.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	var events []models.Earthquake
+	if err := cursor.All(ctx, &events); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UnixMilli()
+	copies := make([]mongo.WriteModel, 0, len(events))
+	removals := make([]mongo.WriteModel, 0, len(events))
+	for _, ev := range events {
+		ev.ArchivedAt = now
+		copies = append(copies, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": ev.ID}).
+			SetReplacement(ev).
+			SetUpsert(true))
+
+		//Cancelliamo solo la revisione che abbiamo copiato: se nel frattempo
+		//un worker ha salvato una versione più nuova, l'evento resta nel catalogo
+		//e verrà valutato di nuovo al prossimo giro
+		var revision any = ev.Revision
+		if ev.Revision == 0 {
+			revision = nil //Eventi senza il campo revision
+		}
+		removals = append(removals, mongo.NewDeleteOneModel().
+			SetFilter(bson.M{"_id": ev.ID, "revision": revision}))
+	}
+
+	if _, err := m.archive.BulkWrite(ctx, copies, options.BulkWrite().SetOrdered(false)); err != nil {
+		return 0, err
+	}
+	result, err := m.collection.BulkWrite(ctx, removals, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Cancella definitivamente gli eventi indicati, insieme al loro storico.
+// Restituisce il numero di eventi tolti dal catalogo.
+func (m *MongoStore) Delete(ctx context.Context, ids []string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	result, err := m.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		//Ignoro il primo valore di ritorno
+		//e torno l'errore nel caso di fallimento
+		return 0, err
+	}
+	if _, err := m.history.DeleteMany(ctx, bson.M{"event_id": bson.M{"$in": ids}}); err != nil {
+		return result.DeletedCount, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Documento della quarantena: l'_id è l'ID dell'evento, così un evento
+// sospetto ricevuto più volte occupa un solo posto (vince l'ultimo)
+type mongoQuarantined struct {
+	ID                      string `bson:"_id"`
+	models.QuarantinedEvent `bson:",inline"`
+}
+
+// Mette un evento in quarantena, sostituendo quello con lo stesso ID
+func (m *MongoStore) Quarantine(ctx context.Context, q models.QuarantinedEvent) error {
+	_, err := m.quarantine.ReplaceOne(ctx,
+		bson.M{"_id": q.Event.ID},
+		mongoQuarantined{ID: q.Event.ID, QuarantinedEvent: q},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// Elenca gli eventi in quarantena, dal più recente
+func (m *MongoStore) ListQuarantine(ctx context.Context, limit int64) ([]models.QuarantinedEvent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "quarantined_at", Value: -1}, {Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := m.quarantine.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	list := []models.QuarantinedEvent{}
+	for cursor.Next(ctx) {
+		var doc mongoQuarantined
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		list = append(list, doc.QuarantinedEvent)
+	}
+	return list, cursor.Err()
+}
+
+// Toglie un evento dalla quarantena e lo restituisce (ok false se non c'era)
+func (m *MongoStore) TakeQuarantined(ctx context.Context, id string) (models.QuarantinedEvent, bool, error) {
+	var doc mongoQuarantined
+	err := m.quarantine.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.QuarantinedEvent{}, false, nil
+	}
+	if err != nil {
+		return models.QuarantinedEvent{}, false, err
+	}
+	return doc.QuarantinedEvent, true, nil
+}
+
+// Chiude la connessione a MongoDB, aspettando (fino a ctx) le operazioni in corso
+func (m *MongoStore) Close(ctx context.Context) error {
+	return m.collection.Database().Client().Disconnect(ctx)
+}
+
+// Aggiorna i campi dell'associazione sulle origini di ogni gruppo, senza
+// toccare il resto del documento (e senza nuove revisioni). Le origini
+// non più presenti nel catalogo (es. archiviate) vengono ignorate.
+func (m *MongoStore) Associate(ctx context.Context, groups []models.EventGroup) error {
+	var writes []mongo.WriteModel
+	for _, g := range groups {
+		for _, id := range g.Members {
+			var update bson.M
+			switch {
+			case g.LogicalID == "":
+				update = bson.M{"$unset": bson.M{"logical_id": "", "secondary": "", "origins": ""}}
+			case id == g.Preferred:
+				update = bson.M{"$set": bson.M{"logical_id": g.LogicalID, "origins": g.Origins}, "$unset": bson.M{"secondary": ""}}
+			default:
+				update = bson.M{"$set": bson.M{"logical_id": g.LogicalID, "secondary": true}, "$unset": bson.M{"origins": ""}}
+			}
+			writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(update))
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	_, err := m.collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+//Funzione che mi restituisce tutto il contenuto del DB senza limiti
+
+func (m *MongoStore) GetAll(ctx context.Context) ([]models.Earthquake, error) {
+	return m.Query(ctx, models.EventFilter{}, 0)
+}
+
+// Cerca gli eventi entro radiusKm dal punto (lat, lon), dal più vicino al più lontano.
+// Usiamo lo stage $geoNear dell'aggregation pipeline, che sfrutta l'indice 2dsphere
+// sul campo location e calcola per noi la distanza di ogni evento.
+func (m *MongoStore) Near(ctx context.Context, lat, lon, radiusKm float64, filter models.EventFilter, limit int64) ([]models.NearbyEvent, error) {
+	//$geoNear deve essere il primo stage della pipeline, quindi non possiamo usarlo
+	//sul catalogo ricostruito dallo storico: in quel caso calcoliamo noi le distanze
+	if filter.AsOf != nil {
+		return nearByScan(ctx, m.Stream, lat, lon, radiusKm, filter, limit)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$geoNear", Value: bson.M{
+			"near":          models.GeoPoint{Type: "Point", Coordinates: []float64{lon, lat}},
+			"key":           "location",
+			"spherical":     true,
+			"maxDistance":   radiusKm * 1000, //In metri
+			"distanceField": "distance_km",
+			//Moltiplichiamo la distanza (in metri) per 0.001 così otteniamo i km
+			"distanceMultiplier": 0.001,
+			//Gli altri filtri (magnitudo, tempo, ...) vengono applicati insieme alla ricerca
+			"query": mongoFilter(filter),
+		}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	cursor, err := m.source(filter).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []models.NearbyEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+//TRADUZIONE DEL FILTRO DI DOMINIO
+//Solo il MongoStore conosce gli operatori di MongoDB: qui traduciamo
+//l'EventFilter nel classico filtro bson.M.
+
+// Costruisce il filtro MongoDB a partire dall'EventFilter
+func mongoFilter(f models.EventFilter) bson.M {
+	filter := bson.M{}
+	//Le condizioni che usano $or non possono stare tutte allo stesso livello
+	//(la chiave si ripeterebbe), quindi le mettiamo in un $and
+	var and []bson.M
+
+	//Qui imposto il magnitudo usando gli operatori $gte e $lte, cioè
+	//Greater/Less than or Equal (maggiore/minore o uguale)
+	if mag := rangeCondition(f.MinMagnitude, f.MaxMagnitude); mag != nil {
+		filter["magnitude"] = mag
+	}
+	if t := rangeCondition(f.StartTime, f.EndTime); t != nil {
+		filter["time"] = t
+	}
+	//La profondità è il terzo elemento delle coordinate
+	if depth := rangeCondition(f.MinDepth, f.MaxDepth); depth != nil {
+		filter["coordinates.2"] = depth
+	}
+
+	//Qui imposto il luogo: uso $regex per cercare pezzi di testo
+	//es. Texas viene trovato anche se scrivo Tex
+	//e anche $options: "i" per ignorare maiuscole e minuscole.
+	//Il testo viene "escapato" così i caratteri speciali non diventano operatori regex
+	if f.Place != "" {
+		filter["place"] = bson.M{"$regex": regexp.QuoteMeta(f.Place), "$options": "i"}
+	}
+
+	//Filtri geografici: usiamo $geoWithin sul punto GeoJSON, che sfrutta l'indice 2dsphere.
+	//Più condizioni sullo stesso campo vanno messe nell'$and
+	if f.BBox != nil {
+		if poly, ok := f.BBox.Polygon(); ok {
+			and = append(and, geoWithin(poly))
+		} else {
+			//Il rettangolo copre tutte le longitudini: basta un filtro sulla latitudine
+			filter["location.coordinates.1"] = bson.M{"$gte": f.BBox.MinLat, "$lte": f.BBox.MaxLat}
+		}
+	}
+	if f.Polygon != nil {
+		and = append(and, geoWithin(*f.Polygon))
+	}
+
+	if f.Tsunami != nil {
+		if *f.Tsunami {
+			filter["tsunami"] = bson.M{"$gt": 0}
+		} else {
+			filter["tsunami"] = bson.M{"$lte": 0}
+		}
+	}
+
+	//Un evento è simulato se ha il flag oppure l'ID che inizia con "sim_"
+	if f.Simulated != nil {
+		if *f.Simulated {
+			and = append(and, bson.M{"$or": []bson.M{
+				{"is_simulated": true},
+				{"_id": bson.M{"$regex": "^sim_"}},
+			}})
+		} else {
+			filter["is_simulated"] = bson.M{"$ne": true}
+			filter["_id"] = bson.M{"$not": primitive.Regex{Pattern: "^sim_"}}
+		}
+	}
+
+	if f.LogicalID != "" {
+		filter["logical_id"] = f.LogicalID
+	}
+	//Pagina successiva: gli eventi dopo il cursore nell'ordine di mongoSort,
+	//(tempo, _id) oppure (magnitudo, _id)
+	if c := f.After; c != nil {
+		field, value := "time", any(c.Time)
+		if f.Sort == models.SortMagnitudeDesc || f.Sort == models.SortMagnitudeAsc {
+			field, value = "magnitude", c.Magnitude
+		}
+		op := "$lt"
+		if f.Sort == models.SortTimeAsc || f.Sort == models.SortMagnitudeAsc {
+			op = "$gt"
+		}
+		and = append(and, bson.M{"$or": []bson.M{
+			{field: bson.M{op: value}},
+			{field: value, "_id": bson.M{op: c.ID}},
+		}})
+	}
+	//Le origini mai associate non hanno il campo secondary
+	if f.Preferred {
+		filter["secondary"] = bson.M{"$ne": true}
+	}
+
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	return filter
+}
+
+// Condizione $geoWithin su un poligono GeoJSON.
+// Usiamo il sistema di riferimento "strictwinding" di MongoDB: l'area del poligono
+// è quella a sinistra dell'anello percorso in senso antiorario, così possiamo usare
+// anche poligoni più grandi di un emisfero (es. rettangoli molto larghi).
+func geoWithin(poly models.GeoPolygon) bson.M {
+	return bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{
+		"type":        "Polygon",
+		"coordinates": poly.Coordinates,
+		"crs": bson.M{
+			"type":       "name",
+			"properties": bson.M{"name": "urn:x-mongodb:crs:strictwinding:EPSG:4326"},
+		},
+	}}}}
+}
+
+// Costruisce una condizione di intervallo con estremi inclusi, nil se non ci sono vincoli.
+// È generica così funziona sia per il magnitudo (float64) sia per il tempo (int64)
+func rangeCondition[T int64 | float64](min, max *T) bson.M {
+	if min == nil && max == nil {
+		return nil
+	}
+	cond := bson.M{}
+	if min != nil {
+		cond["$gte"] = *min
+	}
+	if max != nil {
+		cond["$lte"] = *max
+	}
+	return cond
+}
+
+// Traduce l'ordinamento di dominio in quello di MongoDB.
+// Aggiungiamo sempre l'_id così a parità di valore l'ordine è stabile.
+func mongoSort(order models.SortOrder) bson.D {
+	switch order {
+	case models.SortTimeAsc:
+		return bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}}
+	case models.SortMagnitudeDesc:
+		return bson.D{{Key: "magnitude", Value: -1}, {Key: "_id", Value: -1}}
+	case models.SortMagnitudeAsc:
+		return bson.D{{Key: "magnitude", Value: 1}, {Key: "_id", Value: 1}}
+	default:
+		return bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}
+	}
+}
+
+//SCOPE E STRUTTURAZIONE
+//Invece di usare variabili globali, incapsuliamo lo stato
+//dell'applicazione in una struct.
+
+// Abbiamo tutto il cuore dell'applicazione qui,
+// l'EventStore analizzato sopra, l'EventChannel
+// che serve per collegare le API ai Worker
+// e il sincronizzatore che tiene conto
+// di quante Gorutine sono attive (funziona come un contatore, è un puntatore
+// essendo un oggetto condiviso, non va mai passato per valore)
+type App struct {
+	Store        EventStore
+	EventChannel chan queuedEvent
+	WG           *sync.WaitGroup
+
+	//Write-ahead log degli eventi in coda (nil se disattivato)
+	WAL *wal.Log
+
+	//Politica di overflow e statistiche della coda
+	Queue *ingestQueue
+
+	//Configurazione dei blocchi di scrittura dei worker:
+	//un blocco viene scritto quando raggiunge BatchSize eventi
+	//oppure quando il primo evento aspetta da più di BatchDelay
+	BatchSize  int
+	BatchDelay time.Duration
+
+	//Attesa massima di /api/ingest/batch per mettere in coda un blocco
+	BatchIngestTimeout time.Duration
+
+	//Numero massimo di eventi in una pagina di /api/events
+	MaxPageSize int64
+
+	//Eventi precedenti mostrati da /api/events/:id: raggio di ricerca e numero massimo
+	RelatedRadiusKm float64
+	RelatedLimit    int
+
+	//Numero massimo di eventi in una risposta del servizio FDSN event
+	FDSNMaxEvents int64
+
+	//Cosa fare degli eventi sospetti: reject, quarantine o accept
+	SuspectPolicy string
+
+	//Politiche di conservazione usate dalla pulizia
+	Retention *Retention
+
+	//Poller dei feed USGS: nil se l'ingestione nativa è disattivata,
+	//in quel caso il fetch manuale viene delegato al sensor agent
+	Feeds          *feeds.Poller
+	SensorAgentURL string
+
+	//Poller dei cataloghi FDSN di altre agenzie: nil se FDSN_SOURCES è vuoto
+	FDSN *fdsn.Poller
+
+	//Associazione delle origini dello stesso terremoto arrivate da agenzie diverse
+	//(nil se disattivata)
+	Associator *Associator
+	//Origini in attesa di associazione (nil se l'associazione è disattivata)
+	associations *associationQueue
+
+	//Esiti dei fetch recenti e notifiche dei cambiamenti
+	Fetches *fetchTracker
+
+	//Attività in background e stato dello spegnimento
+	life *lifecycle
+}
+
+//MAIN
+
+func main() {
+
+	//"./main migrate" aggiorna lo schema di MongoDB ed esce, senza avviare il server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//Scelta dello store: di default usiamo MongoDB, ma con STORE_BACKEND=memory
+	//possiamo avviare tutta l'API senza database (utile in locale o in CI)
+	store, err := newStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retention, err := newRetentionFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Il WAL va aperto prima di accettare richieste: contiene gli eventi
+	//confermati ai client ma non ancora salvati prima dell'ultimo arresto
+	walLog, walPending, err := openWALFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Inizializzazione App e Dipendenze
+	//Iniettiamo lo store nel campo Store, in modo tale che
+	//l'applicazione può usare i metodi astratti dell'interfaccia
+	//EventStore
+	app := &App{
+		Store: store,
+		//Utilizzo dei Canali:
+		//Creiamo un canale con buffer 100 per disaccoppiare parzialmente
+		//produttore (API) e consumatore (Worker).
+		//In modo che le APi possono accettare fino ad un massimo di 100
+		//richieste anche se i worker sono occupati.
+		EventChannel:       make(chan queuedEvent, 100),
+		WG:                 &sync.WaitGroup{},
+		BatchSize:          envInt("WORKER_BATCH_SIZE", 100),
+		BatchDelay:         envDuration("WORKER_BATCH_DELAY", 500*time.Millisecond),
+		BatchIngestTimeout: envDuration("INGEST_BATCH_TIMEOUT", 5*time.Second),
+		MaxPageSize:        int64(envInt("EVENTS_MAX_PAGE_SIZE", 1000)),
+		RelatedRadiusKm:    envFloat("RELATED_RADIUS_KM", 100),
+		RelatedLimit:       envInt("RELATED_LIMIT", 10),
+		FDSNMaxEvents:      int64(envInt("FDSNWS_MAX_EVENTS", 20000)),
+		SuspectPolicy:      suspectPolicyFromEnv(),
+		WAL:                walLog,
+		Queue:              newIngestQueueFromEnv(walLog != nil),
+		Retention:          retention,
+		SensorAgentURL:     envString("SENSOR_AGENT_URL", "http://sensor-agent:5001"),
+		Associator:         newAssociatorFromEnv(),
+		Fetches:            newFetchTracker(notifiersFromEnv()...),
+		life:               newLifecycle(),
+	}
+
+	//Ingestione nativa: il backend scarica da solo i feed di USGS
+	if envBool("FEED_POLLER_ENABLED", false) {
+		app.Feeds = newPollerFromEnv(app.enqueueEvents)
+	}
+	//Cataloghi di altre agenzie (INGV, EMSC, ...) dai servizi FDSN event
+	app.FDSN, err = newFDSNPollerFromEnv(app.enqueueCatalog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Le notifiche (log, webhook) e l'associazione tra agenzie girano in goroutine
+	//che vivono quanto i worker
+	app.startNotifier()
+	app.startAssociation()
+
+	//Invece di una singola goroutine, ne avviamo 10 per parallelizzare il lavoro. (Pool Workers)
+	//Nel caso in cui una singola richiesta HTTP potrebbe saturare il sistema
+	//Essendo molto leggere e soprattuto velocissime, evitiamo di avere colli di bottiglia
+	//in Go, quando decidiamo di richiedere i dati dei terremoti delle scorse 24 ore, o di 7/30gg fa.
+
+	numWorkers := 10
+	for i := 0; i < numWorkers; i++ {
+		app.WG.Add(1) //Incremento il contatore del WaitGroup prima di lanciare la Gorutine
+		//Lancio la funzione startWorker in una nuova Gorutine
+		go app.startWorker(i, app.EventChannel) //Usiamo la keyword "go" per avviare una goroutine
+	}
+
+	//Il drainer sposta nel canale gli eventi parcheggiati (INGEST_OVERFLOW=spill),
+	//measure calcola il ritmo dei worker usato per il Retry-After
+	app.background(app.drainSpill)
+	app.background(app.Queue.measure)
+
+	//Con i worker avviati possiamo riprocessare gli eventi rimasti nel WAL
+	app.replayWAL(walPending)
+
+	//Le politiche di conservazione girano in background, senza bisogno
+	//che qualcuno chiami la pulizia (RETENTION_ENABLED=false per disattivarle)
+	if envBool("RETENTION_ENABLED", true) {
+		app.background(func(ctx context.Context) { app.Retention.Loop(ctx, app.Store) })
+	}
+
+	if app.Feeds != nil {
+		app.startFeedPoller()
+	}
+	if app.FDSN != nil {
+		app.startFDSNPoller()
+	}
+
+	//Setup Gin
+	r := app.routes()
+
+	//Il server HTTP gira in una goroutine, mentre il main aspetta
+	//SIGINT (Ctrl+C) o SIGTERM (docker-compose down) per spegnere tutto con ordine
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("Server Go avviato sulla porta 8080")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop() //Un secondo segnale termina subito il processo
+
+	app.shutdown(srv, envDuration("SHUTDOWN_TIMEOUT", 8*time.Second))
+}
+
+// Crea il router Gin con tutte le rotte dell'API.
+// È separato da main così i test possono montare le stesse rotte su un'App
+// con il MemoryStore, senza avviare il server HTTP.
+func (app *App) routes() *gin.Engine {
+	//Gin è uno dei framework più utilizzati per il linguaggio Go
+	//che ci ha semplificato molto il lavoro per gestire le API REST.
+	r := gin.New()
+
+	//Definizione Rotte usando i metodi dell'istanza App
+	api := r.Group("/api")
+	{
+		//Passiamo i metodi dell'istanza 'app' come handler
+		api.POST("/ingest", app.ingestEarthquake)
+		api.POST("/ingest/batch", app.ingestBatch)
+		api.POST("/import/quakeml", app.importQuakeML)
+		api.GET("/ingest/stats", app.getIngestStats)
+		api.GET("/fetches", app.getFetches)
+		api.GET("/events", app.getEvents)
+		api.GET("/events/near", app.getNearbyEvents)
+		api.POST("/events/search", app.searchEvents)
+		api.GET("/events/:id", app.getEvent)
+		api.GET("/events/:id/history", app.getEventHistory)
+		api.POST("/fetch-now", app.ManualFetch)
+		api.POST("/simulate", app.simulateUSEarthquake)
+		api.DELETE("/cleanup", app.cleanupOldEvents)
+		api.GET("/retention", app.getRetention)
+		api.GET("/quarantine", app.getQuarantine)
+		api.POST("/quarantine/:id/release", app.releaseQuarantined)
+		api.DELETE("/quarantine/:id", app.discardQuarantined)
+		api.GET("/export", app.exportCSV)
+	}
+
+	//Servizio FDSN event: sta fuori da /api perché ObsPy e i client di SeisComP
+	//si aspettano il percorso standard /fdsnws/event/1/
+	fdsnws := r.Group("/fdsnws/event/1")
+	{
+		fdsnws.GET("/query", app.fdsnQuery)
+		fdsnws.GET("/version", fdsnVersion)
+		fdsnws.GET("/application.wadl", fdsnWADL)
+	}
+	return r
+}
+
+// Crea lo store indicato dalla variabile d'ambiente STORE_BACKEND
+// "mongo" (default) si collega a MONGO_URI, "memory" tiene tutto in RAM,
+// "bolt" salva tutto in un singolo file locale (BOLT_PATH)
+func newStoreFromEnv() (EventStore, error) {
+	backend := os.Getenv("STORE_BACKEND")
+	switch backend {
+	case "", "mongo":
+		db, err := connectMongo()
+		if err != nil {
+			return nil, err
+		}
+
+		//Senza gli indici le query diventano scansioni di tutta la collection
+		//e le ricerche per distanza non funzionano: applichiamo le migrazioni
+		//mancanti prima di accettare richieste. Con MIGRATE_ON_START=false
+		//vanno lanciate a parte con il comando "migrate".
+		if envBool("MIGRATE_ON_START", true) {
+			ctx, cancel := context.WithTimeout(context.Background(), envDuration("MIGRATE_TIMEOUT", 10*time.Minute))
+			defer cancel()
+			if _, err := migrations.Run(ctx, db); err != nil {
+				return nil, fmt.Errorf("migrazioni: %w", err)
+			}
+		}
+
+		return &MongoStore{
+			collection: db.Collection("events"),
+			history:    db.Collection("events_history"),
+			archive:    db.Collection("events_archive"),
+			quarantine: db.Collection("events_quarantine"),
+		}, nil
+
+	case "memory":
+		log.Println("Store in memoria: i dati non sopravvivono al riavvio")
+		return NewMemoryStore(), nil
+
+	case "bolt":
+		//Database embedded su file, senza server esterni
+		boltPath := os.Getenv("BOLT_PATH")
+		if boltPath == "" {
+			boltPath = "data/earthquakes.db"
+		}
+		store, err := NewBoltStore(boltPath)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Store su file (bbolt): %s", boltPath)
+		return store, nil
+
+	default:
+		return nil, fmt.Errorf("STORE_BACKEND non valido: %q (valori ammessi: mongo, memory, bolt)", backend)
+	}
+}
+
+// Logica dei Worker
+// startWorker consuma gli eventi del canale
+// Abbiamo usato un canale unidirezione (<-chan) per evitare
+// che il worker scriva nel canale (visto che consuma solo).
+// Banalmente ci serve per salvare i dati senza rallentare le rispost del client
+// Gli eventi vengono raccolti in blocchi e scritti con un'unica UpsertMany:
+// durante un fetch di 30 giorni passiamo da migliaia di scritture singole
+// a poche decine di scritture a blocchi.
+func (app *App) startWorker(id int, events <-chan queuedEvent) {
+
+	//Quando la funzione termina, il Defer chiama Done() per segnalare che il worker ha finito il lavoro
+	defer app.WG.Done() // Segnala al WaitGroup quando finito: Decrementa il contatore quando il worker finisce
+	log.Printf("Worker %d avviato", id)
+
+	batch := make([]queuedEvent, 0, app.BatchSize)
+
+	//Il timer parte quando arriva il primo evento del blocco:
+	//così un evento isolato non aspetta mai più di BatchDelay
+	timer := time.NewTimer(app.BatchDelay)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		app.writeBatch(id, batch)
+		batch = batch[:0]
+	}
+
+	//Il select ci fa aspettare sia il canale sia il timer.
+	//Se il canale è vuoto i worker vanno in "stand-by", cioè si addormentano
+	//finché non arriva un evento (o scade il timer), in modo da non consumare CPU.
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				//Il canale è stato chiuso: scriviamo quello che resta e usciamo
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) == 1 {
+				timer.Reset(app.BatchDelay)
+			}
+			if len(batch) >= app.BatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// Attese tra un tentativo e l'altro quando la scrittura di un blocco fallisce
+// (es. MongoDB irraggiungibile per qualche secondo)
+var writeRetryDelays = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+
+// Scrive un blocco di eventi e segnala nel log ogni evento fallito.
+// Gli eventi falliti vengono riprovati qualche volta; quelli salvati vengono
+// segnati come completati nel WAL, gli altri restano lì e vengono
+// riprocessati al prossimo avvio.
+func (app *App) writeBatch(workerID int, batch []queuedEvent) {
+	pending := batch
+	for attempt := 0; ; attempt++ {
+		events := make([]models.Earthquake, len(pending))
+		for i, item := range pending {
+			events[i] = item.event
+		}
+
+		//Usiamo context.Background() perché il worker è un processo asincrono
+		//e non deve dipendere dal contesto della richiesta HTTP originale (che è già terminata).
+		//Significa che le richieste HTTP che riceviamo hanno il loro Context, che scade appena
+		//inviamo la risposta al client, il worker però elabora l'evento (cioè la richiesta) dopo
+		//che la risposta è già stata inviata (in modo asincrono). Se non facesse così, il salvataggio
+		//sul database fallirebbe perché la richiesta originale è fallita (context scaduto)
+		results, errs := app.Store.UpsertMany(context.Background(), events)
+
+		var done []uint64
+		var saved []models.UpsertResult
+		var failed []queuedEvent
+		var failedErrs []error
+		for i, err := range errs {
+			if err != nil {
+				failed = append(failed, pending[i])
+				failedErrs = append(failedErrs, err)
+				//Se qualcosa non va come dovrebbe, il worker non viene fermato
+				log.Printf("- Worker %d - Errore DB sull'evento %s: %v", workerID, pending[i].event.ID, err)
+				continue
+			}
+			done = append(done, pending[i].seq)
+			saved = append(saved, results[i])
+			pending[i].fetch.record(results[i], nil)
+		}
+		app.ackWAL(done)
+		app.Queue.written.Add(int64(len(done)))
+		app.Fetches.changed(saved)
+		app.associate(saved)
+
+		if len(failed) == 0 {
+			return
+		}
+		//In arresto non riproviamo: gli eventi restano nel WAL per il prossimo avvio
+		if attempt >= len(writeRetryDelays) || app.life.closing.Load() {
+			app.Queue.writeErrors.Add(int64(len(failed)))
+			for i, item := range failed {
+				item.fetch.record(models.UpsertResult{}, failedErrs[i])
+			}
+			log.Printf("- Worker %d - %d eventi non salvati, restano nel WAL fino al prossimo avvio", workerID, len(failed))
+			return
+		}
+		time.Sleep(writeRetryDelays[attempt])
+		pending = failed
+	}
+}
+
+//HANDLERS DELLE FUNZIONI CHIAMATE TRAMITE API
+
+// Riceve i dati dall'API esterna e li inserisce nel canale per essere consumati dai worker
+func (app *App) ingestEarthquake(c *gin.Context) {
+	var event models.Earthquake
+
+	//Qui viene usata la reflection, mappiamo i campi del JSON in quelli della struct event
+	if err := c.ShouldBindJSON(&event); err != nil {
+		//Nel caso in cui il client inviasse dati non validi, la funzione si ferma
+		//rispondendo con un errore.
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Il JSON è corretto, ma i valori devono anche avere senso
+	//(es. latitudine 300 o tempo 0 vengono scartati con l'elenco dei problemi)
+	status, problems, err := app.screenEvent(c.Request.Context(), event, "ingest")
+	if err != nil {
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+	switch status {
+	case statusRejected:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"status": statusRejected, "problems": problems})
+		return
+	case statusQuarantined:
+		c.JSON(http.StatusAccepted, gin.H{"status": statusQuarantined, "problems": problems})
+		return
+	}
+
+	//Nel caso in cui ci sia spazio nel canale (100 slot), la richiesta viene messa in coda,
+	//altrimenti decide INGEST_OVERFLOW: aspettiamo un posto, parcheggiamo l'evento
+	//nel WAL oppure lo rifiutiamo.
+	//Prima di rispondere "queued" l'evento viene scritto nel WAL su disco
+	deadline, stop := app.Queue.deadline(app.Queue.BlockTimeout)
+	defer stop()
+	queued, err := app.enqueue(c.Request.Context(), []models.Earthquake{event}, deadline, nil)
+	if err != nil {
+		app.enqueueError(c, err)
+		return
+	}
+	if !queued[0] {
+		//se il sistema è saturo, rifiutiamo la richiesta dicendo quando riprovare
+		app.queueFull(c, gin.H{"status": "queue_full"})
+		return
+	}
+	//Se gli eventi sospetti vengono accettati, segnaliamo comunque i problemi
+	if len(problems) > 0 {
+		c.JSON(http.StatusOK, gin.H{"status": "queued", "problems": problems})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "queued"})
+}
+
+// Dimensione massima del corpo di /api/ingest/batch (il feed mensile USGS sta ampiamente sotto)
+const maxBatchBody = 64 << 20
+
+// Esito di un singolo elemento di /api/ingest/batch
+type batchItemResult struct {
+	Index    int                     `json:"index"`
+	ID       string                  `json:"id,omitempty"`
+	Status   string                  `json:"status"` // accepted, rejected, quarantined, queue_full
+	Error    string                  `json:"error,omitempty"`
+	Problems models.ValidationErrors `json:"problems,omitempty"`
+
+	event models.Earthquake
+}
+
+// Ingest a blocchi: una sola richiesta HTTP per tutti gli eventi di un fetch.
+// Il corpo può essere un array JSON di eventi oppure un FeatureCollection
+// GeoJSON di USGS così com'è. Rispondiamo con l'esito di ogni elemento.
+func (app *App) ingestBatch(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBody))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "corpo della richiesta troppo grande o non leggibile"})
+		return
+	}
+
+	//Capiamo il formato dal primo carattere: '[' array di eventi, '{' GeoJSON
+	var format string
+	var results []batchItemResult
+	switch trimmed := bytes.TrimSpace(body); {
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		format = "array"
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "array JSON non valido: " + err.Error()})
+			return
+		}
+		for i, raw := range items {
+			var ev models.Earthquake
+			err := json.Unmarshal(raw, &ev)
+			if err == nil && ev.ID == "" {
+				err = errors.New("manca l'id")
+			}
+			results = appendBatchItem(results, i, ev, err)
+		}
+
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		format = "geojson"
+		fc, err := geojson.DecodeFeatureCollection(bytes.NewReader(trimmed))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for i, f := range fc.Features {
+			ev, err := geojson.FeatureToEarthquake(f)
+			if err != nil {
+				ev.ID = f.ID
+			}
+			results = appendBatchItem(results, i, ev, err)
+		}
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "atteso un array JSON di eventi o un FeatureCollection GeoJSON"})
+		return
+	}
+
+	app.queueBatch(c, "batch", format, results)
+}
+
+// Import di un catalogo QuakeML 1.2 (ad esempio scaricato dal servizio FDSN di un'agenzia).
+// Gli eventi seguono lo stesso percorso dell'ingest a blocchi e la risposta ha la stessa forma.
+func (app *App) importQuakeML(c *gin.Context) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBody)
+	var results []batchItemResult
+	err := quakeml.Decode(body, func(index int, ev models.Earthquake, err error) error {
+		results = appendBatchItem(results, index, ev, err)
+		return nil
+	})
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "corpo della richiesta troppo grande"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.queueBatch(c, "import:quakeml", "quakeml", results)
+}
+
+// Valida e mette in coda gli elementi letti da un blocco, come un unico fetch,
+// e risponde con l'esito di ognuno. source indica la provenienza (per quarantena e /api/fetches).
+func (app *App) queueBatch(c *gin.Context, source, format string, results []batchItemResult) {
+	//Validazione: gli eventi non validi vengono scartati, quelli sospetti
+	//seguono la politica configurata (scartati, in quarantena o accettati)
+	for i := range results {
+		r := &results[i]
+		if r.Status != statusAccepted {
+			continue
+		}
+		status, problems, err := app.screenEvent(c.Request.Context(), r.event, source)
+		if err != nil {
+			c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+			return
+		}
+		r.Status, r.Problems = status, problems
+	}
+
+	//Mettiamo in coda gli eventi validi. Se i worker sono indietro (e INGEST_OVERFLOW=block)
+	//aspettiamo che si liberi spazio, ma al massimo INGEST_BATCH_TIMEOUT per tutto il blocco:
+	//scaduto il tempo, gli elementi rimasti vengono segnati come queue_full
+	//e il client può rimandare solo quelli dopo Retry-After.
+	deadline, stop := app.Queue.deadline(app.BatchIngestTimeout)
+	defer stop()
+
+	//Il blocco è un fetch: /api/fetches dirà quanti eventi erano nuovi, aggiornati o invariati
+	fetch := app.Fetches.begin(source)
+	defer fetch.seal()
+
+	var accepted []models.Earthquake
+	var owners []int
+	for i, r := range results {
+		if r.Status == statusAccepted {
+			accepted = append(accepted, r.event)
+			owners = append(owners, i)
+		}
+	}
+	queued, err := app.enqueue(c.Request.Context(), accepted, deadline, fetch)
+	if err != nil {
+		app.enqueueError(c, err)
+		return
+	}
+	for i, ok := range queued {
+		if !ok {
+			results[owners[i]].Status = "queue_full"
+		}
+	}
+
+	counts := map[string]int{statusAccepted: 0, statusRejected: 0, statusQuarantined: 0, "queue_full": 0}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+
+	//Se non siamo riusciti a mettere in coda nulla per colpa della coda piena
+	//rispondiamo 503 come /api/ingest, altrimenti 200 con il dettaglio
+	response := gin.H{
+		"fetch_id":    fetch.report.ID,
+		"format":      format,
+		"total":       len(results),
+		"accepted":    counts["accepted"],
+		"rejected":    counts[statusRejected],
+		"quarantined": counts[statusQuarantined],
+		"queue_full":  counts["queue_full"],
+		"items":       results,
+	}
+	if counts["queue_full"] > 0 {
+		//Retry-After anche con risposta 200: il client sa quando rimandare gli scartati
+		retry := app.Queue.retryAfter(app.backlog())
+		c.Header("Retry-After", strconv.Itoa(retry))
+		response["retry_after"] = retry
+	}
+	status := http.StatusOK
+	if counts["accepted"] == 0 && counts["queue_full"] > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, response)
+}
+
+// Registra l'esito della lettura di un elemento del blocco
+func appendBatchItem(results []batchItemResult, index int, ev models.Earthquake, err error) []batchItemResult {
+	if err != nil {
+		return append(results, batchItemResult{Index: index, ID: ev.ID, Status: statusRejected, Error: err.Error()})
+	}
+	return append(results, batchItemResult{Index: index, ID: ev.ID, Status: statusAccepted, event: ev})
+}
+
+// Questa è una funzione di ricerca del database
+func (app *App) getEvents(c *gin.Context) {
+
+	//Leggo i filtri passati nella query e costruisco il filtro di dominio:
+	//sarà lo store a tradurlo nel linguaggio del proprio database.
+	//Un valore non valido è un errore 400, non un parametro ignorato in silenzio
+	filter, limit, err := eventFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Con as_of (timestamp Unix in ms) ricostruiamo il catalogo com'era in quel momento
+	if filter.AsOf, err = optionalIntQuery(c, "as_of"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Con archive=true leggiamo gli eventi spostati nell'archivio dalla politica di conservazione
+	archived, err := optionalBoolQuery(c, "archive")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Archived = archived != nil && *archived
+
+	//Array JSON oppure FeatureCollection GeoJSON, per i client GIS e le mappe web
+	geo, err := geoJSONRequested(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Rispondiamo sempre a pagine: senza limit la pagina è di MaxPageSize eventi,
+	//e l'header Link porta alla successiva. Il catalogo completo si scarica con /api/export
+	app.pageEvents(c, filter, limit, geo)
+}
+
+// Tipo MIME dei documenti GeoJSON (RFC 7946)
+const geoJSONMIME = "application/geo+json"
+
+// Dice se il client vuole un FeatureCollection invece dell'array JSON:
+// con format=geojson (o format=json per l'array), altrimenti dall'header Accept.
+// Chi non indica niente riceve l'array, come prima.
+func geoJSONRequested(c *gin.Context) (bool, error) {
+	//La risposta cambia con l'header Accept: lo diciamo alle cache
+	c.Header("Vary", "Accept")
+	switch c.Query("format") {
+	case "":
+		return c.NegotiateFormat(gin.MIMEJSON, geoJSONMIME) == geoJSONMIME, nil
+	case "json":
+		return false, nil
+	case "geojson":
+		return true, nil
+	default:
+		return false, fmt.Errorf("parametro format non valido: %q (ammessi json e geojson)", c.Query("format"))
+	}
+}
+
+// Restituisce un evento per ID (anche se archiviato) con il suo contesto:
+// livello di rischio, se è una simulazione e gli eventi precedenti più vicini
+// entro RelatedRadiusKm. È la pagina a cui puntano i link di alert e report.
+func (app *App) getEvent(c *gin.Context) {
+	id := c.Param("id")
+	radius := app.RelatedRadiusKm
+	r, err := optionalFloatQuery(c, "radius_km")
+	if err != nil || (r != nil && (*r <= 0 || *r > math.Pi*models.EarthRadiusKm)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parametro radius_km non valido: %q", c.Query("radius_km"))})
+		return
+	}
+	if r != nil {
+		radius = *r
+	}
+
+	ev, err := app.Store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "evento " + id + " non trovato"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+
+	related, err := app.relatedEvents(c.Request.Context(), ev, radius)
+	if err != nil {
+		log.Printf("Errore ricerca degli eventi vicini a %s: %v", id, err)
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"event":             ev,
+		"risk":              CalculateRisk(ev.Magnitude).String(),
+		"simulated":         ev.IsSimulatedEvent(),
+		"archived":          ev.ArchivedAt > 0,
+		"related_radius_km": radius,
+		"related":           related,
+	})
+}
+
+// Eventi reali precedenti più vicini all'evento, dal più vicino, al massimo RelatedLimit.
+// Non contano le altre origini dello stesso terremoto (stesso evento logico)
+// e, se ci sono più origini di un terremoto, contiamo solo la preferita.
+func (app *App) relatedEvents(ctx context.Context, ev models.Earthquake, radiusKm float64) ([]models.NearbyEvent, error) {
+	related := []models.NearbyEvent{}
+	lon, lat, ok := ev.LonLat()
+	if !ok {
+		return related, nil
+	}
+	simulated := false
+	before := ev.Time - 1
+	near, err := app.Store.Near(ctx, lat, lon, radiusKm, models.EventFilter{
+		EndTime:   &before,
+		Simulated: &simulated,
+		Preferred: true,
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range near {
+		if n.ID == ev.ID || (ev.LogicalID != "" && n.LogicalID == ev.LogicalID) {
+			continue
+		}
+		related = append(related, n)
+		if len(related) == app.RelatedLimit {
+			break
+		}
+	}
+	return related, nil
+}
+
+// Restituisce lo storico delle revisioni di un evento, dalla prima all'ultima,
+// ognuna con il momento in cui l'abbiamo ricevuta
+func (app *App) getEventHistory(c *gin.Context) {
+	id := c.Param("id")
+	revisions, err := app.Store.History(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+	if len(revisions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "nessuna revisione per l'evento " + id})
+		return
+	}
+	c.JSON(200, gin.H{
+		"event_id":  id,
+		"revisions": revisions,
+	})
+}
+
+// Scrive la risposta JSON con gli eventi che rispettano il filtro.
+// Passiamo c.Request.Context() allo store. Se l'utente annulla la richiesta
+// MongoDB interromperà l'operazione risparmiando risorse. Nel caso in cui
+// ad esempio, la richiesta è troppo lenta per l'utente e questo l'annulla.
+// Scriviamo l'array JSON un elemento alla volta, man mano che gli eventi
+// arrivano dallo store, invece di caricarli tutti in memoria.
+func (app *App) streamEvents(c *gin.Context, filter models.EventFilter, limit int64) {
+	written := 0
+	err := app.Store.Stream(c.Request.Context(), filter, limit, func(ev models.Earthquake) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		//Al primo evento scriviamo gli header e l'apertura dell'array
+		sep := ","
+		if written == 0 {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			c.Status(200)
+			sep = "["
+		}
+		written++
+		if _, err := c.Writer.WriteString(sep); err != nil {
+			return err
+		}
+		_, err = c.Writer.Write(data)
+		return err
+	})
+	if err != nil {
+		//Se non abbiamo ancora scritto nulla possiamo ancora rispondere con un errore,
+		//altrimenti possiamo solo interrompere la risposta
+		if written == 0 {
+			c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+			return
+		}
+		log.Printf("Stream eventi interrotto dopo %d elementi: %v", written, err)
+		return
+	}
+	//Se tutto va bene chiudiamo l'array JSON (vuoto se non abbiamo trovato nulla)
+	if written == 0 {
+		c.JSON(200, []models.Earthquake{})
+		return
+	}
+	c.Writer.WriteString("]")
 }
 
-// Questa mi serve per pulire il DB dai valori vecchi o simulati (finti)
-// Tutti gli eventi precedenti al "cutoffTime" sono considerati vecchi
-// e vengono cancellati. Mi torna il numero di elementi cancellati
-// (e come negli altri casi, un'errore (eventualmente))
-func (m *MongoStore) DeleteOld(ctx context.Context, cutoffTime int64) (int64, error) {
-
-	//Qui sto costruendo il filtro della query, in particolare
-	//Vogliamo cancellare i dati che sono precedenti al cutoffTime
-	//Ma anche quelli simulati, con un doppio controllo
-	//Sia se il flag "is_simulated" è true, ma anche se l'ID
-	//di quella entry inizia con "sim_"
-	filter := bson.M{
-		"$or": []bson.M{
-			{"time": bson.M{"$lt": cutoffTime}},
-			{"is_simulated": true},
-			{"_id": bson.M{"$regex": "^sim_"}},
-		},
-	}
-	//Eseguiamo la query con il filtro
-	result, err := m.collection.DeleteMany(ctx, filter)
+// Come streamEvents, ma scrive un FeatureCollection GeoJSON con le proprietà
+// del feed USGS, il bbox degli eventi e i metadata (conteggio, URL della richiesta).
+// È lo stesso serializzatore dell'export con format=geojson.
+func (app *App) streamGeoJSON(c *gin.Context, filter models.EventFilter, limit int64) {
+	writer := geojson.NewWriter(c.Writer, geoJSONMetadata(c))
+	written := 0
+	err := app.Store.Stream(c.Request.Context(), filter, limit, func(ev models.Earthquake) error {
+		if written == 0 {
+			c.Header("Content-Type", geoJSONMIME)
+			c.Status(200)
+		}
+		written++
+		return writer.Write(ev)
+	})
 	if err != nil {
-		//Ignoro il primo valore di ritorno
-		//e torno l'errore nel caso di fallimento
-		return 0, err
+		if written == 0 {
+			c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+			return
+		}
+		log.Printf("Stream GeoJSON interrotto dopo %d elementi: %v", written, err)
+		//Come per gli export CSV e QuakeML: il client deve vedere la risposta fallire
+		abortConnection(c)
+		return
+	}
+	if written == 0 {
+		c.Header("Content-Type", geoJSONMIME)
+		c.Status(200)
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Stream GeoJSON interrotto: %v", err)
 	}
-	//Torniamo il numero di elementi eliminati
-	//o niente (nil) nel caso in cui non c'è
-	//nulla da cancellare
-	return result.DeletedCount, nil
 }
 
-//Funzione che mi restituisce tutto il contenuto del DB senza limiti
-
-func (m *MongoStore) GetAll(ctx context.Context) ([]models.Earthquake, error) {
-	return m.Query(ctx, bson.M{}, 0)
+// Scrive come FeatureCollection eventi già letti (es. una pagina)
+func writeGeoJSON(c *gin.Context, events []models.Earthquake) {
+	c.Header("Content-Type", geoJSONMIME)
+	c.Status(200)
+	writer := geojson.NewWriter(c.Writer, geoJSONMetadata(c))
+	for _, ev := range events {
+		if err := writer.Write(ev); err != nil {
+			log.Printf("Risposta GeoJSON interrotta: %v", err)
+			return
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Risposta GeoJSON interrotta: %v", err)
+	}
 }
 
-//SCOPE E STRUTTURAZIONE
-//Invece di usare variabili globali, incapsuliamo lo stato
-//dell'applicazione in una struct.
-
-// Abbiamo tutto il cuore dell'applicazione qui,
-// l'EventStore analizzato sopra, l'EventChannel
-// che serve per collegare le API ai Worker
-// e il sincronizzatore che tiene conto
-// di quante Gorutine sono attive (funziona come un contatore, è un puntatore
-// essendo un oggetto condiviso, non va mai passato per valore)
-type App struct {
-	Store        EventStore
-	EventChannel chan models.Earthquake
-	WG           *sync.WaitGroup
+// Metadata del FeatureCollection, come nei feed USGS
+func geoJSONMetadata(c *gin.Context) geojson.Metadata {
+	return geojson.Metadata{
+		URL:    c.Request.URL.RequestURI(),
+		Title:  "Earthquake Monitor System",
+		Status: http.StatusOK,
+	}
 }
 
-//MAIN
+// Legge i filtri comuni delle ricerche di eventi: magnitudo, luogo, intervallo di tempo,
+// profondità, allerta tsunami, simulazioni, rettangolo geografico, origini (raw)
+// e numero di risultati.
+// Restituisce un errore per il primo parametro non valido.
+func eventFilterFromQuery(c *gin.Context) (models.EventFilter, int64, error) {
+	var filter models.EventFilter
+	var err error
+
+	//Qui imposto il magnitudo: se la query ne è sprovvista il minimo è 0
+	if filter.MinMagnitude, err = optionalFloatQuery(c, "min_mag"); err != nil {
+		return filter, 0, err
+	}
+	if filter.MinMagnitude == nil {
+		zero := 0.0
+		filter.MinMagnitude = &zero
+	}
+	if filter.MaxMagnitude, err = optionalFloatQuery(c, "max_mag"); err != nil {
+		return filter, 0, err
+	}
+	if filter.MaxMagnitude != nil && *filter.MaxMagnitude < *filter.MinMagnitude {
+		return filter, 0, fmt.Errorf("max_mag (%g) è minore di min_mag (%g)", *filter.MaxMagnitude, *filter.MinMagnitude)
+	}
 
-func main() {
+	//Qui imposto il luogo: la ricerca è per testo contenuto
+	//es. Texas viene trovato anche se scrivo Tex
+	//e non distingue maiuscole e minuscole.
+	//anche se scrivo TEXAS, la ricerca va a buon fine
+	filter.Place = c.Query("place")
 
-	//Configurazione del database
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		mongoURI = "mongodb://localhost:27017"
+	//Intervallo di tempo, in ISO 8601 o come timestamp Unix in ms
+	if filter.StartTime, err = optionalTimeQuery(c, "starttime"); err != nil {
+		return filter, 0, err
+	}
+	if filter.EndTime, err = optionalTimeQuery(c, "endtime"); err != nil {
+		return filter, 0, err
+	}
+	if filter.StartTime != nil && filter.EndTime != nil && *filter.EndTime < *filter.StartTime {
+		return filter, 0, fmt.Errorf("endtime è precedente a starttime")
 	}
 
-	//Usiamo un context con timeout per evitare che l'applicazione si blocchi
-	//all'infinito in fase di avvio se il DB non risponde. Invece che rimanere
-	//bloccata in attesa del DB, dopo 10 secondi fallisce.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	//Profondità in km (positiva verso il basso, come nelle coordinate)
+	if filter.MinDepth, err = optionalFloatQuery(c, "min_depth"); err != nil {
+		return filter, 0, err
+	}
+	if filter.MaxDepth, err = optionalFloatQuery(c, "max_depth"); err != nil {
+		return filter, 0, err
+	}
+	if filter.MinDepth != nil && filter.MaxDepth != nil && *filter.MaxDepth < *filter.MinDepth {
+		return filter, 0, fmt.Errorf("max_depth (%g) è minore di min_depth (%g)", *filter.MaxDepth, *filter.MinDepth)
+	}
 
-	//Il defer qui mi permette di liberare le risorse quando il main termina
-	defer cancel()
+	//tsunami=true solo gli eventi con allerta, tsunami=false solo quelli senza
+	if filter.Tsunami, err = optionalBoolQuery(c, "tsunami"); err != nil {
+		return filter, 0, err
+	}
 
-	//Connesione al DB
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	//Di default le simulazioni sono incluse, come prima che esistesse il parametro
+	includeSimulated, err := optionalBoolQuery(c, "include_simulated")
 	if err != nil {
-		log.Fatal(err)
+		return filter, 0, err
 	}
-
-	//
-	dbCollection := client.Database("earthquake_db").Collection("events")
-	log.Println("Connesso a MongoDB")
-
-	//Inizializzazione App e Dipendenze
-	//Iniettiamo &MongoStore nel campo Store, in modo tale che
-	//l'applicazione può usare i metodi astratti dell'interfaccia
-	//EventStore
-	app := &App{
-		Store: &MongoStore{collection: dbCollection},
-		//Utilizzo dei Canali:
-		//Creiamo un canale con buffer 100 per disaccoppiare parzialmente
-		//produttore (API) e consumatore (Worker).
-		//In modo che le APi possono accettare fino ad un massimo di 100
-		//richieste anche se i worker sono occupati.
-		EventChannel: make(chan models.Earthquake, 100),
-		WG:           &sync.WaitGroup{},
+	if includeSimulated != nil && !*includeSimulated {
+		simulated := false
+		filter.Simulated = &simulated
 	}
 
-	//Invece di una singola goroutine, ne avviamo 10 per parallelizzare il lavoro. (Pool Workers)
-	//Nel caso in cui una singola richiesta HTTP potrebbe saturare il sistema
-	//Essendo molto leggere e soprattuto velocissime, evitiamo di avere colli di bottiglia
-	//in Go, quando decidiamo di richiedere i dati dei terremoti delle scorse 24 ore, o di 7/30gg fa.
-
-	numWorkers := 10
-	for i := 0; i < numWorkers; i++ {
-		app.WG.Add(1) //Incremento il contatore del WaitGroup prima di lanciare la Gorutine
-		//Lancio la funzione startWorker in una nuova Gorutine
-		go app.startWorker(i, app.EventChannel) //Usiamo la keyword "go" per avviare una goroutine
+	//Filtro geografico per rettangolo (minlat, maxlat, minlon, maxlon)
+	if filter.BBox, err = bboxFromQuery(c); err != nil {
+		return filter, 0, err
 	}
 
-	//Setup Gin
-	//Gin è uno dei framework più utilizzati per il linguaggio Go
-	//che ci ha semplificato molto il lavoro per gestire le API REST.
-	r := gin.New()
+	//Di default restituiamo gli eventi logici: per ogni terremoto la sola origine preferita,
+	//con l'elenco di tutte le origini delle varie agenzie. Con raw=true tutte le origini
+	raw, err := optionalBoolQuery(c, "raw")
+	if err != nil {
+		return filter, 0, err
+	}
+	filter.Preferred = raw == nil || !*raw
 
-	//Definizione Rotte usando i metodi dell'istanza App
-	api := r.Group("/api")
-	{
-		//Passiamo i metodi dell'istanza 'app' come handler
-		api.POST("/ingest", app.ingestEarthquake)
-		api.GET("/events", app.getEvents)
-		api.POST("/fetch-now", app.ManualFetch)
-		api.POST("/simulate", app.simulateUSEarthquake)
-		api.DELETE("/cleanup", app.cleanupOldEvents)
-		api.GET("/export", app.exportCSV)
+	//Ordinamento: di default dal più recente, come prima che esistesse il parametro.
+	//Il cursore delle pagine vale per qualsiasi ordinamento (vedi pagination.go)
+	var ok bool
+	if filter.Sort, ok = sortOrders[c.Query("sort")]; !ok {
+		return filter, 0, fmt.Errorf("parametro sort non valido: %q (valori ammessi: time, time-asc, magnitude, magnitude-asc)", c.Query("sort"))
 	}
 
-	//Il main si ferma qui, ed entra in un loop infinito che gli permette
-	//Di ascoltare le richieste HTTP sulla porta 8080. Rimane bloccato
-	//Perché la Run è un'istruzione bloccante.
-	log.Printf("Server Go avviato sulla porta 8080")
-	r.Run(":8080")
+	//Imposto il numero di valori che voglio ricevere:
+	//se l'utente non lo specifica rimane 0 (cioè tutti i valori trovati)
+	limit, err := optionalIntQuery(c, "limit")
+	if err != nil || (limit != nil && *limit < 0) {
+		return filter, 0, fmt.Errorf("parametro limit non valido: %q", c.Query("limit"))
+	}
+	if limit == nil {
+		return filter, 0, nil
+	}
+	return filter, *limit, nil
 }
 
-// Logica dei Worker
-// startWorker consuma gli eventi del canale
-// Abbiamo usato un canale unidirezione (<-chan) per evitare
-// che il worker scriva nel canale (visto che consuma solo).
-// Banalmente ci serve per salvare i dati senza rallentare le rispost del client
-func (app *App) startWorker(id int, events <-chan models.Earthquake) {
+// Valori del parametro sort di /api/events, gli stessi di orderby nel servizio FDSN
+var sortOrders = map[string]models.SortOrder{
+	"":              models.SortTimeDesc,
+	"time":          models.SortTimeDesc,
+	"time-asc":      models.SortTimeAsc,
+	"magnitude":     models.SortMagnitudeDesc,
+	"magnitude-asc": models.SortMagnitudeAsc,
+}
 
-	//Quando la funzione termina, il Defer chiama Done() per segnalare che il worker ha finito il lavoro
-	defer app.WG.Done() // Segnala al WaitGroup quando finito: Decrementa il contatore quando il worker finisce
-	log.Printf("Worker %d avviato", id)
+// Legge un istante come timestamp Unix in ms oppure in ISO 8601
+// (es. "2024-08-02T01:02:03Z", "2024-08-02T01:02:03" in UTC, "2024-08-02").
+// Restituisce nil se il parametro è assente.
+func optionalTimeQuery(c *gin.Context, name string) (*int64, error) {
+	raw := strings.TrimSpace(c.Query(name))
+	if raw == "" {
+		return nil, nil
+	}
+	if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return &ms, nil
+	}
+	t, err := parseISOTime(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parametro %s non valido: %q (serve un tempo ISO 8601 o un timestamp in ms)", name, raw)
+	}
+	ms := t.UnixMilli()
+	return &ms, nil
+}
 
-	//Ciclo for-range su un canale per far si che nel caso in cui questo sia vuoto
-	//i worker vadano in "stand-by", cioè si addormentano finché non arriva un evento,
-	//in modo da non consumare CPU.
-	for event := range events {
+// Legge un tempo ISO 8601; senza fuso orario si intende UTC
+func parseISOTime(raw string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+		var t time.Time
+		if t, err = time.Parse(layout, raw); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
 
-		//Usiamo il metodo Upsert e se qualcosa non va come dovrebbe, il worker non viene fermato
-		//Usiamo context.Background() perché il worker è un processo asincrono
-		//e non deve dipendere dal contesto della richiesta HTTP originale (che è già terminata).
-		//Significa che le richieste HTTP che riceviamo hanno il loro Context, che scade appena
-		//inviamo la risposta al client, il worker però elabora l'evento (cioè la richiesta) dopo
-		//che la risposta è già stata inviata (in modo asincrono). Se non facesse così, il salvataggio
-		//sul database fallirebbe perché la richiesta originale è fallita (context scaduto)
-		if err := app.Store.Upsert(context.Background(), event); err != nil {
-			log.Printf("- Worker %d - Errore DB: %v", id, err)
+// Legge il rettangolo geografico dai parametri minlat, maxlat, minlon, maxlon.
+// Restituisce nil se non c'è nessuno dei quattro; se ce ne sono solo alcuni è un errore.
+// minlon > maxlon indica un rettangolo che attraversa l'antimeridiano (es. 170, -170).
+func bboxFromQuery(c *gin.Context) (*models.BoundingBox, error) {
+	names := []string{"minlat", "maxlat", "minlon", "maxlon"}
+	values := make([]float64, len(names))
+	present := 0
+	for i, name := range names {
+		v, err := optionalFloatQuery(c, name)
+		if err != nil {
+			return nil, err
 		}
+		if v != nil {
+			values[i] = *v
+			present++
+		}
+	}
+	if present == 0 {
+		return nil, nil
+	}
+	if present < len(names) {
+		return nil, fmt.Errorf("il rettangolo richiede tutti i parametri minlat, maxlat, minlon, maxlon")
+	}
+	box := &models.BoundingBox{MinLat: values[0], MaxLat: values[1], MinLon: values[2], MaxLon: values[3]}
+	if err := validateBBox(*box); err != nil {
+		return nil, err
 	}
+	return box, nil
 }
 
-//HANDLERS DELLE FUNZIONI CHIAMATE TRAMITE API
+// Controlla che il rettangolo abbia coordinate nei limiti
+func validateBBox(b models.BoundingBox) error {
+	if b.MinLat < -90 || b.MaxLat > 90 || b.MinLat > b.MaxLat {
+		return fmt.Errorf("latitudini non valide: servono -90 <= minlat <= maxlat <= 90")
+	}
+	if b.MinLon < -180 || b.MinLon > 180 || b.MaxLon < -180 || b.MaxLon > 180 {
+		return fmt.Errorf("longitudini non valide: devono essere comprese tra -180 e 180")
+	}
+	return nil
+}
 
-// Riceve i dati dall'API esterna e li inserisce nel canale per essere consumati dai worker
-func (app *App) ingestEarthquake(c *gin.Context) {
-	var event models.Earthquake
+// Corpo della ricerca POST: come i parametri di /api/events, più un poligono GeoJSON.
+// Gli altri filtri di /api/events (tempo, profondità, tsunami, raw, ...) si passano in query.
+type searchRequest struct {
+	Polygon *models.GeoPolygon  `json:"polygon"`
+	BBox    *models.BoundingBox `json:"bbox"`
+	MinMag  *float64            `json:"min_mag"`
+	MaxMag  *float64            `json:"max_mag"`
+	Place   string              `json:"place"`
+	Limit   int64               `json:"limit"`
+}
 
-	//Qui viene usata la reflection, mappiamo i campi del JSON in quelli della struct event
-	if err := c.ShouldBindJSON(&event); err != nil {
-		//Nel caso in cui il client inviasse dati non validi, la funzione si ferma
-		//rispondendo con un errore.
+// Ricerca per area: riceve nel corpo un poligono GeoJSON (e/o un rettangolo)
+// e restituisce gli eventi al suo interno, come /api/events.
+// Usiamo una POST perché un poligono non entra comodamente in una query string.
+func (app *App) searchEvents(c *gin.Context) {
+	var req searchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	//Il select permette di gestire operazioni su canali.
-	//Nel caso in cui ci sia spazio nel canale (100 slot), la richiesta viene messa in coda
-	//altrimenti viene scartata perché non c'è spazio
-	select {
-	case app.EventChannel <- event:
-		c.JSON(http.StatusOK, gin.H{"status": "queued"})
-	default:
-		//se il sistema è saturo, rifiutiamo la richiesta.
-		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "queue_full"})
+	if req.Limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit deve essere un intero positivo"})
+		return
 	}
-}
-
-// Questa è una funzione di ricerca del database
-func (app *App) getEvents(c *gin.Context) {
 
-	//Leggo gli input passati nella query
-	//quindi il magnitudo, luogo e il limite di valori
-	minMagStr := c.Query("min_mag")
-	placeFilter := c.Query("place")
-	limitStr := c.Query("limit")
+	//Partiamo dagli stessi filtri di /api/events (così anche qui di default
+	//c'è un solo risultato per evento logico), poi aggiungiamo quelli del corpo
+	filter, limit, err := eventFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MinMag != nil {
+		filter.MinMagnitude = req.MinMag
+	}
+	if req.MaxMag != nil {
+		filter.MaxMagnitude = req.MaxMag
+	}
+	if filter.MaxMagnitude != nil && *filter.MaxMagnitude < *filter.MinMagnitude {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_mag è minore di min_mag"})
+		return
+	}
+	if req.Place != "" {
+		filter.Place = req.Place
+	}
+	if req.Limit > 0 {
+		limit = req.Limit
+	}
+	if req.Polygon != nil {
+		if err := req.Polygon.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.Polygon = req.Polygon
+	}
+	if req.BBox != nil {
+		if err := validateBBox(*req.BBox); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.BBox = req.BBox
+	}
 
-	//E costruisco il classico filtro che MoongoDB capisce
-	filter := bson.M{}
+	geo, err := geoJSONRequested(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if geo {
+		app.streamGeoJSON(c, filter, limit)
+		return
+	}
+	app.streamEvents(c, filter, limit)
+}
 
-	//Qui imposto il magnitudo minimo usando l'operatore $gte, cioè
-	//Grather than or Equal (maggiore o uguale)
-	if minMagStr != "" {
-		if mag, err := strconv.ParseFloat(minMagStr, 64); err == nil {
-			filter["magnitude"] = bson.M{"$gte": mag}
-		}
-	} else {
-		//Nel caso in cui la query sia sprovvista di magnitudo
-		//lo imposto a 0.
-		filter["magnitude"] = bson.M{"$gte": 0.0}
+// Ricerca "vicino a me": restituisce gli eventi entro radius_km dal punto (lat, lon),
+// ciascuno con la sua distanza, dal più vicino al più lontano.
+// Si possono aggiungere min_mag, starttime e endtime (timestamp Unix in ms) e limit.
+func (app *App) getNearbyEvents(c *gin.Context) {
+	//Qui i parametri sono obbligatori: senza un punto e un raggio la ricerca non ha senso
+	lat, err := requiredFloatQuery(c, "lat", -90, 90)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	//Qui imposto il luogo: uso $regex per cercare pezzi di testo
-	//es. Texas viene trovato anche se scrivo Tex
-	//e anche $options: "i" per il Case sensitive.
-	//anche se scrivo TEXAS, la ricerca va a buon fine
-	if placeFilter != "" {
-		filter["place"] = bson.M{"$regex": placeFilter, "$options": "i"}
+	lon, err := requiredFloatQuery(c, "lon", -180, 180)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	//Limitiamo il raggio a metà circonferenza terrestre; un raggio nullo non trova nulla
+	radius, err := requiredFloatQuery(c, "radius_km", 0, math.Pi*models.EarthRadiusKm)
+	if err == nil && radius == 0 {
+		err = fmt.Errorf("parametro radius_km deve essere maggiore di 0")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	//Imposto il numero di valori che voglio ricevere
-	var limit int64 = 0
-	//Se l'utente non lo specifica nella richiesta, di default rimane 0 (cioè tutti i valori trovati)
-	if limitStr != "" {
-		//Altrimenti li devo convertire, da stringa ad interno e intero positivo
-		//Non permetto all'utente di inserire un limite che non sia un numero
-		//e soprattuto che non sia positivo. In caso contrario ignoro il parametro
-		if l, err := strconv.ParseInt(limitStr, 10, 64); err == nil && l > 0 {
-			limit = l
-		}
+	var filter models.EventFilter
+	if filter.MinMagnitude, err = optionalFloatQuery(c, "min_mag"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	//Come in /api/events: tempo ISO 8601 o timestamp in ms
+	if filter.StartTime, err = optionalTimeQuery(c, "starttime"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.EndTime, err = optionalTimeQuery(c, "endtime"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.StartTime != nil && filter.EndTime != nil && *filter.EndTime < *filter.StartTime {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "endtime è precedente a starttime"})
+		return
+	}
+	var limit int64
+	if l, err := optionalIntQuery(c, "limit"); err != nil || (l != nil && *l <= 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit deve essere un intero positivo"})
+		return
+	} else if l != nil {
+		limit = *l
 	}
 
-	//Passiamo c.Request.Context() allo store. Se l'utente annulla la richiesta
-	//MongoDB interromperà l'operazione risparmiando risorse. Nel caso in cui
-	//ad esempio, la richiesta è troppo lenta per l'utente e questo l'annulla.
-	events, err := app.Store.Query(c.Request.Context(), filter, limit)
+	events, err := app.Store.Near(c.Request.Context(), lat, lon, radius, filter, limit)
 	if err != nil {
+		log.Printf("Errore ricerca per distanza: %v", err)
 		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
 		return
 	}
-	//Se tutto va bene torniamo la lista di struct events in formato JSON
-	//e la mandiamo al client.
 	c.JSON(200, events)
 }
 
+// Legge un parametro numerico obbligatorio e controlla che sia nell'intervallo [min, max]
+func requiredFloatQuery(c *gin.Context, name string, min, max float64) (float64, error) {
+	v, err := optionalFloatQuery(c, name)
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return 0, fmt.Errorf("parametro %s obbligatorio", name)
+	}
+	if *v < min || *v > max {
+		return 0, fmt.Errorf("parametro %s fuori intervallo [%g, %g]", name, min, max)
+	}
+	return *v, nil
+}
+
+// Legge un parametro float opzionale: nil se assente, errore se non è un numero
+func optionalFloatQuery(c *gin.Context, name string) (*float64, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("parametro %s non valido: %q", name, raw)
+	}
+	return &v, nil
+}
+
+// Legge un parametro intero opzionale: nil se assente, errore se non è un intero
+func optionalIntQuery(c *gin.Context, name string) (*int64, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parametro %s non valido: %q", name, raw)
+	}
+	return &v, nil
+}
+
+// Legge un parametro booleano opzionale (true/false, 1/0): nil se assente
+func optionalBoolQuery(c *gin.Context, name string) (*bool, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parametro %s non valido: %q", name, raw)
+	}
+	return &v, nil
+}
+
 // Funzione per il fetch manuale
 // Abbiamo introdotto un principio di separazione delle resposabilità
 // Il main (Go) non si occupa di scaricare i dati, ma solo di gestirli
@@ -407,10 +2162,32 @@ func (app *App) ManualFetch(c *gin.Context) {
 		reqBody.Range = "hour"
 	}
 
+	//Con l'ingestione nativa scarichiamo noi il feed, senza passare dal sensor agent
+	if app.Feeds != nil {
+		result, err := app.Feeds.Fetch(c.Request.Context(), reqBody.Range)
+		if errors.Is(err, feeds.ErrUnknownFeed) {
+			c.JSON(http.StatusBadRequest, gin.H{"Errore": "Inserisci un range valido tra: hour, day, 7days, 30days"})
+			return
+		}
+		if err != nil {
+			log.Printf("Errore fetch feed %s: %v", reqBody.Range, err)
+			c.JSON(http.StatusBadGateway, gin.H{"Errore": "Download del feed USGS non riuscito"})
+			return
+		}
+		//Stesse chiavi della risposta del sensor agent, più il dettaglio del download
+		c.JSON(http.StatusOK, gin.H{
+			"Stato":  "Completato",
+			"Range":  reqBody.Range,
+			"Eventi": result.Events,
+			"feed":   result,
+		})
+		return
+	}
+
 	//Trasformo la struct di Go in una sequenza di byte JSON
 	jsonData, _ := json.Marshal(reqBody)
 	//Delego il sensor_agent (Python) per scaricare i dati internet
-	sensorURL := "http://sensor-agent:5001/trigger-fetch"
+	sensorURL := app.SensorAgentURL + "/trigger-fetch"
 
 	//Qui uso la libreria standard net/http come Client
 	//Anche qui propaghiamo il contesto per gestire timeout e cancellazioni
@@ -438,47 +2215,45 @@ func (app *App) ManualFetch(c *gin.Context) {
 }
 
 // Questa è la funzione di pulizia del DB
-// elimina tutto ciò che sià più vecchio di 1 ora e che non sia reale
-// (quindi generato da noi)
+// applica subito le politiche di conservazione: archivia gli eventi reali
+// scaduti e cancella le simulazioni (quindi generate da noi)
 func (app *App) cleanupOldEvents(c *gin.Context) {
 
-	//Possiamo modificare da qui il tempo di cancellazione
-	//o dalla richiesta che facciamo se lo specifichiamo
-	hoursStr := c.Query("hours")
-	hours := 1
-
-	//Qui controlliamo come prima che nella query vengano passati dati corretti
-	//quindi numeri interi positivi
-	if hoursStr != "" {
-		if h, err := strconv.Atoi(hoursStr); err == nil && h > 0 {
-			hours = h
-		}
+	//Prima questa chiamata cancellava tutto ciò che era più vecchio di "hours"
+	//(di default un'ora!): ora applica subito le politiche di conservazione,
+	//quindi gli eventi reali vengono al massimo spostati nell'archivio.
+	//Il parametro hours viene accettato per compatibilità con il frontend ma ignorato.
+	if hours := c.Query("hours"); hours != "" {
+		log.Printf("PULIZIA parametro hours=%s ignorato: si applicano le politiche di conservazione", hours)
 	}
 
-	//Qui definisco il tempo, misuro dal valore attuale, sottraggo 1 ora, e poi
-	//converto il valore in millisecondi
-	//tutto ciò che ha un timestamp minore del valore cutoffTime è considerato vecchio
-	//e verrà cancellato
-	cutoffTime := time.Now().Add(-time.Duration(hours) * time.Hour).UnixMilli()
-
-	//Deleghiamo all'interfaccia Store la logica di cancellazione
-	//noi specifichiamo solo i filtri della cancellazione ma la funzione
-	//non sa come cancellare i dati dal DB.
-	//Inoltre torniamo il numero di valori cancellati
-	count, err := app.Store.DeleteOld(c.Request.Context(), cutoffTime)
+	//Deleghiamo alle politiche la scelta di cosa archiviare e cosa cancellare:
+	//sarà poi lo store a sapere come farlo sul proprio database
+	report, err := app.Retention.Run(c.Request.Context(), app.Store)
 	if err != nil {
-		c.JSON(500, gin.H{"Errore DB": "Errore nella pulizia del database"})
+		c.JSON(500, gin.H{"Errore DB": "Errore nella pulizia del database", "report": report})
 		return
 	}
 
-	//Torniamo il numero di errori cancellati nell'arco di tempo specificato
-	msg := fmt.Sprintf("Pulizia: rimossi %d eventi nelle ultime %d ore.", count, hours)
+	msg := fmt.Sprintf("Pulizia: %d eventi archiviati e %d cancellati.", report.Archived, report.Deleted)
 	log.Printf("PULIZIA %s", msg)
 
-	//Torno un JSON che mi dice quanti elementi sono stati cancellati
+	//Torno un JSON con il riassunto per ogni politica.
+	//deleted_count conta gli eventi tolti dal catalogo, come prima
 	c.JSON(200, gin.H{
-		"message":       msg,
-		"deleted_count": count,
+		"message":        msg,
+		"deleted_count":  report.Archived + report.Deleted,
+		"archived_count": report.Archived,
+		"report":         report,
+	})
+}
+
+// Mostra le politiche di conservazione configurate e l'esito dell'ultimo giro
+func (app *App) getRetention(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"policies": app.Retention.Policies,
+		"interval": app.Retention.Interval.String(),
+		"last_run": app.Retention.Last(),
 	})
 }
 
@@ -487,8 +2262,8 @@ func (app *App) cleanupOldEvents(c *gin.Context) {
 func (app *App) simulateUSEarthquake(c *gin.Context) {
 
 	//Creo una stringa univoca che concatena "sim_" con il timestamp di ora
-	//"sim_us" viene utilizzato nella DeleteOld nel MongoStore per conferma
-	//che stiamo cancellando terremoti falsi
+	//il prefisso "sim_" viene riconosciuto da IsSimulatedEvent, così la politica
+	//di conservazione delle simulazioni sa che stiamo cancellando terremoti falsi
 	fakeID := fmt.Sprintf("sim_us_%d", time.Now().UnixNano())
 	//Qui abbiamo creato un array di città
 	cities := []string{"San Francisco, CA", "Los Angeles, CA", "Seattle, WA", "Portland, OR", "San Diego, CA"}
@@ -515,37 +2290,57 @@ func (app *App) simulateUSEarthquake(c *gin.Context) {
 	//Bypasso i worker e effettuo direttamente l'inserimento
 	//Lo posso fare perché è un'azione che viene fatta dall'utente nel frontend
 	//Non genero simultaneamente 1000 terremoti, quindi non ho bisogno di una coda di worker.
-	if err := app.Store.Upsert(c.Request.Context(), fakeEvent); err != nil {
+	result, err := app.Store.Upsert(c.Request.Context(), fakeEvent)
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to simulate"})
 		return
 	}
+	app.Fetches.changed([]models.UpsertResult{result})
 	c.JSON(201, fakeEvent)
 }
 
 // Questa funzione permette all'utente di scaricare un file CSV (eseguibile con Excel)
 // che contiene tutti i dati presenti del database.
+// Con format=quakeml il catalogo viene esportato in QuakeML 1.2, per scambiarlo con altre agenzie,
+// con format=geojson come FeatureCollection GeoJSON, per i programmi GIS.
 func (app *App) exportCSV(c *gin.Context) {
-
-	//Intanto recupero tutti i dati dal DB
-	events, err := app.Store.GetAll(c.Request.Context())
-	if err != nil {
-		c.JSON(500, gin.H{"error": "db error"})
+	switch c.Query("format") {
+	case "", "csv":
+	case "quakeml":
+		app.exportQuakeML(c)
+		return
+	case "geojson":
+		app.exportGeoJSON(c)
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "parametro format non valido: ammessi csv, quakeml e geojson"})
 		return
 	}
 
-	//Qui indico al browser di non mostrare il contenuto della finestra, ma solo quello di salvare
-	//il file .csv, specificando che il formato è un testo separato da virgole
-	c.Header("Content-Disposition", "attachment; filename=report_terremoti.csv")
-	c.Header("Content-Type", "text/csv")
-
 	//Qui facciamo in modo che la libreria CSV di Go si colleghi direttamente all'utente
 	writer := csv.NewWriter(c.Writer)
 
-	//Intestazione del file CSV
-	writer.Write([]string{"Data Ora", "Luogo", "Magnitudo", "Profondita (km)", "Tsunami", "Rischio"})
+	//Header della risposta e intestazione del file: li scriviamo solo quando sappiamo
+	//che lo store risponde, così un errore iniziale resta un 500 in JSON
+	start := func() {
+		//Qui indico al browser di non mostrare il contenuto della finestra, ma solo quello di salvare
+		//il file .csv, specificando che il formato è un testo separato da virgole
+		c.Header("Content-Disposition", "attachment; filename=report_terremoti.csv")
+		c.Header("Content-Type", "text/csv")
+		writer.Write([]string{"Data Ora", "Luogo", "Magnitudo", "Profondita (km)", "Tsunami", "Rischio"})
+	}
+	written := 0
 
+	//Invece di caricare tutto il DB in memoria, scriviamo le righe
+	//man mano che gli eventi arrivano dal cursore dello store.
+	//Se il client annulla il download, il contesto della richiesta viene annullato
+	//e anche la query sul DB si ferma.
 	//Qui ignoro l'ID del terremoto
-	for _, ev := range events {
+	err := app.Store.Stream(c.Request.Context(), models.EventFilter{}, 0, func(ev models.Earthquake) error {
+		if written == 0 {
+			start()
+		}
+		written++
 
 		//Converto il dato da millisecondi (Timestamp UNIX) ad un formato comprensibile
 		tm := time.UnixMilli(ev.Time).UTC()
@@ -577,8 +2372,89 @@ func (app *App) exportCSV(c *gin.Context) {
 			tsunami,
 			risk.String(), //Chiama il metodo String() definito all'inizio
 		})
+
+		//Se la scrittura verso il client fallisce (connessione chiusa) ci fermiamo
+		return writer.Error()
+	})
+	if err != nil {
+		log.Printf("Export CSV interrotto dopo %d eventi: %v", written, err)
+		if written == 0 {
+			c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+			return
+		}
+		//Come per il QuakeML: un file troncato sembrerebbe completo,
+		//interrompiamo la connessione così il download fallisce
+		abortConnection(c)
+		return
+	}
+	if written == 0 {
+		start()
 	}
 	//Obbligo a prendere i dati nella RAM e scriverli nella parte finale del file
 	//senza Flush() le ultime righe del CSV andrebbero perse
 	writer.Flush()
 }
+
+// Export del catalogo come FeatureCollection GeoJSON, per i programmi GIS
+func (app *App) exportGeoJSON(c *gin.Context) {
+	//Come il CSV contiene tutto il catalogo, le simulazioni sono riconoscibili da is_simulated
+	c.Header("Content-Disposition", "attachment; filename=catalogo_terremoti.geojson")
+	app.streamGeoJSON(c, models.EventFilter{}, 0)
+}
+
+// Export del catalogo in QuakeML 1.2. Come per il CSV gli eventi vengono scritti
+// man mano che arrivano dallo store. Gli eventi simulati non vengono esportati:
+// il documento è pensato per altre agenzie.
+func (app *App) exportQuakeML(c *gin.Context) {
+	//Gli header del file li scriviamo solo quando sappiamo che lo store risponde
+	setHeaders := func() {
+		c.Header("Content-Disposition", "attachment; filename=catalogo_terremoti.xml")
+		c.Header("Content-Type", "application/xml")
+	}
+
+	writer := quakeml.NewWriter(c.Writer, quakeml.DefaultAuthority)
+	simulated := false
+	written := 0
+	err := app.Store.Stream(c.Request.Context(), models.EventFilter{Simulated: &simulated}, 0, func(ev models.Earthquake) error {
+		if written == 0 {
+			setHeaders()
+		}
+		written++
+		return writer.Write(ev)
+	})
+	if err != nil {
+		log.Printf("Export QuakeML interrotto dopo %d eventi: %v", written, err)
+		if written == 0 {
+			c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+			return
+		}
+		//Chiudere il documento darebbe un catalogo valido ma incompleto, che chi lo
+		//importa non saprebbe riconoscere: interrompiamo la connessione, così il download fallisce
+		abortConnection(c)
+		return
+	}
+	if written == 0 {
+		setHeaders()
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Export QuakeML interrotto: %v", err)
+	}
+}
+
+// Chiude la connessione senza terminare la risposta già iniziata: il client vede
+// una risposta troncata (es. il chunk finale mancante) invece di un documento completo.
+// Se la connessione non si può prendere (HTTP/2, test) la risposta resta com'è.
+// Il ResponseWriter di gin rifiuta l'Hijack dopo la prima scrittura: chiediamo la
+// connessione a quello di net/http che c'è sotto, che svuota il buffer e la cede.
+func abortConnection(c *gin.Context) {
+	var w http.ResponseWriter = c.Writer
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		w = u.Unwrap()
+	}
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("Impossibile interrompere la connessione: %v", err)
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"backend-go/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Crea un'App con il MemoryStore e i worker avviati, come main ma senza WAL,
+// poller e attività in background. I worker vengono fermati alla fine del test.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	app := &App{
+		Store:              NewMemoryStore(),
+		EventChannel:       make(chan queuedEvent, 100),
+		WG:                 &sync.WaitGroup{},
+		BatchSize:          10,
+		BatchDelay:         5 * time.Millisecond,
+		BatchIngestTimeout: time.Second,
+		MaxPageSize:        1000,
+		RelatedRadiusKm:    100,
+		RelatedLimit:       10,
+		FDSNMaxEvents:      100,
+		SuspectPolicy:      suspectReject,
+		Queue:              newIngestQueueFromEnv(false),
+		Fetches:            newFetchTracker(),
+		life:               newLifecycle(),
+	}
+	for i := 0; i < 2; i++ {
+		app.WG.Add(1)
+		go app.startWorker(i, app.EventChannel)
+	}
+	t.Cleanup(func() {
+		app.life.closing.Store(true)
+		close(app.EventChannel)
+		app.WG.Wait()
+	})
+	return app
+}
+
+// Esegue una richiesta sulle rotte dell'App e restituisce la risposta registrata
+func doRequest(t *testing.T, app *App, method, target string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// Aspetta che i worker abbiano salvato n eventi
+func waitForEvents(t *testing.T, app *App, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		all, err := app.Store.GetAll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("salvati %d eventi su %d", len(all), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testEvent(id string, mag float64, age time.Duration) models.Earthquake {
+	return models.Earthquake{
+		ID:          id,
+		Place:       "10km N of Test",
+		Magnitude:   mag,
+		Time:        time.Now().Add(-age).UnixMilli(),
+		Coordinates: []float64{13.5, 43.6, 8.1},
+	}
+}
+
+func decodeEvents(t *testing.T, rec *httptest.ResponseRecorder) []models.Earthquake {
+	t.Helper()
+	var events []models.Earthquake
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatalf("risposta non valida: %v\n%s", err, rec.Body.String())
+	}
+	return events
+}
+
+func TestIngestAndGetEvents(t *testing.T) {
+	app := newTestApp(t)
+
+	for _, ev := range []models.Earthquake{
+		testEvent("us1000aaaa", 2.5, time.Hour),
+		testEvent("us1000bbbb", 4.8, 2*time.Hour),
+	} {
+		rec := doRequest(t, app, http.MethodPost, "/api/ingest", ev)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ingest %s: status %d, %s", ev.ID, rec.Code, rec.Body.String())
+		}
+	}
+	waitForEvents(t, app, 2)
+
+	//Dal più recente al più vecchio
+	events := decodeEvents(t, doRequest(t, app, http.MethodGet, "/api/events", nil))
+	if len(events) != 2 || events[0].ID != "us1000aaaa" || events[1].ID != "us1000bbbb" {
+		t.Fatalf("eventi inattesi: %+v", events)
+	}
+	if events[0].Revision != 1 {
+		t.Errorf("revisione %d, attesa 1", events[0].Revision)
+	}
+
+	events = decodeEvents(t, doRequest(t, app, http.MethodGet, "/api/events?min_mag=4", nil))
+	if len(events) != 1 || events[0].ID != "us1000bbbb" {
+		t.Fatalf("filtro min_mag: %+v", events)
+	}
+
+	rec := doRequest(t, app, http.MethodGet, "/api/events/us1000aaaa", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/events/:id: status %d", rec.Code)
+	}
+	if rec := doRequest(t, app, http.MethodGet, "/api/events/us1000zzzz", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("evento inesistente: status %d, atteso 404", rec.Code)
+	}
+}
+
+func TestIngestRejectsInvalidEvent(t *testing.T) {
+	app := newTestApp(t)
+
+	ev := testEvent("us1000cccc", 3, time.Hour)
+	ev.Coordinates = []float64{13.5, 143.6, 8.1}
+	rec := doRequest(t, app, http.MethodPost, "/api/ingest", ev)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, atteso 422: %s", rec.Code, rec.Body.String())
+	}
+	if all, _ := app.Store.GetAll(context.Background()); len(all) != 0 {
+		t.Fatalf("l'evento non valido è stato salvato: %+v", all)
+	}
+}
+
+func TestGetEventsInvalidParameters(t *testing.T) {
+	app := newTestApp(t)
+	for _, query := range []string{
+		"min_mag=abc",
+		"min_mag=5&max_mag=4",
+		"starttime=ieri",
+		"limit=-1",
+		"minlat=10",
+	} {
+		if rec := doRequest(t, app, http.MethodGet, "/api/events?"+query, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, atteso 400", query, rec.Code)
+		}
+	}
+}
+
+func TestSearchEventsReturnsPreferredOrigins(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+
+	usgs := testEvent("us1000dddd", 4.1, time.Hour)
+	ingv := testEvent("ingv:3734", 4.0, time.Hour)
+	ingv.Source = "ingv"
+	old := testEvent("us1000eeee", 3.0, 72*time.Hour)
+	if _, errs := app.Store.UpsertMany(ctx, []models.Earthquake{usgs, ingv, old}); errs[0] != nil || errs[1] != nil || errs[2] != nil {
+		t.Fatal(errs)
+	}
+	//Le due origini dello stesso terremoto formano un evento logico con INGV preferita
+	err := app.Store.Associate(ctx, []models.EventGroup{{
+		LogicalID: usgs.ID,
+		Preferred: ingv.ID,
+		Members:   []string{usgs.ID, ingv.ID},
+		Origins:   []models.OriginRef{models.RefOf(ingv), models.RefOf(usgs)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := map[string]any{"bbox": models.BoundingBox{MinLat: 40, MaxLat: 45, MinLon: 10, MaxLon: 15}}
+	start := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339)
+	events := decodeEvents(t, doRequest(t, app, http.MethodPost, "/api/events/search?starttime="+start, body))
+	if len(events) != 1 || events[0].ID != ingv.ID {
+		t.Fatalf("attesa la sola origine preferita %s, trovati %+v", ingv.ID, events)
+	}
+
+	//Con raw=true tornano tutte le origini
+	events = decodeEvents(t, doRequest(t, app, http.MethodPost, "/api/events/search?raw=true&starttime="+start, body))
+	if len(events) != 2 {
+		t.Fatalf("con raw=true attese 2 origini, trovati %+v", events)
+	}
+}
+
+// Store che si interrompe dopo il primo evento, come un cursore perso a metà export
+type brokenStreamStore struct{ EventStore }
+
+func (s brokenStreamStore) Stream(ctx context.Context, filter models.EventFilter, limit int64, fn func(models.Earthquake) error) error {
+	if err := fn(testEvent("us1000ffff", 3, time.Hour)); err != nil {
+		return err
+	}
+	return errors.New("cursore perso")
+}
+
+func TestExportAbortsOnStreamError(t *testing.T) {
+	app := newTestApp(t)
+	app.Store = brokenStreamStore{app.Store}
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	for _, format := range []string{"quakeml", "csv", "geojson"} {
+		//Il client non deve ricevere un file completo ma troncato: fallisce la
+		//richiesta (se non era ancora arrivato nulla) o la lettura del corpo
+		resp, err := http.Get(srv.URL + "/api/export?format=" + format)
+		if err != nil {
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Fatalf("export %s interrotto letto come completo:\n%s", format, body)
+		}
+	}
+}
+
+// Aspetta che l'origine id faccia parte dell'evento logico logicalID
+func waitForLogicalID(t *testing.T, app *App, id, logicalID string) models.Earthquake {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ev, err := app.Store.Get(context.Background(), id)
+		if err == nil && ev.LogicalID == logicalID {
+			return ev
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("origine %s: evento logico %q, atteso %q (err %v)", id, ev.LogicalID, logicalID, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAssociationKeepsFirstOriginAsLogicalID(t *testing.T) {
+	app := newTestApp(t)
+	app.Associator = &Associator{Window: 16 * time.Second, MaxDistanceKm: 100, MaxMagDiff: 0.7, Priority: []string{"ingv", "emsc", "usgs"}}
+	app.startAssociation()
+	t.Cleanup(func() {
+		app.associations.close()
+		<-app.associations.done
+	})
+	ctx := context.Background()
+
+	//Lo stesso terremoto arriva da tre agenzie, una dopo l'altra, e le origini
+	//vengono associate insieme (es. la goroutine di associazione era indietro)
+	usgs := testEvent("us1000gggg", 4.1, time.Hour)
+	ingv := testEvent("ingv:3735", 4.0, time.Hour)
+	ingv.Source = "ingv"
+	emsc := testEvent("emsc:20240802_1", 4.2, time.Hour)
+	emsc.Source = "emsc"
+	var saved []models.UpsertResult
+	for _, ev := range []models.Earthquake{usgs, ingv, emsc} {
+		result, err := app.Store.Upsert(ctx, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, result)
+		time.Sleep(2 * time.Millisecond) //UpdatedAt diversi
+	}
+	app.associate(saved)
+
+	//L'evento logico prende l'ID dell'origine arrivata per prima
+	preferred := waitForLogicalID(t, app, ingv.ID, usgs.ID)
+	if preferred.Secondary || len(preferred.Origins) != 3 {
+		t.Fatalf("origine preferita: %+v", preferred)
+	}
+	for _, id := range []string{usgs.ID, emsc.ID} {
+		if ev := waitForLogicalID(t, app, id, usgs.ID); !ev.Secondary {
+			t.Fatalf("l'origine %s dovrebbe essere secondaria", id)
+		}
+	}
+
+	//Un'altra agenzia che arriva dopo si aggiunge senza cambiare l'ID
+	gfz := testEvent("gfz:2024pabc", 4.1, time.Hour)
+	gfz.Source = "gfz"
+	if rec := doRequest(t, app, http.MethodPost, "/api/ingest", gfz); rec.Code != http.StatusOK {
+		t.Fatalf("ingest %s: status %d", gfz.ID, rec.Code)
+	}
+	waitForLogicalID(t, app, gfz.ID, usgs.ID)
+	if ev := waitForLogicalID(t, app, ingv.ID, usgs.ID); len(ev.Origins) != 4 {
+		t.Fatalf("attese 4 origini, trovate %+v", ev.Origins)
+	}
+}
+
+func TestEventsDefaultPagination(t *testing.T) {
+	app := newTestApp(t)
+	app.MaxPageSize = 2
+	var events []models.Earthquake
+	for i, id := range []string{"us1000hhh1", "us1000hhh2", "us1000hhh3"} {
+		events = append(events, testEvent(id, 3, time.Duration(i+1)*time.Hour))
+	}
+	if _, errs := app.Store.UpsertMany(context.Background(), events); errs[0] != nil {
+		t.Fatal(errs)
+	}
+
+	//Senza limit la risposta è una pagina di MaxPageSize eventi con il link alla successiva
+	rec := doRequest(t, app, http.MethodGet, "/api/events", nil)
+	page := decodeEvents(t, rec)
+	link := rec.Header().Get("Link")
+	if len(page) != 2 || page[0].ID != "us1000hhh1" || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Fatalf("prima pagina %+v, Link %q", page, link)
+	}
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+	rec = doRequest(t, app, http.MethodGet, next, nil)
+	page = decodeEvents(t, rec)
+	if len(page) != 1 || page[0].ID != "us1000hhh3" || rec.Header().Get("Link") != "" {
+		t.Fatalf("ultima pagina %+v, Link %q", page, rec.Header().Get("Link"))
+	}
+}
+
+func TestEventsSortParameter(t *testing.T) {
+	app := newTestApp(t)
+	var events []models.Earthquake
+	for i, mag := range []float64{2.1, 4.5, 3.0, 4.5, 1.2} {
+		events = append(events, testEvent(fmt.Sprintf("us1000s%03d", i), mag, time.Duration(i+1)*time.Hour))
+	}
+	if _, errs := app.Store.UpsertMany(context.Background(), events); errs[0] != nil {
+		t.Fatal(errs)
+	}
+
+	//Seguendo i link si ottiene tutto il catalogo nell'ordine richiesto (a parità di magnitudo decide l'ID)
+	for sort, want := range map[string][]string{
+		"time":          {"us1000s000", "us1000s001", "us1000s002", "us1000s003", "us1000s004"},
+		"time-asc":      {"us1000s004", "us1000s003", "us1000s002", "us1000s001", "us1000s000"},
+		"magnitude":     {"us1000s003", "us1000s001", "us1000s002", "us1000s000", "us1000s004"},
+		"magnitude-asc": {"us1000s004", "us1000s000", "us1000s002", "us1000s001", "us1000s003"},
+	} {
+		var got []string
+		next := "/api/events?limit=2&sort=" + sort
+		for next != "" {
+			rec := doRequest(t, app, http.MethodGet, next, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("sort=%s: status %d\n%s", sort, rec.Code, rec.Body.String())
+			}
+			for _, ev := range decodeEvents(t, rec) {
+				got = append(got, ev.ID)
+			}
+			next = strings.TrimSuffix(strings.TrimPrefix(rec.Header().Get("Link"), "<"), `>; rel="next"`)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("sort=%s: %v, atteso %v", sort, got, want)
+		}
+	}
+
+	if rec := doRequest(t, app, http.MethodGet, "/api/events?sort=distance", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("sort non valido: status %d", rec.Code)
+	}
+	//Il cursore di un ordinamento non vale per un altro
+	rec := doRequest(t, app, http.MethodGet, "/api/events?limit=2&sort=magnitude", nil)
+	next := strings.TrimSuffix(strings.TrimPrefix(rec.Header().Get("Link"), "<"), `>; rel="next"`)
+	if rec := doRequest(t, app, http.MethodGet, strings.Replace(next, "sort=magnitude", "sort=time", 1), nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("cursore con un altro ordinamento: status %d", rec.Code)
+	}
+}
+
+// Il cursore deve funzionare con tutti gli ordinamenti e con tutti gli store:
+// scorrendo a pagine si ottiene lo stesso elenco della query completa
+func TestCursorWithEverySortOrder(t *testing.T) {
+	bolt, err := NewBoltStore(t.TempDir() + "/events.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close(context.Background()) })
+	stores := map[string]EventStore{"memory": NewMemoryStore(), "bolt": bolt}
+
+	//Magnitudo e tempi ripetuti: a parità decide l'ID
+	var events []models.Earthquake
+	for i := 0; i < 9; i++ {
+		ev := testEvent(fmt.Sprintf("us1000p%03d", i), float64(2+i%3), 0)
+		ev.Time = time.Date(2024, 8, 2, 0, 0, 0, 0, time.UTC).Add(-time.Duration(i/2) * time.Hour).UnixMilli()
+		events = append(events, ev)
+	}
+
+	ctx := context.Background()
+	for name, store := range stores {
+		if _, errs := store.UpsertMany(ctx, events); errs[0] != nil {
+			t.Fatal(errs)
+		}
+		for _, order := range []models.SortOrder{models.SortTimeDesc, models.SortTimeAsc, models.SortMagnitudeDesc, models.SortMagnitudeAsc} {
+			all, err := store.Query(ctx, models.EventFilter{Sort: order}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paged []models.Earthquake
+			filter := models.EventFilter{Sort: order}
+			for {
+				page, err := store.Query(ctx, filter, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				paged = append(paged, page...)
+				last := page[len(page)-1]
+				filter.After = &models.EventCursor{Time: last.Time, Magnitude: last.Magnitude, ID: last.ID}
+			}
+			if len(paged) != len(all) {
+				t.Fatalf("%s, ordinamento %d: %d eventi a pagine, %d in totale", name, order, len(paged), len(all))
+			}
+			for i := range all {
+				if paged[i].ID != all[i].ID {
+					t.Fatalf("%s, ordinamento %d: posizione %d %s, atteso %s", name, order, i, paged[i].ID, all[i].ID)
+				}
+			}
+		}
+	}
+}
+
+func TestFDSNEventIDReturnsPreferredOrigin(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+
+	usgs := testEvent("us1000hhhh", 4.1, time.Hour)
+	ingv := testEvent("ingv:3736", 4.0, time.Hour)
+	ingv.Source = "ingv"
+	old := testEvent("us1000iiii", 3.0, 72*time.Hour)
+	if _, errs := app.Store.UpsertMany(ctx, []models.Earthquake{usgs, ingv, old}); errs[0] != nil || errs[1] != nil || errs[2] != nil {
+		t.Fatal(errs)
+	}
+	err := app.Store.Associate(ctx, []models.EventGroup{{
+		LogicalID: usgs.ID,
+		Preferred: ingv.ID,
+		Members:   []string{usgs.ID, ingv.ID},
+		Origins:   []models.OriginRef{models.RefOf(ingv), models.RefOf(usgs)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Store.Archive(ctx, []string{old.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	//L'ID di un'origine secondaria restituisce l'origine preferita del suo evento logico
+	rec := doRequest(t, app, http.MethodGet, "/fdsnws/event/1/query?format=text&eventid="+usgs.ID, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), ingv.ID) || strings.Contains(rec.Body.String(), usgs.ID) {
+		t.Fatalf("eventid secondario: status %d\n%s", rec.Code, rec.Body.String())
+	}
+	//Gli eventi archiviati e quelli fuori dagli altri filtri non vengono restituiti
+	for _, query := range []string{"eventid=" + old.ID, "eventid=" + ingv.ID + "&minmagnitude=5"} {
+		if rec := doRequest(t, app, http.MethodGet, "/fdsnws/event/1/query?"+query, nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: status %d, atteso 204\n%s", query, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestFDSNRadialQueryTooManyEvents(t *testing.T) {
+	app := newTestApp(t)
+	app.FDSNMaxEvents = 2
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := app.Store.Upsert(ctx, testEvent(fmt.Sprintf("us1000j%03d", i), 3, time.Duration(i+1)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Il cerchio contiene più di FDSNMaxEvents eventi: 413 anche con limit entro il massimo
+	rec := doRequest(t, app, http.MethodGet, "/fdsnws/event/1/query?latitude=43.6&longitude=13.5&maxradius=1&limit=1", nil)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, atteso 413\n%s", rec.Code, rec.Body.String())
+	}
+	//Con un cerchio che ne contiene meno la richiesta va a buon fine
+	rec = doRequest(t, app, http.MethodGet, "/fdsnws/event/1/query?format=text&latitude=43.6&longitude=13.5&maxradius=1&minmagnitude=3&endtime="+
+		time.Now().Add(-90*time.Minute).UTC().Format("2006-01-02T15:04:05"), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, atteso 200\n%s", rec.Code, rec.Body.String())
+	}
+}
+
+// Crea un MongoStore su un database temporaneo, cancellato alla fine del test.
+// Serve un MongoDB: il test viene saltato se MONGO_TEST_URI non è impostata.
+func newTestMongoStore(t *testing.T) (*MongoStore, *mongo.Database) {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI non impostata")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("earthquake_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return &MongoStore{
+		collection: db.Collection("events"),
+		history:    db.Collection("events_history"),
+		archive:    db.Collection("events_archive"),
+		quarantine: db.Collection("events_quarantine"),
+	}, db
+}
+
+func TestMongoUpsertRetriesAfterCatalogWriteFails(t *testing.T) {
+	store, db := newTestMongoStore(t)
+	ctx := context.Background()
+
+	//Un validatore che rifiuta ogni documento fa fallire il passo 3 (catalogo)
+	//dopo che il passo 2 ha già salvato la revisione nello storico
+	err := db.RunCommand(ctx, bson.D{{Key: "create", Value: "events"}, {Key: "validator", Value: bson.M{"_id": bson.M{"$exists": false}}}}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := testEvent("us1000kkkk", 3.2, time.Hour)
+	if _, err := store.Upsert(ctx, ev); err == nil {
+		t.Fatal("il passo 3 doveva fallire")
+	}
+
+	//Il retry ricalcola la stessa revisione: quella già nello storico non è un errore
+	err = db.RunCommand(ctx, bson.D{{Key: "collMod", Value: "events"}, {Key: "validator", Value: bson.M{}}}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.Upsert(ctx, ev)
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if result.Outcome != models.OutcomeCreated || result.Revision != 1 {
+		t.Fatalf("retry: %+v", result)
+	}
+
+	//E l'evento si può ancora aggiornare
+	ev.Magnitude = 3.4
+	if result, err = store.Upsert(ctx, ev); err != nil || result.Revision != 2 {
+		t.Fatalf("aggiornamento: %+v, %v", result, err)
+	}
+	revisions, err := store.History(ctx, ev.ID)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("storico: %+v, %v", revisions, err)
+	}
+}
+
+func TestSameRevision(t *testing.T) {
+	ev := testEvent("us1000kkkk", 3.2, time.Hour)
+	saved := models.EventRevision{EventID: ev.ID, Revision: 1, IngestedAt: 1000, Event: ev}
+	retry := saved
+	retry.IngestedAt = 2000
+	if !sameRevision(saved, retry) {
+		t.Fatal("una revisione ricalcolata più tardi è la stessa")
+	}
+	changed := retry
+	changed.Event.Magnitude = 3.4
+	if sameRevision(saved, changed) {
+		t.Fatal("revisioni con contenuto diverso")
+	}
+	next := retry
+	next.Revision = 2
+	if sameRevision(saved, next) {
+		t.Fatal("revisioni con numero diverso")
+	}
+}
+
+// Un evento archiviato che arriva di nuovo riprende la numerazione dal suo storico,
+// allo stesso modo in tutti gli store
+func TestReingestAfterArchiveContinuesRevisions(t *testing.T) {
+	bolt, err := NewBoltStore(t.TempDir() + "/events.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close(context.Background()) })
+	stores := map[string]EventStore{"memory": NewMemoryStore(), "bolt": bolt}
+	if os.Getenv("MONGO_TEST_URI") != "" {
+		stores["mongo"], _ = newTestMongoStore(t)
+	}
+
+	ctx := context.Background()
+	for name, store := range stores {
+		ev := testEvent("us1000llll", 3.2, 72*time.Hour)
+		for _, mag := range []float64{3.2, 3.4} {
+			ev.Magnitude = mag
+			if _, err := store.Upsert(ctx, ev); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if n, err := store.Archive(ctx, []string{ev.ID}); err != nil || n != 1 {
+			t.Fatalf("%s: archiviati %d eventi, %v", name, n, err)
+		}
+
+		result, err := store.Upsert(ctx, ev)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if result.Outcome != models.OutcomeCreated || result.Revision != 3 {
+			t.Fatalf("%s: dopo l'archiviazione %+v, attesa la revisione 3", name, result)
+		}
+		ev.Magnitude = 3.5
+		if result, err = store.Upsert(ctx, ev); err != nil || result.Revision != 4 {
+			t.Fatalf("%s: aggiornamento %+v, %v", name, result, err)
+		}
+
+		revisions, err := store.History(ctx, ev.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != 4 {
+			t.Fatalf("%s: storico %+v, attese 4 revisioni", name, revisions)
+		}
+		for i, r := range revisions {
+			if r.Revision != i+1 {
+				t.Fatalf("%s: posizione %d revisione %d", name, i, r.Revision)
+			}
+		}
+	}
+}
+
+func TestNearbyEventsParameters(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	recent := testEvent("us1000mmmm", 3.1, time.Hour)
+	old := testEvent("us1000nnnn", 3.3, 72*time.Hour)
+	if _, errs := app.Store.UpsertMany(ctx, []models.Earthquake{recent, old}); errs[0] != nil || errs[1] != nil {
+		t.Fatal(errs)
+	}
+
+	//starttime in ISO 8601, come in /api/events
+	start := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339)
+	rec := doRequest(t, app, http.MethodGet, "/api/events/near?lat=43.6&lon=13.5&radius_km=10&starttime="+start, nil)
+	var nearby []models.NearbyEvent
+	if err := json.Unmarshal(rec.Body.Bytes(), &nearby); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %v\n%s", rec.Code, err, rec.Body.String())
+	}
+	if len(nearby) != 1 || nearby[0].ID != recent.ID {
+		t.Fatalf("attesa la sola %s, trovati %+v", recent.ID, nearby)
+	}
+
+	for _, query := range []string{
+		"lat=43.6&lon=13.5&radius_km=0",
+		"lat=43.6&lon=13.5&radius_km=-5",
+		"lat=43.6&lon=13.5&radius_km=10&starttime=ieri",
+		"lat=43.6&lon=13.5&radius_km=10&starttime=2024-08-02&endtime=2024-08-01",
+	} {
+		if rec := doRequest(t, app, http.MethodGet, "/api/events/near?"+query, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d, atteso 400", query, rec.Code)
+		}
+	}
+}
+
+func TestSuspectFeedEventsQuarantinedByDefault(t *testing.T) {
+	t.Setenv("INGEST_SUSPECT_POLICY", "")
+	app := newTestApp(t)
+	app.SuspectPolicy = suspectPolicyFromEnv()
+	ctx := context.Background()
+
+	//Un evento del feed con mag null arriva con magnitudo 0: sospetto, non da scartare
+	micro := testEvent("us1000oooo", 0, time.Hour)
+	if err := app.enqueueEvents(ctx, "all_hour", []models.Earthquake{micro}); err != nil {
+		t.Fatal(err)
+	}
+	quarantined, err := app.Store.ListQuarantine(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || quarantined[0].Event.ID != micro.ID || quarantined[0].Source != "feed:all_hour" {
+		t.Fatalf("quarantena: %+v", quarantined)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"backend-go/models"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore è un'implementazione di EventStore che tiene tutti i dati in RAM.
+// Non ha bisogno di MongoDB, quindi ci permette di avviare tutta l'API Gin
+// in locale o in CI. I dati ovviamente si perdono al riavvio.
+type MemoryStore struct {
+	//Usiamo un RWMutex perché le letture (Query) sono molto più frequenti
+	//delle scritture (Upsert), e più letture possono avvenire in parallelo
+	mu      sync.RWMutex
+	events  map[string]models.Earthquake
+	history map[string][]models.EventRevision // Revisioni per ID, in ordine
+	archive map[string]models.Earthquake      // Eventi spostati dalla politica di conservazione
+	//Eventi sospetti in attesa di revisione
+	quarantine map[string]models.QuarantinedEvent
+}
+
+// Costruttore del MemoryStore, inizializza le mappe interne
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		events:     make(map[string]models.Earthquake),
+		history:    make(map[string][]models.EventRevision),
+		archive:    make(map[string]models.Earthquake),
+		quarantine: make(map[string]models.QuarantinedEvent),
+	}
+}
+
+// Inserisce o aggiorna l'evento con lo stesso ID, salvando la nuova revisione nello storico
+func (m *MemoryStore) Upsert(ctx context.Context, event models.Earthquake) (models.UpsertResult, error) {
+	results, errs := m.UpsertMany(ctx, []models.Earthquake{event})
+	return results[0], errs[0]
+}
+
+// Versione a blocchi di Upsert: prendiamo il lock una volta sola per tutto il blocco
+func (m *MemoryStore) UpsertMany(ctx context.Context, events []models.Earthquake) ([]models.UpsertResult, []error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	results := make([]models.UpsertResult, len(events))
+	for i, ev := range events {
+		var current *models.Earthquake
+		if cur, ok := m.events[ev.ID]; ok {
+			current = &cur
+		}
+		next, revisions, result := nextRevision(current, lastRevision(m.history[ev.ID]), ev, now)
+		results[i] = result
+		if len(revisions) == 0 {
+			continue
+		}
+		m.history[ev.ID] = append(m.history[ev.ID], revisions...)
+		m.events[ev.ID] = next
+	}
+	return results, make([]error, len(events))
+}
+
+// Restituisce gli eventi che rispettano il filtro, nell'ordine richiesto
+// (di default dal più nuovo al più vecchio).
+// Con filter.AsOf il catalogo viene ricostruito dallo storico delle revisioni.
+func (m *MemoryStore) Query(ctx context.Context, filter models.EventFilter, limit int64) ([]models.Earthquake, error) {
+	m.mu.RLock()
+	candidates := make([]models.Earthquake, 0, len(m.events))
+	if filter.AsOf != nil {
+		for _, revisions := range m.history {
+			if ev, ok := revisionAsOf(revisions, *filter.AsOf); ok {
+				candidates = append(candidates, ev)
+			}
+		}
+	} else {
+		source := m.events
+		if filter.Archived {
+			source = m.archive
+		}
+		for _, ev := range source {
+			candidates = append(candidates, ev)
+		}
+	}
+	m.mu.RUnlock()
+
+	//Controlliamo il contesto, così se il client annulla la richiesta ci fermiamo
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	//Come nel MongoStore, restituiamo una slice vuota e mai nil
+	return selectEvents(candidates, filter, limit), nil
+}
+
+// Cerca un evento per ID: prima nel catalogo, poi nell'archivio
+func (m *MemoryStore) Get(ctx context.Context, id string) (models.Earthquake, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if ev, ok := m.events[id]; ok {
+		return ev, nil
+	}
+	if ev, ok := m.archive[id]; ok {
+		return ev, nil
+	}
+	return models.Earthquake{}, ErrNotFound
+}
+
+// Restituisce tutte le revisioni di un evento, dalla più vecchia alla più recente
+func (m *MemoryStore) History(ctx context.Context, id string) ([]models.EventRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]models.EventRevision{}, m.history[id]...), nil
+}
+
+// Passa gli eventi uno alla volta alla funzione fn.
+// I dati sono già in RAM, quindi ci basta scorrere il risultato di Query:
+// lavorando su una copia non teniamo il lock mentre il client legge.
+func (m *MemoryStore) Stream(ctx context.Context, filter models.EventFilter, limit int64, fn func(models.Earthquake) error) error {
+	events, err := m.Query(ctx, filter, limit)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cerca gli eventi entro radiusKm dal punto (lat, lon), dal più vicino al più lontano
+func (m *MemoryStore) Near(ctx context.Context, lat, lon, radiusKm float64, filter models.EventFilter, limit int64) ([]models.NearbyEvent, error) {
+	return nearByScan(ctx, m.Stream, lat, lon, radiusKm, filter, limit)
+}
+
+// Aggiorna i campi dell'associazione sulle origini di ogni gruppo
+func (m *MemoryStore) Associate(ctx context.Context, groups []models.EventGroup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range groups {
+		for _, id := range g.Members {
+			if ev, ok := m.events[id]; ok {
+				m.events[id] = g.Apply(ev)
+			}
+		}
+	}
+	return nil
+}
+
+// Sposta gli eventi indicati nell'archivio, lo storico resta com'è
+func (m *MemoryStore) Archive(ctx context.Context, ids []string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	var moved int64
+	for _, id := range ids {
+		ev, ok := m.events[id]
+		if !ok {
+			continue
+		}
+		ev.ArchivedAt = now
+		m.archive[id] = ev
+		delete(m.events, id)
+		moved++
+	}
+	return moved, nil
+}
+
+// Cancella definitivamente gli eventi indicati, insieme al loro storico
+func (m *MemoryStore) Delete(ctx context.Context, ids []string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for _, id := range ids {
+		if _, ok := m.events[id]; ok {
+			delete(m.events, id)
+			deleted++
+		}
+		delete(m.history, id)
+	}
+	return deleted, nil
+}
+
+// Mette un evento in quarantena, sostituendo quello con lo stesso ID
+func (m *MemoryStore) Quarantine(ctx context.Context, q models.QuarantinedEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quarantine[q.Event.ID] = q
+	return nil
+}
+
+// Elenca gli eventi in quarantena, dal più recente
+func (m *MemoryStore) ListQuarantine(ctx context.Context, limit int64) ([]models.QuarantinedEvent, error) {
+	m.mu.RLock()
+	list := make([]models.QuarantinedEvent, 0, len(m.quarantine))
+	for _, q := range m.quarantine {
+		list = append(list, q)
+	}
+	m.mu.RUnlock()
+	return sortQuarantine(list, limit), nil
+}
+
+// Toglie un evento dalla quarantena e lo restituisce (ok false se non c'era)
+func (m *MemoryStore) TakeQuarantined(ctx context.Context, id string) (models.QuarantinedEvent, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.quarantine[id]
+	delete(m.quarantine, id)
+	return q, ok, nil
+}
+
+// Non c'è niente da chiudere: i dati vivono in RAM
+func (m *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// Restituisce tutto il contenuto dello store senza limiti
+func (m *MemoryStore) GetAll(ctx context.Context) ([]models.Earthquake, error) {
+	return m.Query(ctx, models.EventFilter{}, 0)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"backend-go/migrations"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Si collega a MONGO_URI e restituisce il database earthquake_db
+func connectMongo() (*mongo.Database, error) {
+	//Configurazione del database
+	mongoURI := envString("MONGO_URI", "mongodb://localhost:27017")
+
+	//Usiamo un context con timeout per evitare che l'applicazione si blocchi
+	//all'infinito in fase di avvio se il DB non risponde. Invece che rimanere
+	//bloccata in attesa del DB, dopo 10 secondi fallisce.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	//Il defer qui mi permette di liberare le risorse quando la funzione termina
+	defer cancel()
+
+	//Connesione al DB
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Connesso a MongoDB")
+	return client.Database("earthquake_db"), nil
+}
+
+// Comando "migrate": applica le migrazioni ed esce senza avviare il server.
+// Con "migrate status" mostra solo quelle applicate e quelle mancanti.
+// Utile per aggiornare lo schema prima del deploy, con MIGRATE_ON_START=false.
+func runMigrateCommand(args []string) error {
+	db, err := connectMongo()
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("MIGRATE_TIMEOUT", 10*time.Minute))
+	defer cancel()
+
+	if len(args) > 0 && args[0] == "status" {
+		applied, pending, err := migrations.Status(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, a := range applied {
+			fmt.Printf("%4d  applicata %s  %s\n", a.Version, a.AppliedAt.Format(time.RFC3339), a.Description)
+		}
+		for _, m := range pending {
+			fmt.Printf("%4d  da applicare          %s\n", m.Version, m.Description)
+		}
+		return nil
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("argomento non valido per migrate: %q (ammesso: status)", args[0])
+	}
+
+	applied, err := migrations.Run(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		log.Println("Schema già aggiornato, nessuna migrazione da applicare")
+	} else {
+		log.Printf("Migrazioni applicate: %v", applied)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package migrations
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// All contiene tutte le migrazioni, in ordine di versione.
+// Una migrazione già rilasciata non va mai modificata: se serve cambiare
+// qualcosa si aggiunge una nuova versione in fondo alla lista.
+var All = []Migration{
+	{
+		Version:     1,
+		Description: "indici di events per ordinamento per tempo e filtro per magnitudo",
+		Up:          createEventIndexes,
+	},
+	{
+		Version:     2,
+		Description: "campo location GeoJSON e indice 2dsphere",
+		Up:          backfillLocation,
+	},
+	{
+		Version:     3,
+		Description: "indici di events_history",
+		Up:          createHistoryIndexes,
+	},
+	{
+		Version:     4,
+		Description: "revisione 1 nello storico per gli eventi salvati prima delle revisioni",
+		Up:          backfillLegacyRevisions,
+	},
+	{
+		Version:     5,
+		Description: "indici di events_archive",
+		Up:          createArchiveIndexes,
+	},
+	{
+		Version:     6,
+		Description: "indice di events_quarantine",
+		Up:          createQuarantineIndexes,
+	},
+	{
+		Version:     7,
+		Description: "indice di events per l'associazione tra agenzie",
+		Up:          createAssociationIndexes,
+	},
+}
+
+// Query mostra di default gli eventi dal più recente, con _id come secondo criterio;
+// il filtro per magnitudo viene quasi sempre usato insieme all'ordinamento per tempo.
+// L'indice su is_simulated serve alla pulizia degli eventi simulati.
+func createEventIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "magnitude", Value: -1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "is_simulated", Value: 1}}},
+	})
+	return err
+}
+
+// Completa il campo location sui documenti salvati prima che esistesse,
+// ricavandolo dalle coordinate (solo se sono valide, altrimenti l'indice fallirebbe).
+// Senza l'indice 2dsphere $geoNear non funziona.
+func backfillLocation(ctx context.Context, db *mongo.Database) error {
+	events := db.Collection("events")
+	_, err := events.UpdateMany(ctx,
+		bson.M{
+			"location":      bson.M{"$exists": false},
+			"coordinates.0": bson.M{"$gte": -180, "$lte": 180},
+			"coordinates.1": bson.M{"$gte": -90, "$lte": 90},
+		},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"location": bson.M{
+				"type": "Point",
+				"coordinates": bson.A{
+					bson.M{"$arrayElemAt": bson.A{"$coordinates", 0}},
+					bson.M{"$arrayElemAt": bson.A{"$coordinates", 1}},
+				},
+			},
+		}}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = events.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "location", Value: "2dsphere"}},
+	})
+	return err
+}
+
+// Storico: ricerca delle revisioni di un evento e ricostruzione con as_of
+func createHistoryIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("events_history").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "event_id", Value: 1}, {Key: "revision", Value: 1}}},
+		{Keys: bson.D{{Key: "ingested_at", Value: 1}}},
+	})
+	return err
+}
+
+// Gli eventi salvati prima dello storico non hanno il campo revision.
+// Copiamo ognuno nello storico come revisione 1 (con la data di aggiornamento,
+// 0 se sconosciuta) e poi impostiamo revision a 1 sul documento,
+// così anche le query as_of e /history li vedono.
+// Tutto avviene sul server con $merge, senza portare i documenti nel backend.
+func backfillLegacyRevisions(ctx context.Context, db *mongo.Database) error {
+	events := db.Collection("events")
+	legacy := bson.M{"revision": bson.M{"$exists": false}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: legacy}},
+		{{Key: "$set", Value: bson.M{"revision": 1}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":         bson.M{"$concat": bson.A{"$_id", "#1"}},
+			"event_id":    "$_id",
+			"revision":    bson.M{"$literal": 1},
+			"ingested_at": bson.M{"$ifNull": bson.A{"$updated_at", 0}},
+			"event":       "$$ROOT",
+		}}},
+		//Se la revisione esiste già (migrazione interrotta a metà) la lasciamo com'è
+		{{Key: "$merge", Value: bson.M{
+			"into":           "events_history",
+			"on":             "_id",
+			"whenMatched":    "keepExisting",
+			"whenNotMatched": "insert",
+		}}},
+	}
+	cursor, err := events.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	//$merge non restituisce documenti, chiudiamo subito il cursore
+	if err := cursor.Close(ctx); err != nil {
+		return err
+	}
+
+	_, err = events.UpdateMany(ctx, legacy, bson.M{"$set": bson.M{"revision": 1}})
+	return err
+}
+
+// L'archivio si interroga come il catalogo attuale (anche per distanza),
+// quindi gli servono gli stessi indici
+func createArchiveIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("events_archive").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "magnitude", Value: -1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "location", Value: "2dsphere"}}},
+	})
+	return err
+}
+
+// La quarantena viene elencata dalla più recente
+func createQuarantineIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("events_quarantine").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "quarantined_at", Value: -1}},
+	})
+	return err
+}
+
+// L'associazione legge le origini di un evento logico per logical_id
+func createAssociationIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("events").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "logical_id", Value: 1}},
+		//Solo le origini associate hanno il campo
+		Options: options.Index().SetSparse(true),
+	})
+	return err
+}
@@ -0,0 +1,176 @@
+// Package migrations gestisce lo schema del database MongoDB: indici e
+// trasformazioni dei dati necessarie quando models.Earthquake cambia forma.
+// Ogni migrazione ha un numero di versione e viene applicata una sola volta:
+// le versioni applicate vengono registrate nella collection schema_migrations.
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration è un singolo passo dello schema.
+// Up deve essere idempotente: se il processo si interrompe a metà,
+// la migrazione viene rieseguita per intero al prossimo avvio.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// Applied è una migrazione registrata nel database
+type Applied struct {
+	Version     int       `bson:"_id" json:"version"`
+	Description string    `bson:"description" json:"description"`
+	AppliedAt   time.Time `bson:"applied_at" json:"applied_at"`
+}
+
+const (
+	versionsCollection = "schema_migrations"
+	lockCollection     = "schema_migrations_lock"
+	// Dopo questo tempo un lock viene considerato abbandonato (es. processo terminato a metà)
+	staleLockAfter = 10 * time.Minute
+)
+
+// ErrLocked indica che un'altra istanza sta già applicando le migrazioni
+var ErrLocked = errors.New("migrazioni già in corso in un'altra istanza")
+
+// Run applica in ordine tutte le migrazioni non ancora registrate
+// e restituisce le versioni applicate in questa esecuzione.
+func Run(ctx context.Context, db *mongo.Database) ([]int, error) {
+	return run(ctx, db, All)
+}
+
+func run(ctx context.Context, db *mongo.Database, migrations []Migration) ([]int, error) {
+	if err := checkVersions(migrations); err != nil {
+		return nil, err
+	}
+
+	//Più istanze del backend possono partire insieme (es. docker-compose scale):
+	//solo una alla volta applica le migrazioni
+	release, err := acquireLock(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	done, err := appliedVersions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []int
+	versions := db.Collection(versionsCollection)
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+		log.Printf("Migrazione %d: %s", m.Version, m.Description)
+		start := time.Now()
+		if err := m.Up(ctx, db); err != nil {
+			return applied, fmt.Errorf("migrazione %d (%s): %w", m.Version, m.Description, err)
+		}
+		_, err := versions.InsertOne(ctx, Applied{
+			Version:     m.Version,
+			Description: m.Description,
+			AppliedAt:   time.Now().UTC(),
+		})
+		if err != nil {
+			return applied, fmt.Errorf("registrazione migrazione %d: %w", m.Version, err)
+		}
+		log.Printf("Migrazione %d completata in %s", m.Version, time.Since(start).Round(time.Millisecond))
+		applied = append(applied, m.Version)
+	}
+	return applied, nil
+}
+
+// Status restituisce le migrazioni registrate nel database e quelle ancora da applicare
+func Status(ctx context.Context, db *mongo.Database) (applied []Applied, pending []Migration, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := db.Collection(versionsCollection).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, nil, err
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+	for _, m := range All {
+		if !done[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return applied, pending, nil
+}
+
+// Le versioni devono essere crescenti e senza duplicati
+func checkVersions(migrations []Migration) error {
+	if !sort.SliceIsSorted(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version }) {
+		return errors.New("le migrazioni devono essere in ordine di versione")
+	}
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return fmt.Errorf("versione di migrazione duplicata: %d", migrations[i].Version)
+		}
+	}
+	return nil
+}
+
+// Legge le versioni già applicate
+func appliedVersions(ctx context.Context, db *mongo.Database) (map[int]bool, error) {
+	cursor, err := db.Collection(versionsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var applied []Applied
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+	return done, nil
+}
+
+// Prende il lock inserendo un documento con _id fisso: l'inserimento fallisce
+// se il documento esiste già. Un lock più vecchio di staleLockAfter viene rimosso.
+// Restituisce la funzione per rilasciarlo.
+func acquireLock(ctx context.Context, db *mongo.Database) (func(), error) {
+	locks := db.Collection(lockCollection)
+	owner, _ := os.Hostname()
+
+	_, err := locks.DeleteOne(ctx, bson.M{"_id": "lock", "locked_at": bson.M{"$lt": time.Now().Add(-staleLockAfter)}})
+	if err != nil {
+		return nil, err
+	}
+	_, err = locks.InsertOne(ctx, bson.M{"_id": "lock", "owner": owner, "locked_at": time.Now()})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		//Usiamo un contesto nuovo: quello della chiamata potrebbe essere già scaduto
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := locks.DeleteOne(ctx, bson.M{"_id": "lock", "owner": owner}); err != nil {
+			log.Printf("Impossibile rilasciare il lock delle migrazioni: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,60 @@
+package models
+
+// Agenzia degli eventi senza Source: i feed USGS e il sensor agent
+const DefaultSource = "usgs"
+
+// Agency restituisce l'agenzia da cui arriva l'evento
+func (e Earthquake) Agency() string {
+	if e.Source != "" {
+		return e.Source
+	}
+	return DefaultSource
+}
+
+// OriginRef riassume una delle origini (soluzioni) che contribuiscono a un evento logico
+type OriginRef struct {
+	ID          string    `json:"id" bson:"id"`
+	Source      string    `json:"source" bson:"source"`
+	Place       string    `json:"place" bson:"place"`
+	Magnitude   float64   `json:"magnitude" bson:"magnitude"`
+	Time        int64     `json:"time" bson:"time"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+	Preferred   bool      `json:"preferred" bson:"preferred"`
+}
+
+// RefOf riassume un evento come origine di un evento logico
+func RefOf(e Earthquake) OriginRef {
+	return OriginRef{
+		ID:          e.ID,
+		Source:      e.Agency(),
+		Place:       e.Place,
+		Magnitude:   e.Magnitude,
+		Time:        e.Time,
+		Coordinates: e.Coordinates,
+	}
+}
+
+// EventGroup è un evento logico: le origini dello stesso terremoto arrivate
+// da agenzie diverse, una delle quali è la preferita.
+// Con LogicalID vuoto le origini in Members tornano a essere eventi a sé.
+type EventGroup struct {
+	LogicalID string
+	Preferred string      // ID dell'origine preferita
+	Members   []string    // ID di tutte le origini, compresa la preferita
+	Origins   []OriginRef // Riassunto delle origini, salvato sulla preferita
+}
+
+// Apply restituisce l'evento con i campi dell'associazione aggiornati
+// secondo il gruppo (l'evento deve essere uno dei membri)
+func (g EventGroup) Apply(e Earthquake) Earthquake {
+	e.LogicalID, e.Secondary, e.Origins = g.LogicalID, false, nil
+	if g.LogicalID == "" {
+		return e
+	}
+	if e.ID == g.Preferred {
+		e.Origins = g.Origins
+	} else {
+		e.Secondary = true
+	}
+	return e
+}
@@ -10,6 +10,67 @@ type Earthquake struct {
 	// Le coordinate GeoJSON sono solitamente [Longitudine, Latitudine, Profondità]
 	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
 	Tsunami     int       `json:"tsunami" bson:"tsunami"`
-	
-	IsSimulated bool      `json:"is_simulated" bson:"is_simulated"`
-}
\ No newline at end of file
+
+	IsSimulated bool `json:"is_simulated" bson:"is_simulated"`
+
+	// Agenzia da cui arriva l'evento quando non è USGS (es. "ingv", "emsc" per i
+	// cataloghi FDSN). Vuoto per gli eventi dei feed USGS e del sensor agent.
+	Source string `json:"source,omitempty" bson:"source,omitempty"`
+
+	// Numero di revisione e momento (timestamp Unix in ms) in cui l'abbiamo ricevuta.
+	// Li gestisce lo store: ad ogni modifica accettata la revisione aumenta di uno.
+	Revision  int   `json:"revision,omitempty" bson:"revision,omitempty"`
+	UpdatedAt int64 `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+
+	// Momento (timestamp Unix in ms) in cui la politica di conservazione
+	// ha spostato l'evento nell'archivio. Vale 0 per gli eventi del catalogo attuale.
+	ArchivedAt int64 `json:"archived_at,omitempty" bson:"archived_at,omitempty"`
+
+	// Associazione tra agenzie (vedi EventGroup): le origini dello stesso terremoto
+	// arrivate da agenzie diverse condividono LogicalID. Solo la preferita ha
+	// Secondary a false e l'elenco di tutte le origini in Origins.
+	// Li gestisce lo store, come la revisione: quelli ricevuti dai client vengono ignorati.
+	LogicalID string      `json:"logical_id,omitempty" bson:"logical_id,omitempty"`
+	Secondary bool        `json:"secondary,omitempty" bson:"secondary,omitempty"`
+	Origins   []OriginRef `json:"origins,omitempty" bson:"origins,omitempty"`
+
+	// Posizione come punto GeoJSON, ricavata dalle coordinate (vedi WithLocation).
+	// Serve solo a MongoDB per l'indice geospaziale 2dsphere, quindi non la esponiamo nell'API.
+	Location *GeoPoint `json:"-" bson:"location,omitempty"`
+}
+
+// GeoPoint è un punto GeoJSON: {"type": "Point", "coordinates": [Longitudine, Latitudine]}
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// LonLat restituisce longitudine e latitudine dell'evento.
+// ok è false se le coordinate mancano o sono fuori dai limiti validi.
+func (e Earthquake) LonLat() (lon, lat float64, ok bool) {
+	if len(e.Coordinates) < 2 {
+		return 0, 0, false
+	}
+	lon, lat = e.Coordinates[0], e.Coordinates[1]
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	return lon, lat, true
+}
+
+// WithLocation restituisce una copia dell'evento con il punto GeoJSON ricavato dalle coordinate.
+// Se le coordinate non sono valide la posizione resta vuota: un punto fuori dai limiti
+// farebbe fallire la scrittura su MongoDB a causa dell'indice 2dsphere.
+func (e Earthquake) WithLocation() Earthquake {
+	e.Location = nil
+	if lon, lat, ok := e.LonLat(); ok {
+		e.Location = &GeoPoint{Type: "Point", Coordinates: []float64{lon, lat}}
+	}
+	return e
+}
+
+// NearbyEvent è un evento restituito da una ricerca per distanza
+type NearbyEvent struct {
+	Earthquake `bson:",inline"`
+	DistanceKm float64 `json:"distance_km" bson:"distance_km"` // Distanza dal punto cercato
+}
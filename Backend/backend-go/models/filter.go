@@ -0,0 +1,177 @@
+package models
+
+import "strings"
+
+// SortOrder indica l'ordinamento dei risultati di una query
+type SortOrder int
+
+const (
+	SortTimeDesc      SortOrder = iota // Dal più recente al più vecchio (default)
+	SortTimeAsc                        // Dal più vecchio al più recente
+	SortMagnitudeDesc                  // Dal più forte al più debole
+	SortMagnitudeAsc                   // Dal più debole al più forte
+)
+
+// Less dice se l'evento a viene prima dell'evento b secondo l'ordinamento.
+// A parità di valore usiamo l'ID, così l'ordine è sempre lo stesso tra una chiamata e l'altra.
+func (o SortOrder) Less(a, b Earthquake) bool {
+	switch o {
+	case SortTimeAsc:
+		if a.Time != b.Time {
+			return a.Time < b.Time
+		}
+		return a.ID < b.ID
+	case SortMagnitudeDesc:
+		if a.Magnitude != b.Magnitude {
+			return a.Magnitude > b.Magnitude
+		}
+		return a.ID > b.ID
+	case SortMagnitudeAsc:
+		if a.Magnitude != b.Magnitude {
+			return a.Magnitude < b.Magnitude
+		}
+		return a.ID < b.ID
+	default:
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		return a.ID > b.ID
+	}
+}
+
+// BoundingBox è un rettangolo geografico in gradi.
+// Se MinLon > MaxLon il rettangolo attraversa l'antimeridiano (es. da 170 a -170).
+type BoundingBox struct {
+	MinLat float64 `json:"minlat"`
+	MaxLat float64 `json:"maxlat"`
+	MinLon float64 `json:"minlon"`
+	MaxLon float64 `json:"maxlon"`
+}
+
+// CrossesAntimeridian dice se il rettangolo passa per la longitudine 180
+func (b BoundingBox) CrossesAntimeridian() bool {
+	return b.MinLon > b.MaxLon
+}
+
+// Contains dice se il punto (lon, lat) cade nel rettangolo, estremi inclusi
+func (b BoundingBox) Contains(lon, lat float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.CrossesAntimeridian() {
+		return lon >= b.MinLon || lon <= b.MaxLon
+	}
+	return lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// EventCursor è la posizione dell'ultimo evento di una pagina (tempo, magnitudo e ID).
+// La pagina successiva parte dall'evento che lo segue nell'ordinamento della query,
+// quindi gli eventi arrivati nel frattempo non spostano le pagine. Vale per tutti
+// gli ordinamenti: per tempo conta Time, per magnitudo Magnitude, a parità l'ID.
+type EventCursor struct {
+	Time      int64
+	Magnitude float64
+	ID        string
+}
+
+// Follows dice se l'evento viene dopo il cursore nell'ordinamento indicato
+func (c EventCursor) Follows(order SortOrder, ev Earthquake) bool {
+	return order.Less(Earthquake{Time: c.Time, Magnitude: c.Magnitude, ID: c.ID}, ev)
+}
+
+// EventFilter è il filtro di dominio per EventStore.Query.
+// Ogni store lo traduce nel proprio linguaggio di query, così la logica
+// di business non deve conoscere gli operatori del database.
+// I campi puntatore a nil (o le stringhe vuote) significano "nessun vincolo".
+type EventFilter struct {
+	MinMagnitude *float64     // Magnitudo minimo (incluso)
+	MaxMagnitude *float64     // Magnitudo massimo (incluso)
+	StartTime    *int64       // Timestamp Unix in ms (incluso)
+	EndTime      *int64       // Timestamp Unix in ms (incluso)
+	MinDepth     *float64     // Profondità minima in km (inclusa)
+	MaxDepth     *float64     // Profondità massima in km (inclusa)
+	Place        string       // Testo contenuto nel luogo, senza distinzione maiuscole/minuscole
+	BBox         *BoundingBox // Rettangolo geografico
+	Polygon      *GeoPolygon  // Poligono GeoJSON
+	Tsunami      *bool        // true = solo allerta tsunami, false = solo senza allerta
+	Simulated    *bool        // true = solo simulati, false = solo reali
+	LogicalID    string       // Solo le origini di questo evento logico
+	Preferred    bool         // Solo le origini preferite: un solo risultato per evento logico
+	Sort         SortOrder
+
+	// Se impostato, solo gli eventi che seguono il cursore (paginazione),
+	// con qualsiasi ordinamento.
+	After *EventCursor
+
+	// Se impostato, la query non guarda il catalogo attuale ma lo ricostruisce
+	// com'era in quel momento (timestamp Unix in ms) usando le revisioni salvate.
+	// Non viene controllato da Matches: sono gli store a scegliere le revisioni giuste.
+	AsOf *int64
+
+	// Se true la query legge l'archivio (eventi spostati dalla politica di conservazione)
+	// invece del catalogo attuale. Con AsOf viene ignorato: lo storico contiene
+	// anche le revisioni degli eventi archiviati.
+	Archived bool
+}
+
+// Matches dice se l'evento rispetta tutte le condizioni del filtro.
+// Serve agli store che non hanno un motore di query proprio.
+func (f EventFilter) Matches(ev Earthquake) bool {
+	if f.MinMagnitude != nil && ev.Magnitude < *f.MinMagnitude {
+		return false
+	}
+	if f.MaxMagnitude != nil && ev.Magnitude > *f.MaxMagnitude {
+		return false
+	}
+	if f.StartTime != nil && ev.Time < *f.StartTime {
+		return false
+	}
+	if f.EndTime != nil && ev.Time > *f.EndTime {
+		return false
+	}
+	if f.MinDepth != nil || f.MaxDepth != nil {
+		//Senza profondità l'evento non rispetta il vincolo (come in MongoDB)
+		if len(ev.Coordinates) < 3 {
+			return false
+		}
+		depth := ev.Coordinates[2]
+		if (f.MinDepth != nil && depth < *f.MinDepth) || (f.MaxDepth != nil && depth > *f.MaxDepth) {
+			return false
+		}
+	}
+	if f.Place != "" && !strings.Contains(strings.ToLower(ev.Place), strings.ToLower(f.Place)) {
+		return false
+	}
+	if f.BBox != nil {
+		if len(ev.Coordinates) < 2 || !f.BBox.Contains(ev.Coordinates[0], ev.Coordinates[1]) {
+			return false
+		}
+	}
+	if f.Polygon != nil {
+		if len(ev.Coordinates) < 2 || !f.Polygon.Contains(ev.Coordinates[0], ev.Coordinates[1]) {
+			return false
+		}
+	}
+	if f.Tsunami != nil && (ev.Tsunami > 0) != *f.Tsunami {
+		return false
+	}
+	if f.Simulated != nil && ev.IsSimulatedEvent() != *f.Simulated {
+		return false
+	}
+	if f.After != nil && !f.After.Follows(f.Sort, ev) {
+		return false
+	}
+	if f.LogicalID != "" && ev.LogicalID != f.LogicalID {
+		return false
+	}
+	if f.Preferred && ev.Secondary {
+		return false
+	}
+	return true
+}
+
+// IsSimulatedEvent dice se l'evento è stato generato da noi:
+// controlliamo sia il flag sia il prefisso "sim_" dell'ID, come fa la pulizia del DB
+func (e Earthquake) IsSimulatedEvent() bool {
+	return e.IsSimulated || strings.HasPrefix(e.ID, "sim_")
+}
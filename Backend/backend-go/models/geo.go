@@ -0,0 +1,129 @@
+package models
+
+import (
+	"fmt"
+	"math"
+)
+
+// Raggio medio della Terra in km
+const EarthRadiusKm = 6371.0088
+
+// DistanceKm calcola la distanza sulla superficie terrestre tra due punti
+// (in gradi) con la formula dell'emisenoverso (haversine)
+func DistanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// GeoPolygon è un poligono GeoJSON: il primo anello è il contorno esterno,
+// gli eventuali anelli successivi sono "buchi". Ogni punto è [Longitudine, Latitudine].
+type GeoPolygon struct {
+	Type        string        `json:"type" bson:"type"`
+	Coordinates [][][]float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// Validate controlla che il poligono rispetti le regole GeoJSON:
+// tipo "Polygon", anelli chiusi con almeno 4 punti e coordinate nei limiti
+func (p GeoPolygon) Validate() error {
+	if p.Type != "Polygon" {
+		return fmt.Errorf("il tipo della geometria deve essere Polygon, non %q", p.Type)
+	}
+	if len(p.Coordinates) == 0 {
+		return fmt.Errorf("il poligono non ha anelli")
+	}
+	for i, ring := range p.Coordinates {
+		if len(ring) < 4 {
+			return fmt.Errorf("l'anello %d deve avere almeno 4 punti", i)
+		}
+		for _, pt := range ring {
+			if len(pt) < 2 || pt[0] < -180 || pt[0] > 180 || pt[1] < -90 || pt[1] > 90 {
+				return fmt.Errorf("l'anello %d contiene un punto non valido: %v", i, pt)
+			}
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return fmt.Errorf("l'anello %d non è chiuso (il primo e l'ultimo punto devono coincidere)", i)
+		}
+	}
+	return nil
+}
+
+// Contains dice se il punto (lon, lat) cade nel poligono: dentro il contorno
+// esterno e fuori da tutti i buchi. Usiamo il metodo del raggio (ray casting)
+// sul piano longitudine/latitudine, che va bene per poligoni non troppo grandi.
+func (p GeoPolygon) Contains(lon, lat float64) bool {
+	if len(p.Coordinates) == 0 || !ringContains(p.Coordinates[0], lon, lat) {
+		return false
+	}
+	for _, hole := range p.Coordinates[1:] {
+		if ringContains(hole, lon, lat) {
+			return false
+		}
+	}
+	return true
+}
+
+// Conta quante volte un raggio orizzontale che parte dal punto attraversa i lati dell'anello:
+// se è un numero dispari il punto è dentro
+func ringContains(ring [][]float64, lon, lat float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Polygon converte il rettangolo in un poligono GeoJSON in senso antiorario.
+// I lati GeoJSON sono archi di cerchio massimo, mentre i lati nord e sud del rettangolo
+// sono paralleli: per seguirli aggiungiamo un punto ogni grado di longitudine.
+// Se il rettangolo attraversa l'antimeridiano le longitudini oltre 180 vengono riportate
+// tra -180 e 180. ok è false se il rettangolo copre tutte le longitudini,
+// caso in cui non può essere descritto da un singolo anello.
+func (b BoundingBox) Polygon() (poly GeoPolygon, ok bool) {
+	minLon, maxLon := b.MinLon, b.MaxLon
+	if b.CrossesAntimeridian() {
+		maxLon += 360
+	}
+	if maxLon-minLon >= 360 {
+		return GeoPolygon{}, false
+	}
+	//Ai poli tutti i punti di un parallelo coincidono: ci fermiamo appena prima
+	//per non avere vertici duplicati, che MongoDB rifiuta
+	const polarLimit = 89.999999
+	minLat := math.Max(b.MinLat, -polarLimit)
+	maxLat := math.Min(b.MaxLat, polarLimit)
+
+	normalize := func(lon float64) float64 {
+		if lon > 180 {
+			return lon - 360
+		}
+		return lon
+	}
+	steps := int(math.Ceil(maxLon - minLon))
+	if steps < 1 {
+		steps = 1
+	}
+	step := (maxLon - minLon) / float64(steps)
+
+	ring := make([][]float64, 0, 2*steps+3)
+	//Lato sud, da ovest verso est
+	for i := 0; i <= steps; i++ {
+		ring = append(ring, []float64{normalize(minLon + float64(i)*step), minLat})
+	}
+	//Lato nord, da est verso ovest
+	for i := steps; i >= 0; i-- {
+		ring = append(ring, []float64{normalize(minLon + float64(i)*step), maxLat})
+	}
+	//Chiudiamo l'anello tornando al primo punto
+	ring = append(ring, []float64{ring[0][0], ring[0][1]})
+	return GeoPolygon{Type: "Polygon", Coordinates: [][][]float64{ring}}, true
+}
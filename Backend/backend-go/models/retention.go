@@ -0,0 +1,149 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionAction è cosa fare di un evento quando la sua politica di conservazione scade
+type RetentionAction string
+
+const (
+	RetentionKeep    RetentionAction = "keep"    // Conservato per sempre nel catalogo
+	RetentionArchive RetentionAction = "archive" // Spostato nell'archivio, ancora consultabile
+	RetentionDelete  RetentionAction = "delete"  // Cancellato definitivamente, storico compreso
+)
+
+// RetentionPolicy è una regola di conservazione con un nome.
+// Le condizioni (magnitudo, simulato) dicono a quali eventi si applica;
+// MaxAge dice dopo quanto tempo dall'evento scatta l'azione.
+// Le politiche si valutano in ordine: ogni evento segue la prima che lo riguarda.
+type RetentionPolicy struct {
+	Name         string          `json:"name"`
+	MinMagnitude *float64        `json:"min_magnitude,omitempty"` // Incluso
+	MaxMagnitude *float64        `json:"max_magnitude,omitempty"` // Incluso
+	Simulated    *bool           `json:"simulated,omitempty"`     // nil = sia reali che simulati
+	MaxAge       RetentionAge    `json:"max_age,omitempty"`
+	Action       RetentionAction `json:"action"`
+}
+
+// RetentionAge è una durata che in JSON si scrive come stringa.
+// Oltre al formato di Go ("36h", "90m") accetta i giorni, es. "90d".
+type RetentionAge time.Duration
+
+func (a RetentionAge) MarshalJSON() ([]byte, error) {
+	d := time.Duration(a)
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return json.Marshal(fmt.Sprintf("%dd", d/(24*time.Hour)))
+	}
+	return json.Marshal(d.String())
+}
+
+func (a *RetentionAge) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("max_age deve essere una stringa (es. \"90d\", \"24h\")")
+	}
+	d, err := ParseRetentionAge(s)
+	if err != nil {
+		return err
+	}
+	*a = RetentionAge(d)
+	return nil
+}
+
+// ParseRetentionAge legge una durata nel formato di Go o in giorni ("90d")
+func ParseRetentionAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("durata non valida: %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("durata non valida: %q", s)
+	}
+	return d, nil
+}
+
+// DefaultRetentionPolicies sono le politiche usate se non ne vengono configurate altre.
+// Le simulazioni vengono prima: generano magnitudi alti e altrimenti
+// finirebbero nella politica dei terremoti forti.
+func DefaultRetentionPolicies() []RetentionPolicy {
+	simulated := true
+	strong := 4.5
+	return []RetentionPolicy{
+		{Name: "simulazioni", Simulated: &simulated, MaxAge: RetentionAge(24 * time.Hour), Action: RetentionDelete},
+		{Name: "forti", MinMagnitude: &strong, Action: RetentionKeep},
+		{Name: "standard", MaxAge: RetentionAge(90 * 24 * time.Hour), Action: RetentionArchive},
+	}
+}
+
+// ValidateRetentionPolicies controlla nomi, azioni e durate di un elenco di politiche
+func ValidateRetentionPolicies(policies []RetentionPolicy) error {
+	if len(policies) == 0 {
+		return errors.New("nessuna politica di conservazione definita")
+	}
+	names := map[string]bool{}
+	for i, p := range policies {
+		if p.Name == "" {
+			return fmt.Errorf("politica %d: il nome è obbligatorio", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("politica %q definita due volte", p.Name)
+		}
+		names[p.Name] = true
+
+		switch p.Action {
+		case RetentionKeep:
+			if p.MaxAge != 0 {
+				return fmt.Errorf("politica %q: max_age non ha senso con l'azione keep", p.Name)
+			}
+		case RetentionArchive, RetentionDelete:
+			if p.MaxAge <= 0 {
+				return fmt.Errorf("politica %q: max_age è obbligatorio con l'azione %s", p.Name, p.Action)
+			}
+		default:
+			return fmt.Errorf("politica %q: azione non valida %q (ammesse: keep, archive, delete)", p.Name, p.Action)
+		}
+
+		if p.MinMagnitude != nil && p.MaxMagnitude != nil && *p.MinMagnitude > *p.MaxMagnitude {
+			return fmt.Errorf("politica %q: min_magnitude maggiore di max_magnitude", p.Name)
+		}
+	}
+	return nil
+}
+
+// Applies dice se la politica riguarda l'evento (senza guardare l'età)
+func (p RetentionPolicy) Applies(ev Earthquake) bool {
+	return EventFilter{
+		MinMagnitude: p.MinMagnitude,
+		MaxMagnitude: p.MaxMagnitude,
+		Simulated:    p.Simulated,
+	}.Matches(ev)
+}
+
+// Expired dice se per l'evento è arrivato il momento di applicare l'azione
+func (p RetentionPolicy) Expired(ev Earthquake, now time.Time) bool {
+	if p.Action == RetentionKeep {
+		return false
+	}
+	return ev.Time < now.Add(-time.Duration(p.MaxAge)).UnixMilli()
+}
+
+// MatchRetentionPolicy restituisce la prima politica che riguarda l'evento
+// (nil se nessuna: in quel caso l'evento viene conservato)
+func MatchRetentionPolicy(policies []RetentionPolicy, ev Earthquake) *RetentionPolicy {
+	for i := range policies {
+		if policies[i].Applies(ev) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package models
+
+import "slices"
+
+// EventRevision è una versione di un evento così come l'abbiamo ricevuta.
+// USGS rivede magnitudo e posizione per ore dopo l'evento: invece di sovrascrivere
+// teniamo tutte le versioni, numerate a partire da 1.
+type EventRevision struct {
+	EventID    string     `json:"event_id" bson:"event_id"`
+	Revision   int        `json:"revision" bson:"revision"`
+	IngestedAt int64      `json:"ingested_at" bson:"ingested_at"` // Timestamp Unix in ms
+	Event      Earthquake `json:"event" bson:"event"`
+}
+
+// UpsertOutcome dice cosa è successo salvando un evento
+type UpsertOutcome string
+
+const (
+	OutcomeCreated   UpsertOutcome = "created"   // Evento nuovo
+	OutcomeUpdated   UpsertOutcome = "updated"   // Evento già presente con qualche campo diverso: nuova revisione
+	OutcomeUnchanged UpsertOutcome = "unchanged" // Identico alla versione salvata: nessuna scrittura
+)
+
+// UpsertResult è l'esito del salvataggio di un evento
+type UpsertResult struct {
+	ID       string        `json:"id"`
+	Outcome  UpsertOutcome `json:"outcome"`
+	Changed  []string      `json:"changed,omitempty"` // Campi cambiati, solo per updated
+	Revision int           `json:"revision"`
+	Event    Earthquake    `json:"event"` // La versione salvata (quella già presente se unchanged)
+}
+
+// ChangedFields restituisce i nomi (come nel JSON) dei campi diversi tra due versioni
+// dello stesso evento. I campi gestiti dallo store (revisione, data di aggiornamento,
+// punto GeoJSON ricavato dalle coordinate) non vengono confrontati.
+func ChangedFields(old, new Earthquake) []string {
+	var changed []string
+	if old.Place != new.Place {
+		changed = append(changed, "place")
+	}
+	if old.Magnitude != new.Magnitude {
+		changed = append(changed, "magnitude")
+	}
+	if old.Time != new.Time {
+		changed = append(changed, "time")
+	}
+	if !slices.Equal(old.Coordinates, new.Coordinates) {
+		changed = append(changed, "coordinates")
+	}
+	if old.Tsunami != new.Tsunami {
+		changed = append(changed, "tsunami")
+	}
+	if old.IsSimulated != new.IsSimulated {
+		changed = append(changed, "is_simulated")
+	}
+	if old.Source != new.Source {
+		changed = append(changed, "source")
+	}
+	return changed
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Severity dice quanto è grave un problema trovato dalla validazione
+type Severity string
+
+const (
+	SeverityError   Severity = "error"   // Dato impossibile: l'evento va scartato
+	SeveritySuspect Severity = "suspect" // Dato possibile ma sospetto (es. un default "or 0.0")
+)
+
+// FieldError è un problema su un singolo campo, pensato per essere letto da un programma:
+// Code è stabile, Message è la spiegazione per le persone
+type FieldError struct {
+	Field    string   `json:"field" bson:"field"`
+	Code     string   `json:"code" bson:"code"`
+	Message  string   `json:"message" bson:"message"`
+	Severity Severity `json:"severity" bson:"severity"`
+}
+
+// ValidationErrors è l'elenco dei problemi di un evento (vuoto se è valido)
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	parts := make([]string, len(v))
+	for i, e := range v {
+		parts[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// HasErrors dice se c'è almeno un problema grave
+func (v ValidationErrors) HasErrors() bool {
+	for _, e := range v {
+		if e.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Limiti usati dalla validazione
+const (
+	MinMagnitudeValue = -2.0 // Microsismi strumentali
+	MaxMagnitudeValue = 10.0 // Il più forte mai registrato è 9.5
+	MinDepthKm        = -10.0
+	MaxDepthKm        = 800.0 // I terremoti più profondi arrivano a circa 700 km
+)
+
+// L'ID può avere un prefisso dell'agenzia (es. "ingv:123") e contenere _ . - :
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:\-]{0,127}$`)
+
+// Validate controlla che l'evento sia plausibile e restituisce i problemi trovati.
+// now serve per riconoscere i tempi nel futuro.
+func (e Earthquake) Validate(now time.Time) ValidationErrors {
+	var errs ValidationErrors
+	add := func(field, code string, severity Severity, format string, args ...any) {
+		errs = append(errs, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...), Severity: severity})
+	}
+
+	//ID
+	switch {
+	case e.ID == "":
+		add("id", "required", SeverityError, "l'id è obbligatorio")
+	case !idPattern.MatchString(e.ID):
+		add("id", "format", SeverityError, "id non valido %q: ammessi lettere, numeri e _ . - : (massimo 128 caratteri)", e.ID)
+	}
+
+	//Coordinate: [Longitudine, Latitudine, Profondità]
+	if len(e.Coordinates) != 3 {
+		add("coordinates", "length", SeverityError, "servono 3 valori [longitudine, latitudine, profondità], trovati %d", len(e.Coordinates))
+	} else {
+		lon, lat, depth := e.Coordinates[0], e.Coordinates[1], e.Coordinates[2]
+		if lon < -180 || lon > 180 {
+			add("coordinates[0]", "range", SeverityError, "longitudine %g fuori da [-180, 180]", lon)
+		}
+		if lat < -90 || lat > 90 {
+			add("coordinates[1]", "range", SeverityError, "latitudine %g fuori da [-90, 90]", lat)
+		}
+		if depth < MinDepthKm || depth > MaxDepthKm {
+			add("coordinates[2]", "range", SeverityError, "profondità %g km fuori da [%g, %g]", depth, MinDepthKm, MaxDepthKm)
+		}
+		//Il punto (0, 0) è quello che si ottiene quando le coordinate mancano
+		if lon == 0 && lat == 0 {
+			add("coordinates", "null_island", SeveritySuspect, "coordinate (0, 0): probabilmente mancanti")
+		}
+	}
+
+	//Magnitudo
+	switch {
+	case e.Magnitude < MinMagnitudeValue || e.Magnitude > MaxMagnitudeValue:
+		add("magnitude", "range", SeverityError, "magnitudo %g fuori da [%g, %g]", e.Magnitude, MinMagnitudeValue, MaxMagnitudeValue)
+	case e.Magnitude == 0:
+		add("magnitude", "zero", SeveritySuspect, "magnitudo esattamente 0: probabilmente mancante")
+	}
+
+	//Tempo (timestamp Unix in ms)
+	switch {
+	case e.Time == 0:
+		add("time", "required", SeverityError, "il tempo è obbligatorio")
+	case e.Time > now.Add(24*time.Hour).UnixMilli():
+		add("time", "future", SeverityError, "tempo %s nel futuro", time.UnixMilli(e.Time).UTC().Format(time.RFC3339))
+	case e.Time > now.Add(10*time.Minute).UnixMilli():
+		add("time", "future", SeveritySuspect, "tempo %s nel futuro (orologio della sorgente sbagliato?)", time.UnixMilli(e.Time).UTC().Format(time.RFC3339))
+	case e.Time < 0:
+		//Eventi storici prima del 1970: possibili nei cataloghi, ma non dai sensori
+		add("time", "historical", SeveritySuspect, "tempo %s precedente al 1970", time.UnixMilli(e.Time).UTC().Format(time.RFC3339))
+	}
+
+	if e.Tsunami != 0 && e.Tsunami != 1 {
+		add("tsunami", "range", SeverityError, "tsunami deve valere 0 o 1, trovato %d", e.Tsunami)
+	}
+	if strings.TrimSpace(e.Place) == "" {
+		add("place", "required", SeveritySuspect, "luogo mancante")
+	}
+	return errs
+}
+
+// QuarantinedEvent è un evento sospetto messo da parte invece di essere salvato nel catalogo
+type QuarantinedEvent struct {
+	Event         Earthquake       `json:"event" bson:"event"`
+	Problems      ValidationErrors `json:"problems" bson:"problems"`
+	Source        string           `json:"source" bson:"source"`                 // Da dove è arrivato (ingest, batch, feed ...)
+	QuarantinedAt int64            `json:"quarantined_at" bson:"quarantined_at"` // Timestamp Unix in ms
+}
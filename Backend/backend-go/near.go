@@ -0,0 +1,37 @@
+package main
+
+import (
+	"backend-go/models"
+	"context"
+	"sort"
+)
+
+// Ricerca per distanza per gli store senza indice geospaziale (memoria e bbolt).
+// Scorre gli eventi che rispettano il filtro tramite stream, calcola la distanza
+// di ognuno e tiene solo quelli entro il raggio, dal più vicino al più lontano.
+func nearByScan(ctx context.Context, stream func(context.Context, models.EventFilter, int64, func(models.Earthquake) error) error,
+	lat, lon, radiusKm float64, filter models.EventFilter, limit int64) ([]models.NearbyEvent, error) {
+
+	events := []models.NearbyEvent{}
+	err := stream(ctx, filter, 0, func(ev models.Earthquake) error {
+		evLon, evLat, ok := ev.LonLat()
+		if !ok {
+			return nil
+		}
+		if d := models.DistanceKm(lat, lon, evLat, evLon); d <= radiusKm {
+			events = append(events, models.NearbyEvent{Earthquake: ev, DistanceKm: d})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].DistanceKm < events[j].DistanceKm
+	})
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
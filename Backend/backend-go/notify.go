@@ -0,0 +1,153 @@
+package main
+
+import (
+	"backend-go/models"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//NOTIFICHE
+//I worker passano qui gli esiti delle scritture: è il punto in cui agganciare
+//chi deve reagire ai cambiamenti del catalogo (log, webhook, in futuro alert o websocket).
+//Le notifiche vengono consegnate da una goroutine a parte, così un notifier lento
+//non rallenta i worker. La goroutine fa parte del ciclo di vita dell'App:
+//allo spegnimento viene chiusa dopo i worker e aspettata finché la coda non è vuota.
+
+// Notifier riceve gli esiti delle scritture
+type Notifier interface {
+	// Eventi creati o aggiornati da un blocco di scrittura (gli invariati non vengono passati)
+	EventsChanged(changes []models.UpsertResult)
+	// Tutti gli eventi di un fetch sono stati elaborati
+	FetchCompleted(report FetchReport)
+}
+
+// Crea i notifier configurati: il log è sempre attivo,
+// il webhook solo se NOTIFY_WEBHOOK_URL è impostato
+func notifiersFromEnv() []Notifier {
+	notifiers := []Notifier{logNotifier{}}
+	if url := envString("NOTIFY_WEBHOOK_URL", ""); url != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			URL:    url,
+			Client: &http.Client{Timeout: envDuration("NOTIFY_WEBHOOK_TIMEOUT", 5*time.Second)},
+		})
+	}
+	return notifiers
+}
+
+// Una notifica in attesa di consegna: o un gruppo di cambiamenti o un fetch concluso
+type notification struct {
+	changes []models.UpsertResult
+	fetch   *FetchReport
+}
+
+// Consegna le notifiche ai notifier, in ordine, da una sola goroutine (run)
+type dispatcher struct {
+	notifiers []Notifier
+	queue     chan notification
+
+	mu     sync.Mutex // Protegge closed: dopo close non si può più scrivere in queue
+	closed bool
+}
+
+func newDispatcher(notifiers []Notifier) *dispatcher {
+	return &dispatcher{notifiers: notifiers, queue: make(chan notification, 256)}
+}
+
+// Mette in coda una notifica. Se i notifier sono troppo indietro la notifica
+// viene scartata: i dati sono comunque salvati, si perde solo l'avviso.
+// Dopo close le notifiche vengono scartate.
+func (d *dispatcher) send(n notification) {
+	if len(d.notifiers) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		log.Println("Notifiche: dispatcher chiuso, notifica scartata")
+		return
+	}
+	select {
+	case d.queue <- n:
+	default:
+		log.Println("Notifiche: coda piena, notifica scartata")
+	}
+}
+
+// Chiude la coda: run consegna le notifiche rimaste e termina
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+}
+
+// Consegna le notifiche finché la coda non viene chiusa e svuotata
+func (d *dispatcher) run() {
+	for n := range d.queue {
+		for _, notifier := range d.notifiers {
+			if n.fetch != nil {
+				notifier.FetchCompleted(*n.fetch)
+			} else {
+				notifier.EventsChanged(n.changes)
+			}
+		}
+	}
+}
+
+// Scrive nel log le revisioni degli eventi e il riassunto dei fetch
+type logNotifier struct{}
+
+func (logNotifier) EventsChanged(changes []models.UpsertResult) {
+	for _, r := range changes {
+		if r.Outcome == models.OutcomeUpdated {
+			log.Printf("Evento %s aggiornato (revisione %d): %s", r.ID, r.Revision, strings.Join(r.Changed, ", "))
+		}
+	}
+}
+
+func (logNotifier) FetchCompleted(report FetchReport) {
+	log.Printf("Fetch %d (%s): %d in coda, %d nuovi, %d aggiornati, %d invariati, %d falliti",
+		report.ID, report.Source, report.Queued, report.Created, report.Updated, report.Unchanged, report.Failed)
+}
+
+// Invia le notifiche in POST a un URL esterno, come JSON:
+// {"type": "events_changed", "changes": [...]} oppure {"type": "fetch_completed", "fetch": {...}}
+type webhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *webhookNotifier) EventsChanged(changes []models.UpsertResult) {
+	w.post(map[string]any{"type": "events_changed", "changes": changes})
+}
+
+func (w *webhookNotifier) FetchCompleted(report FetchReport) {
+	w.post(map[string]any{"type": "fetch_completed", "fetch": report})
+}
+
+// Un errore del webhook viene solo segnalato: non riproviamo
+func (w *webhookNotifier) post(payload any) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Webhook: %v", err)
+		return
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("risposta %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("Webhook %s: %v", w.URL, err)
+	}
+}
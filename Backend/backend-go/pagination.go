@@ -0,0 +1,118 @@
+package main
+
+import (
+	"backend-go/models"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+//PAGINAZIONE DI /api/events
+///api/events restituisce sempre una pagina (di limit eventi, o di MaxPageSize senza limit)
+//e, se ci sono altri eventi, l'header Link con rel="next" verso la pagina successiva.
+//Il cursore contiene tempo, magnitudo e ID dell'ultimo evento della pagina: la pagina
+//successiva parte da lì, quindi gli eventi che arrivano mentre il client scorre non
+//spostano le pagine (a differenza di un offset). Con la magnitudo il cursore funziona
+//anche con gli ordinamenti per magnitudo scelti con sort (a parità di magnitudo decide
+//l'ID), così EventFilter.After vale per qualsiasi ordinamento. sort fa parte
+//dell'impronta dei filtri: un cursore non si può riusare con un altro ordinamento.
+
+// Il cursore, prima della codifica in base64. Query è un'impronta dei filtri:
+// un cursore vale solo per la ricerca che l'ha prodotto
+type pageToken struct {
+	Time      int64   `json:"t"`
+	Magnitude float64 `json:"m"`
+	ID        string  `json:"id"`
+	Query     string  `json:"q"`
+}
+
+// Parametri che non fanno parte della ricerca, esclusi dall'impronta
+var pagingParams = map[string]bool{"cursor": true, "limit": true}
+
+// Impronta dei filtri della richiesta: i parametri ordinati, senza cursore e limite
+func queryFingerprint(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		if !pagingParams[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		for _, v := range values[k] {
+			fmt.Fprintf(h, "%s=%s&", k, v)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func encodeCursor(ev models.Earthquake, fingerprint string) string {
+	raw, _ := json.Marshal(pageToken{Time: ev.Time, Magnitude: ev.Magnitude, ID: ev.ID, Query: fingerprint})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+var errBadCursor = errors.New("cursore non valido")
+
+func decodeCursor(token, fingerprint string) (*models.EventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var t pageToken
+	if err := json.Unmarshal(raw, &t); err != nil || t.ID == "" {
+		return nil, errBadCursor
+	}
+	if t.Query != fingerprint {
+		return nil, fmt.Errorf("%w: è stato generato con filtri diversi", errBadCursor)
+	}
+	return &models.EventCursor{Time: t.Time, Magnitude: t.Magnitude, ID: t.ID}, nil
+}
+
+// Restituisce una pagina di eventi. Leggiamo un evento in più della pagina
+// per sapere se esiste la successiva, così l'ultima pagina non ha il link next.
+// Con geo la pagina è un FeatureCollection GeoJSON invece di un array.
+func (app *App) pageEvents(c *gin.Context, filter models.EventFilter, limit int64, geo bool) {
+	fingerprint := queryFingerprint(c.Request.URL.Query())
+	if token := c.Query("cursor"); token != "" {
+		after, err := decodeCursor(token, fingerprint)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.After = after
+	}
+
+	size := app.MaxPageSize
+	if limit > 0 && limit < size {
+		size = limit
+	}
+	events, err := app.Store.Query(c.Request.Context(), filter, size+1)
+	if err != nil {
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+	if int64(len(events)) > size {
+		events = events[:size]
+		next := *c.Request.URL
+		q := next.Query()
+		q.Set("cursor", encodeCursor(events[len(events)-1], fingerprint))
+		q.Set("limit", strconv.FormatInt(size, 10))
+		next.RawQuery = q.Encode()
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	if geo {
+		writeGeoJSON(c, events)
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"backend-go/fdsn"
+	"backend-go/feeds"
+	"backend-go/models"
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+//INGESTIONE NATIVA DEI FEED USGS
+//Con FEED_POLLER_ENABLED=true il backend scarica da solo i feed GeoJSON di USGS,
+//quindi continua a ricevere dati anche se il sensor agent Python è spento.
+//Con FDSN_SOURCES scarica anche i cataloghi di altre agenzie (INGV, EMSC, ...)
+//nel formato testo dei servizi FDSN event.
+
+// Crea il poller dei feed leggendo la configurazione.
+// Gli URL partono da FEED_BASE_URL e possono essere sostituiti uno per uno
+// con FEED_URL_HOUR, FEED_URL_DAY, FEED_URL_7DAYS e FEED_URL_30DAYS
+// (utile per puntare a un server locale con dei file di prova).
+// FEED_MAX_BACKOFF limita l'attesa tra un tentativo e l'altro quando il feed dà errore.
+func newPollerFromEnv(sink feeds.Sink) *feeds.Poller {
+	urls := feeds.URLsFromBase(strings.TrimSuffix(envString("FEED_BASE_URL", feeds.DefaultBaseURL), "/"))
+	for name := range urls {
+		urls[name] = envString("FEED_URL_"+strings.ToUpper(name), urls[name])
+	}
+	p := feeds.New(urls, sink)
+	p.MaxBackoff = envDuration("FEED_MAX_BACKOFF", feeds.DefaultMaxBackoff)
+	return p
+}
+
+// Avvia il download periodico del feed FEED_POLL_RANGE ogni FEED_POLL_INTERVAL,
+// fino all'arresto del server.
+// USGS aggiorna il feed orario ogni minuto; grazie alle richieste condizionali
+// un feed non cambiato costa solo una risposta 304.
+func (app *App) startFeedPoller() {
+	feed := envString("FEED_POLL_RANGE", "hour")
+	interval := envDuration("FEED_POLL_INTERVAL", time.Minute)
+	app.background(func(ctx context.Context) { app.Feeds.Run(ctx, feed, interval) })
+}
+
+// Crea il poller dei cataloghi FDSN leggendo FDSN_SOURCES
+// (es. "ingv,emsc" oppure "ingv,iris=https://service.iris.edu/fdsnws/event/1/query?format=text").
+// Restituisce nil se non ci sono sorgenti configurate.
+func newFDSNPollerFromEnv(sink fdsn.Sink) (*fdsn.Poller, error) {
+	sources, err := fdsn.ParseSources(envString("FDSN_SOURCES", ""))
+	if err != nil || len(sources) == 0 {
+		return nil, err
+	}
+	return fdsn.New(sources, envDuration("FDSN_LOOKBACK", 24*time.Hour), sink), nil
+}
+
+// Avvia l'interrogazione periodica delle sorgenti FDSN ogni FDSN_POLL_INTERVAL.
+// I servizi FDSN aggiornano i cataloghi ogni pochi minuti e non supportano
+// le richieste condizionali, quindi non conviene interrogarli troppo spesso.
+func (app *App) startFDSNPoller() {
+	interval := envDuration("FDSN_POLL_INTERVAL", 5*time.Minute)
+	app.background(func(ctx context.Context) { app.FDSN.Run(ctx, interval) })
+}
+
+// Sink del poller: valida gli eventi e mette quelli accettati nella coda dei worker.
+// A differenza di /api/ingest qui aspettiamo che si liberi spazio invece di
+// scartare: il feed mensile contiene migliaia di eventi, molti più del buffer.
+func (app *App) enqueueEvents(ctx context.Context, feed string, events []models.Earthquake) error {
+	return app.enqueueFrom(ctx, "feed:"+feed, events)
+}
+
+// Sink del poller FDSN: come per i feed USGS, con source "fdsn:<agenzia>"
+func (app *App) enqueueCatalog(ctx context.Context, source string, events []models.Earthquake) error {
+	return app.enqueueFrom(ctx, "fdsn:"+source, events)
+}
+
+func (app *App) enqueueFrom(ctx context.Context, source string, events []models.Earthquake) error {
+	fetch := app.Fetches.begin(source)
+	defer fetch.seal()
+
+	accepted := make([]models.Earthquake, 0, len(events))
+	for _, ev := range events {
+		status, problems, err := app.screenEvent(ctx, ev, source)
+		if err != nil {
+			return err
+		}
+		if status != statusAccepted {
+			log.Printf("Fetch %s: evento %s %s (%v)", source, ev.ID, status, problems)
+			continue
+		}
+		accepted = append(accepted, ev)
+	}
+
+	//Senza scadenza: enqueue aspetta finché il contesto non viene annullato
+	queued, err := app.enqueue(ctx, accepted, nil, fetch)
+	if err != nil {
+		return err
+	}
+	for _, ok := range queued {
+		if !ok {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Package quakeml legge e scrive cataloghi in formato QuakeML 1.2 (BED),
+// il formato XML standard per lo scambio di cataloghi sismici tra agenzie
+// (USGS, INGV, GFZ, EMSC lo pubblicano tutti dai loro servizi FDSN).
+//
+// Di ogni evento usiamo l'origine e la magnitudo preferite e la descrizione
+// del luogo. La profondità in QuakeML è in metri, nel nostro modello in km.
+// Il flag tsunami e gli eventi simulati non hanno un equivalente in QuakeML.
+package quakeml
+
+import (
+	"backend-go/models"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Namespace di QuakeML 1.2
+const (
+	NamespaceQuakeML = "http://quakeml.org/xmlns/quakeml/1.2"
+	NamespaceBED     = "http://quakeml.org/xmlns/bed/1.2"
+)
+
+// Event è un <event> di QuakeML, con i soli elementi che ci servono
+type Event struct {
+	XMLName              xml.Name      `xml:"event"`
+	PublicID             string        `xml:"publicID,attr"`
+	EventSource          string        `xml:"eventsource,attr,omitempty"` // catalog:eventsource di USGS (es. "us")
+	EventID              string        `xml:"eventid,attr,omitempty"`     // catalog:eventid di USGS (es. "7000abcd")
+	Descriptions         []Description `xml:"description"`
+	PreferredOriginID    string        `xml:"preferredOriginID,omitempty"`
+	PreferredMagnitudeID string        `xml:"preferredMagnitudeID,omitempty"`
+	Type                 string        `xml:"type,omitempty"`
+	CreationInfo         *CreationInfo `xml:"creationInfo,omitempty"`
+	Origins              []Origin      `xml:"origin"`
+	Magnitudes           []Magnitude   `xml:"magnitude"`
+}
+
+// Description è una descrizione testuale dell'evento (es. il nome della regione)
+type Description struct {
+	Text string `xml:"text"`
+	Type string `xml:"type,omitempty"` // earthquake name, region name, ...
+}
+
+// Origin è una localizzazione dell'evento
+type Origin struct {
+	PublicID  string        `xml:"publicID,attr"`
+	Time      TimeQuantity  `xml:"time"`
+	Latitude  RealQuantity  `xml:"latitude"`
+	Longitude RealQuantity  `xml:"longitude"`
+	Depth     *RealQuantity `xml:"depth,omitempty"` // In metri
+}
+
+// Magnitude è una stima della magnitudo
+type Magnitude struct {
+	PublicID string       `xml:"publicID,attr"`
+	Mag      RealQuantity `xml:"mag"`
+	Type     string       `xml:"type,omitempty"` // ML, Mw, mb, ...
+	OriginID string       `xml:"originID,omitempty"`
+}
+
+// CreationInfo dice chi ha prodotto un elemento, quando e in quale versione
+type CreationInfo struct {
+	AgencyID     string `xml:"agencyID,omitempty"`
+	Author       string `xml:"author,omitempty"`
+	CreationTime string `xml:"creationTime,omitempty"`
+	Version      string `xml:"version,omitempty"`
+}
+
+// RealQuantity è un valore numerico con la sua incertezza
+type RealQuantity struct {
+	Value       float64  `xml:"value"`
+	Uncertainty *float64 `xml:"uncertainty,omitempty"`
+}
+
+// TimeQuantity è un istante, come testo ISO 8601
+type TimeQuantity struct {
+	Value string `xml:"value"`
+}
+
+// EventError descrive un evento scartato perché incompleto
+type EventError struct {
+	Index int    // Posizione nel documento
+	ID    string // ID dell'evento, se ricavabile
+	Err   error
+}
+
+func (e EventError) Error() string {
+	return fmt.Sprintf("evento %d (%s): %v", e.Index, e.ID, e.Err)
+}
+
+// Parse legge un documento QuakeML e restituisce i terremoti validi.
+// Gli eventi incompleti vengono scartati e riportati in skipped, senza bloccare
+// gli altri; err è diverso da nil solo se il documento intero non è leggibile.
+func Parse(r io.Reader) (events []models.Earthquake, skipped []EventError, err error) {
+	err = Decode(r, func(index int, ev models.Earthquake, err error) error {
+		if err != nil {
+			skipped = append(skipped, EventError{Index: index, ID: ev.ID, Err: err})
+			return nil
+		}
+		events = append(events, ev)
+		return nil
+	})
+	return events, skipped, err
+}
+
+// Decode legge il documento un evento alla volta, senza caricarlo tutto in memoria,
+// e chiama fn con l'esito della conversione di ognuno (per chi deve sapere
+// l'esito di ogni evento, es. l'import a blocchi). Se fn restituisce un errore
+// la lettura si ferma.
+func Decode(r io.Reader, fn func(index int, ev models.Earthquake, err error) error) error {
+	dec := xml.NewDecoder(r)
+	foundRoot := false
+	index := 0
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("QuakeML non valido: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "quakeml", "eventParameters":
+			foundRoot = true
+		case "event":
+			var e Event
+			if err := dec.DecodeElement(&e, &start); err != nil {
+				return fmt.Errorf("QuakeML non valido (evento %d): %w", index, err)
+			}
+			ev, err := ToEarthquake(e)
+			if err := fn(index, ev, err); err != nil {
+				return err
+			}
+			index++
+		}
+	}
+	if !foundRoot {
+		return errors.New("QuakeML non valido: manca l'elemento quakeml o eventParameters")
+	}
+	return nil
+}
+
+// ToEarthquake converte un evento usando l'origine e la magnitudo preferite
+// (o le prime, se il documento non indica quali preferire).
+// Come per il GeoJSON, il luogo mancante diventa "Unknown" e la magnitudo mancante 0.
+func ToEarthquake(e Event) (models.Earthquake, error) {
+	ev := models.Earthquake{ID: EventID(e), Place: "Unknown"}
+	if ev.ID == "" {
+		return ev, errors.New("manca il publicID")
+	}
+	if e.Type == "not existing" {
+		return ev, errors.New("evento annullato dall'agenzia (type \"not existing\")")
+	}
+
+	origin := preferredOrigin(e)
+	if origin == nil {
+		return ev, errors.New("nessuna origine")
+	}
+	t, err := parseTime(origin.Time.Value)
+	if err != nil {
+		return ev, fmt.Errorf("tempo dell'origine non valido: %w", err)
+	}
+	ev.Time = t.UnixMilli()
+
+	depth := 0.0
+	if origin.Depth != nil {
+		depth = origin.Depth.Value / 1000
+	}
+	ev.Coordinates = []float64{origin.Longitude.Value, origin.Latitude.Value, depth}
+
+	if mag := preferredMagnitude(e); mag != nil {
+		ev.Magnitude = mag.Mag.Value
+	}
+	if place := placeName(e.Descriptions); place != "" {
+		ev.Place = place
+	}
+	return ev, nil
+}
+
+// EventID ricava il nostro ID dall'evento. Per USGS usiamo gli attributi
+// catalog:eventsource e catalog:eventid (es. "us" + "7000abcd"), come nel feed GeoJSON;
+// altrimenti l'ultima parte del publicID, dopo l'ultima "/" o "=" (es.
+// "smi:webservices.ingv.it/fdsnws/event/1/query?eventId=37346241" diventa "37346241").
+func EventID(e Event) string {
+	if e.EventSource != "" && e.EventID != "" {
+		return e.EventSource + e.EventID
+	}
+	id := strings.TrimSpace(e.PublicID)
+	if i := strings.LastIndexAny(id, "/="); i >= 0 {
+		id = id[i+1:]
+	}
+	return id
+}
+
+func preferredOrigin(e Event) *Origin {
+	for i := range e.Origins {
+		if e.Origins[i].PublicID == e.PreferredOriginID {
+			return &e.Origins[i]
+		}
+	}
+	if len(e.Origins) > 0 {
+		return &e.Origins[0]
+	}
+	return nil
+}
+
+func preferredMagnitude(e Event) *Magnitude {
+	for i := range e.Magnitudes {
+		if e.Magnitudes[i].PublicID == e.PreferredMagnitudeID {
+			return &e.Magnitudes[i]
+		}
+	}
+	if len(e.Magnitudes) > 0 {
+		return &e.Magnitudes[0]
+	}
+	return nil
+}
+
+// Preferiamo il nome dell'evento (es. "10 km N di Norcia"), poi quello della regione
+func placeName(descriptions []Description) string {
+	for _, kind := range []string{"earthquake name", "region name", ""} {
+		for _, d := range descriptions {
+			if text := strings.TrimSpace(d.Text); text != "" && (kind == "" || d.Type == kind) {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+// I tempi di QuakeML sono ISO 8601, con o senza fuso orario (senza si intende UTC)
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"}
+
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q non è un tempo ISO 8601", s)
+}
@@ -0,0 +1,166 @@
+package quakeml
+
+import (
+	"backend-go/models"
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Legge un documento di testdata
+func parseFile(t *testing.T, name string) ([]models.Earthquake, []EventError) {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, skipped, err := Parse(f)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return events, skipped
+}
+
+// Scrive gli eventi con Writer e rilegge il documento
+func roundTrip(t *testing.T, events []models.Earthquake) ([]models.Earthquake, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, DefaultAuthority)
+	for _, ev := range events {
+		if err := w.Write(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again, skipped, err := Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("documento scritto non valido: %v\n%s", err, buf.String())
+	}
+	if len(skipped) > 0 {
+		t.Fatalf("eventi scartati rileggendo il documento scritto: %v", skipped)
+	}
+	return again, buf.String()
+}
+
+func ms(s string) int64 {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		panic(err)
+	}
+	return t.UnixMilli()
+}
+
+func TestParseAndRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		file    string
+		want    []models.Earthquake
+		skipped []string // ID degli eventi scartati
+	}{
+		{
+			//USGS: ID da catalog:eventsource + catalog:eventid, origine e magnitudo
+			//preferite anche se non sono le prime, nome dell'evento prima della regione
+			file: "usgs.xml",
+			want: []models.Earthquake{
+				{
+					ID: "us7000n0ab", Place: "south of the Fiji Islands", Magnitude: 4.9,
+					Time: ms("2024-08-02T00:36:52.345Z"), Coordinates: []float64{-178.123, -24.567, 540.2},
+				},
+				{
+					ID: "nc75012345", Place: "8 km NW of The Geysers, CA", Magnitude: 1.6,
+					Time: ms("2024-08-02T00:55:01.230Z"), Coordinates: []float64{-122.8225, 38.8185, 2.41},
+				},
+			},
+		},
+		{
+			//INGV: ID dal publicID (eventId=...), tempi senza fuso orario,
+			//evento "not existing" scartato, profondità mancante a 0
+			file: "ingv.xml",
+			want: []models.Earthquake{
+				{
+					ID: "37346241", Place: "3 km SW Norcia (PG)", Magnitude: 3.4,
+					Time: ms("2024-08-02T01:02:03.46Z"), Coordinates: []float64{13.0612, 42.7701, 8.1},
+				},
+				{
+					ID: "37346310", Place: "Mar Tirreno Meridionale (MARE)", Magnitude: 2.1,
+					Time: ms("2024-08-02T03:44:10.12Z"), Coordinates: []float64{15.03, 39.12, 0},
+				},
+			},
+			skipped: []string{"37346300"},
+		},
+		{
+			file: "empty.xml",
+		},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			events, skipped := parseFile(t, tc.file)
+			if !reflect.DeepEqual(events, tc.want) {
+				t.Fatalf("eventi letti:\n%+v\nattesi:\n%+v", events, tc.want)
+			}
+			var skippedIDs []string
+			for _, s := range skipped {
+				skippedIDs = append(skippedIDs, s.ID)
+			}
+			if !reflect.DeepEqual(skippedIDs, tc.skipped) {
+				t.Fatalf("eventi scartati %v, attesi %v", skippedIDs, tc.skipped)
+			}
+
+			//Scritti e riletti, gli eventi devono restare identici
+			again, doc := roundTrip(t, events)
+			if !reflect.DeepEqual(again, events) {
+				t.Fatalf("dopo la riscrittura:\n%+v\nattesi:\n%+v\n%s", again, events, doc)
+			}
+		})
+	}
+}
+
+func TestWriterPublicIDAndDepth(t *testing.T) {
+	ev := models.Earthquake{
+		ID: "ingv:37346241", Place: "3 km SW Norcia (PG)", Magnitude: 3.4,
+		Time: ms("2024-08-02T01:02:03.46Z"), Coordinates: []float64{13.0612, 42.7701, 8.1},
+		Source: "ingv", Revision: 2,
+	}
+	e := FromEarthquake(ev, DefaultAuthority)
+	if want := DefaultAuthority + "/event/ingv:37346241"; e.PublicID != want {
+		t.Fatalf("publicID %q, atteso %q", e.PublicID, want)
+	}
+	if id := EventID(e); id != ev.ID {
+		t.Fatalf("EventID(publicID) = %q, atteso %q", id, ev.ID)
+	}
+	//km nel modello, metri in QuakeML, senza errori di arrotondamento
+	if d := e.Origins[0].Depth; d == nil || d.Value != 8100 {
+		t.Fatalf("profondità %+v, attesi 8100 m", d)
+	}
+	if e.CreationInfo == nil || e.CreationInfo.AgencyID != "INGV" || e.CreationInfo.Version != "2" {
+		t.Fatalf("creationInfo %+v", e.CreationInfo)
+	}
+
+	again, doc := roundTrip(t, []models.Earthquake{ev})
+	if !strings.Contains(doc, "<depth><value>8100</value></depth>") {
+		t.Fatalf("profondità non scritta in metri:\n%s", doc)
+	}
+	if len(again) != 1 || again[0].ID != ev.ID || again[0].Coordinates[2] != 8.1 {
+		t.Fatalf("evento riletto: %+v", again)
+	}
+}
+
+func TestEmptyDocument(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriter(&buf, DefaultAuthority).Close(); err != nil {
+		t.Fatal(err)
+	}
+	events, skipped, err := Parse(&buf)
+	if err != nil || len(events) != 0 || len(skipped) != 0 {
+		t.Fatalf("documento vuoto: %v, %v, %v", events, skipped, err)
+	}
+
+	//Senza quakeml né eventParameters non è un catalogo
+	if _, _, err := Parse(strings.NewReader(`<?xml version="1.0"?><catalog/>`)); err == nil {
+		t.Fatal("atteso un errore per un documento che non è QuakeML")
+	}
+}
@@ -0,0 +1,111 @@
+package quakeml
+
+import (
+	"backend-go/models"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAuthority è il prefisso dei publicID dei documenti che esportiamo
+const DefaultAuthority = "smi:earthquake-monitor"
+
+// Writer scrive un documento QuakeML un evento alla volta,
+// così un export grande non deve stare tutto in memoria
+type Writer struct {
+	w         io.Writer
+	enc       *xml.Encoder
+	authority string
+	started   bool
+}
+
+// NewWriter crea un Writer; authority è il prefisso dei publicID (es. DefaultAuthority).
+// Gli ID generati hanno la forma <authority>/event/<id>: rileggendo il documento
+// con Parse si ottiene di nuovo lo stesso ID.
+func NewWriter(w io.Writer, authority string) *Writer {
+	return &Writer{w: w, enc: xml.NewEncoder(w), authority: authority}
+}
+
+// Scrive l'intestazione e l'apertura di eventParameters
+func (w *Writer) start() error {
+	w.started = true
+	_, err := fmt.Fprintf(w.w, "%s<q:quakeml xmlns:q=%q xmlns=%q>\n<eventParameters publicID=\"%s/catalog/%d\">\n",
+		xml.Header, NamespaceQuakeML, NamespaceBED, w.authority, time.Now().Unix())
+	return err
+}
+
+// Write aggiunge un evento al documento
+func (w *Writer) Write(ev models.Earthquake) error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if err := w.enc.Encode(FromEarthquake(ev, w.authority)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, "\n")
+	return err
+}
+
+// Close chiude il documento (anche se non contiene eventi). Non chiude w.
+func (w *Writer) Close() error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w.w, "</eventParameters>\n</q:quakeml>\n")
+	return err
+}
+
+// FromEarthquake converte un evento nel suo <event> QuakeML, con una sola
+// origine e una sola magnitudo (entrambe preferite). La revisione diventa
+// la versione di creationInfo, l'agenzia d'origine (Source) il suo agencyID.
+func FromEarthquake(ev models.Earthquake, authority string) Event {
+	base := authority + "/event/" + ev.ID
+	e := Event{
+		PublicID:             base,
+		Descriptions:         []Description{{Text: ev.Place, Type: "earthquake name"}},
+		PreferredOriginID:    base + "/origin",
+		PreferredMagnitudeID: base + "/magnitude",
+		Type:                 "earthquake",
+	}
+	if ev.Revision > 0 || ev.UpdatedAt > 0 || ev.Source != "" {
+		e.CreationInfo = &CreationInfo{AgencyID: strings.ToUpper(ev.Source)}
+		if ev.Revision > 0 {
+			e.CreationInfo.Version = strconv.Itoa(ev.Revision)
+		}
+		if ev.UpdatedAt > 0 {
+			e.CreationInfo.CreationTime = formatTime(ev.UpdatedAt)
+		}
+	}
+
+	origin := Origin{
+		PublicID: e.PreferredOriginID,
+		Time:     TimeQuantity{Value: formatTime(ev.Time)},
+	}
+	if len(ev.Coordinates) >= 2 {
+		origin.Longitude.Value, origin.Latitude.Value = ev.Coordinates[0], ev.Coordinates[1]
+	}
+	if len(ev.Coordinates) >= 3 {
+		//km -> metri, arrotondati al millimetro per non scrivere 8099.999999999999
+		origin.Depth = &RealQuantity{Value: math.Round(ev.Coordinates[2]*1e6) / 1e3}
+	}
+	e.Origins = []Origin{origin}
+	e.Magnitudes = []Magnitude{{
+		PublicID: e.PreferredMagnitudeID,
+		Mag:      RealQuantity{Value: ev.Magnitude},
+		OriginID: origin.PublicID,
+	}}
+	return e
+}
+
+// Tempo Unix in ms in formato ISO 8601 UTC, con i millesimi
+func formatTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01-02T15:04:05.000Z")
+}
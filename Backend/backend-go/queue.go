@@ -0,0 +1,369 @@
+package main
+
+import (
+	"backend-go/models"
+	"backend-go/wal"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//CODA DEGLI EVENTI
+//Tutti gli ingressi (ingest singolo, a blocchi, feed, quarantena) passano da enqueue:
+//l'evento viene prima scritto nel WAL su disco e solo dopo messo nel canale dei worker.
+//Così "queued" significa che l'evento sopravvive anche a un riavvio del processo.
+//Quando i worker sono indietro la politica INGEST_OVERFLOW decide se aspettare,
+//parcheggiare gli eventi nel WAL (spill) o rifiutarli indicando quando riprovare.
+
+// Cosa fare quando la coda dei worker è piena (INGEST_OVERFLOW)
+const (
+	overflowBlock  = "block"  // Aspetta che si liberi un posto, al massimo INGEST_BLOCK_TIMEOUT
+	overflowSpill  = "spill"  // Accetta comunque: l'evento resta nel WAL e va in coda appena c'è posto
+	overflowReject = "reject" // Rifiuta subito, indicando al client quando riprovare (Retry-After)
+)
+
+// Elemento del canale: l'evento con il suo numero di sequenza nel WAL (0 se il WAL è disattivato)
+// e il fetch a cui appartiene (nil per gli eventi singoli)
+type queuedEvent struct {
+	seq   uint64
+	event models.Earthquake
+	fetch *fetchRun
+}
+
+// Scadenza già passata: enqueue prova a mettere in coda senza aspettare
+var noWait = func() <-chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+// Stato della coda di ingestione: politica di overflow, eventi in attesa
+// fuori dal canale (spill) e contatori esposti da /api/ingest/stats
+type ingestQueue struct {
+	Overflow     string
+	BlockTimeout time.Duration
+	SpillMax     int
+
+	mu    sync.Mutex
+	spill []queuedEvent
+	wake  chan struct{} // Segnala al drainer che lo spill non è più vuoto
+
+	queued      atomic.Int64  // Eventi messi direttamente nel canale
+	spilled     atomic.Int64  // Eventi finiti nello spill
+	dropped     atomic.Int64  // Eventi rifiutati perché la coda era piena
+	written     atomic.Int64  // Eventi salvati dai worker
+	writeErrors atomic.Int64  // Eventi che i worker non sono riusciti a salvare
+	rate        atomic.Uint64 // Eventi salvati al secondo (float64, media mobile)
+}
+
+// Legge INGEST_OVERFLOW, INGEST_BLOCK_TIMEOUT e INGEST_SPILL_MAX.
+// Un valore sconosciuto di INGEST_OVERFLOW viene segnalato e si usa il default.
+func newIngestQueueFromEnv(walEnabled bool) *ingestQueue {
+	q := &ingestQueue{
+		Overflow:     envString("INGEST_OVERFLOW", overflowBlock),
+		BlockTimeout: envDuration("INGEST_BLOCK_TIMEOUT", 2*time.Second),
+		SpillMax:     envInt("INGEST_SPILL_MAX", 100000),
+		wake:         make(chan struct{}, 1),
+	}
+	switch q.Overflow {
+	case overflowBlock, overflowReject:
+	case overflowSpill:
+		if !walEnabled {
+			log.Println("INGEST_OVERFLOW=spill senza WAL: gli eventi in attesa restano solo in memoria")
+		}
+	default:
+		log.Printf("Valore non valido per INGEST_OVERFLOW (%q), uso il default %s", q.Overflow, overflowBlock)
+		q.Overflow = overflowBlock
+	}
+	return q
+}
+
+// Scadenza per chi mette in coda da una richiesta HTTP: solo in modalità block
+// aspettiamo (al massimo wait), altrimenti si decide subito. stop va sempre chiamata.
+func (q *ingestQueue) deadline(wait time.Duration) (<-chan time.Time, func()) {
+	if q.Overflow != overflowBlock {
+		return noWait, func() {}
+	}
+	t := time.NewTimer(wait)
+	return t.C, func() { t.Stop() }
+}
+
+// Aggiunge un evento allo spill, se c'è ancora posto
+func (q *ingestQueue) pushSpill(item queuedEvent) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.spill) >= q.SpillMax {
+		return false
+	}
+	q.spill = append(q.spill, item)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Numero di eventi nello spill
+func (q *ingestQueue) spillLen() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.spill)
+}
+
+// Ritmo con cui i worker stanno salvando gli eventi (eventi al secondo)
+func (q *ingestQueue) drainRate() float64 {
+	return math.Float64frombits(q.rate.Load())
+}
+
+// Aggiorna ogni secondo la media mobile degli eventi salvati al secondo
+func (q *ingestQueue) measure(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := q.written.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := q.written.Load()
+		rate := 0.7*q.drainRate() + 0.3*float64(now-last)
+		last = now
+		q.rate.Store(math.Float64bits(rate))
+	}
+}
+
+// Secondi consigliati al client prima di riprovare: il tempo che i worker,
+// al ritmo attuale, impiegano per smaltire quello che è già in attesa
+func (q *ingestQueue) retryAfter(backlog int) int {
+	rate := q.drainRate()
+	if rate < 0.1 {
+		//I worker non stanno salvando nulla (es. database irraggiungibile)
+		return 10
+	}
+	secs := int(math.Ceil(float64(backlog) / rate))
+	return min(max(secs, 1), 300)
+}
+
+// Apre il WAL indicato da WAL_PATH (se WAL_ENABLED non è false)
+// e restituisce gli eventi rimasti in sospeso dall'esecuzione precedente
+func openWALFromEnv() (*wal.Log, []wal.Entry, error) {
+	if !envBool("WAL_ENABLED", true) {
+		log.Println("WAL disattivato: gli eventi in coda si perdono se il processo si ferma")
+		return nil, nil, nil
+	}
+	path := envString("WAL_PATH", "data/ingest.wal")
+	maxSize := int64(envInt("WAL_MAX_SIZE_MB", 64)) << 20
+	w, pending, err := wal.Open(path, maxSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("apertura WAL %s: %w", path, err)
+	}
+	log.Printf("WAL %s: %d eventi in sospeso da riprocessare", path, len(pending))
+	return w, pending, nil
+}
+
+// Mette gli eventi nella coda dei worker e dice, per ognuno, se è stato accettato.
+// Gli eventi vengono scritti nel WAL tutti insieme (un solo fsync), poi inviati al canale.
+// Se il canale è pieno aspettiamo fino a deadline (nil = finché ctx non viene annullato,
+// noWait = per niente); poi, in modalità spill, l'evento resta nel WAL e viene
+// messo in coda appena c'è posto. Gli eventi rimasti fuori vengono tolti dal WAL,
+// perché il client sa che non sono stati accettati.
+// fetch (può essere nil) raccoglie gli esiti del salvataggio degli eventi accodati.
+func (app *App) enqueue(ctx context.Context, events []models.Earthquake, deadline <-chan time.Time, fetch *fetchRun) ([]bool, error) {
+	queued := make([]bool, len(events))
+	if len(events) == 0 {
+		return queued, nil
+	}
+
+	//Durante lo spegnimento il canale viene chiuso: il lock in lettura
+	//garantisce che non succeda mentre stiamo ancora scrivendo
+	app.life.sendMu.RLock()
+	defer app.life.sendMu.RUnlock()
+	if app.life.closing.Load() {
+		return queued, errShuttingDown
+	}
+
+	seqs := make([]uint64, len(events))
+	if app.WAL != nil {
+		var err error
+		if seqs, err = app.WAL.Append(events); err != nil {
+			return queued, fmt.Errorf("scrittura WAL: %w", err)
+		}
+	}
+
+	//Contiamo gli eventi nel fetch prima di inviarli: un worker potrebbe salvarli subito
+	fetch.add(len(events))
+
+	q := app.Queue
+	expired := false
+	var rejected []uint64
+	for i, ev := range events {
+		item := queuedEvent{seq: seqs[i], event: ev, fetch: fetch}
+
+		//Se ci sono eventi nello spill, i nuovi vanno in fondo: così l'ordine di arrivo
+		//viene rispettato e chi arriva dopo non scavalca chi sta già aspettando
+		if q.Overflow == overflowSpill && q.spillLen() > 0 {
+			if queued[i] = q.pushSpill(item); queued[i] {
+				q.spilled.Add(1)
+			} else {
+				q.dropped.Add(1)
+				rejected = append(rejected, seqs[i])
+			}
+			continue
+		}
+
+		//Prima proviamo senza aspettare, poi (se c'è ancora tempo) aspettiamo un posto
+		select {
+		case app.EventChannel <- item:
+			queued[i] = true
+			q.queued.Add(1)
+			continue
+		default:
+		}
+		if !expired {
+			select {
+			case app.EventChannel <- item:
+				queued[i] = true
+				q.queued.Add(1)
+				continue
+			case <-deadline:
+				expired = true
+			case <-ctx.Done():
+				expired = true
+			}
+		}
+		if q.Overflow == overflowSpill && q.pushSpill(item) {
+			queued[i] = true
+			q.spilled.Add(1)
+			continue
+		}
+		q.dropped.Add(1)
+		rejected = append(rejected, seqs[i])
+	}
+
+	fetch.add(-len(rejected))
+	if app.WAL != nil {
+		if err := app.WAL.Done(rejected); err != nil {
+			log.Printf("WAL: impossibile segnare %d eventi rifiutati: %v", len(rejected), err)
+		}
+	}
+	return queued, nil
+}
+
+// Sposta gli eventi dello spill nel canale dei worker, in ordine di arrivo,
+// man mano che si libera spazio
+func (app *App) drainSpill(ctx context.Context) {
+	q := app.Queue
+	for {
+		q.mu.Lock()
+		var item queuedEvent
+		ok := len(q.spill) > 0
+		if ok {
+			item = q.spill[0]
+		}
+		q.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case app.EventChannel <- item:
+			//Solo il drainer toglie elementi dalla testa, enqueue aggiunge in fondo
+			q.mu.Lock()
+			q.spill[0] = queuedEvent{}
+			q.spill = q.spill[1:]
+			q.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Quanti eventi sono in attesa di essere salvati (canale + spill)
+func (app *App) backlog() int {
+	return len(app.EventChannel) + app.Queue.spillLen()
+}
+
+// Risposta quando enqueue fallisce: server in arresto o WAL non scrivibile
+func (app *App) enqueueError(c *gin.Context, err error) {
+	if errors.Is(err, errShuttingDown) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting_down"})
+		return
+	}
+	log.Printf("Errore WAL: %v", err)
+	c.JSON(http.StatusServiceUnavailable, gin.H{"status": "wal_error"})
+}
+
+// Risposta 503 quando un evento non trova posto in coda: Retry-After
+// dice al client quando riprovare, in base al ritmo attuale dei worker
+func (app *App) queueFull(c *gin.Context, body gin.H) {
+	retry := app.Queue.retryAfter(app.backlog())
+	c.Header("Retry-After", strconv.Itoa(retry))
+	body["retry_after"] = retry
+	c.JSON(http.StatusServiceUnavailable, body)
+}
+
+// Statistiche della coda di ingestione
+func (app *App) getIngestStats(c *gin.Context) {
+	q := app.Queue
+	walPending := 0
+	if app.WAL != nil {
+		walPending = app.WAL.Pending()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"overflow":           q.Overflow,
+		"queue_depth":        len(app.EventChannel),
+		"queue_capacity":     cap(app.EventChannel),
+		"spill_depth":        q.spillLen(),
+		"spill_max":          q.SpillMax,
+		"wal_pending":        walPending,
+		"drain_rate":         math.Round(q.drainRate()*100) / 100,
+		"retry_after":        q.retryAfter(app.backlog()),
+		"queued_total":       q.queued.Load(),
+		"spilled_total":      q.spilled.Load(),
+		"dropped_total":      q.dropped.Load(),
+		"written_total":      q.written.Load(),
+		"write_errors_total": q.writeErrors.Load(),
+	})
+}
+
+// Rimette in coda gli eventi rimasti nel WAL dall'esecuzione precedente.
+// Va chiamata dopo l'avvio dei worker: se sono tanti aspettiamo che si liberi spazio.
+func (app *App) replayWAL(pending []wal.Entry) {
+	if len(pending) == 0 {
+		return
+	}
+	fetch := app.Fetches.begin("wal")
+	fetch.add(len(pending))
+	for _, e := range pending {
+		app.EventChannel <- queuedEvent{seq: e.Seq, event: e.Event, fetch: fetch}
+	}
+	fetch.seal()
+	log.Printf("WAL: %d eventi rimessi in coda", len(pending))
+}
+
+// Segna come completati nel WAL gli eventi salvati dai worker
+func (app *App) ackWAL(seqs []uint64) {
+	if app.WAL == nil || len(seqs) == 0 {
+		return
+	}
+	if err := app.WAL.Done(seqs); err != nil {
+		//Non è grave: al riavvio verranno riscritti, e l'upsert non duplica nulla
+		log.Printf("WAL: impossibile segnare %d eventi come completati: %v", len(seqs), err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"backend-go/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//POLITICHE DI CONSERVAZIONE
+//Invece di cancellare tutto ciò che è più vecchio di un'ora, ogni evento segue
+//la prima politica che lo riguarda (es. "forti": M>=4.5 per sempre,
+//"simulazioni": cancellate dopo un giorno, "standard": archiviati dopo 90 giorni).
+//Gli eventi reali scaduti vengono spostati nell'archivio, che resta consultabile.
+
+// Numero di ID passati allo store in ogni chiamata ad Archive o Delete
+const retentionChunk = 500
+
+// Retention applica le politiche di conservazione, a richiesta o periodicamente
+type Retention struct {
+	Policies []models.RetentionPolicy
+	Interval time.Duration
+
+	//Un solo giro alla volta: il giro programmato e la pulizia richiesta
+	//dall'API non devono lavorare insieme sugli stessi eventi
+	mu sync.Mutex
+	//Ultimo resoconto, leggibile anche mentre un giro è in corso
+	last atomic.Pointer[RetentionReport]
+}
+
+// RetentionReport riassume un giro delle politiche
+type RetentionReport struct {
+	StartedAt time.Time             `json:"started_at"`
+	Duration  string                `json:"duration"`
+	Scanned   int64                 `json:"scanned"`
+	Archived  int64                 `json:"archived"`
+	Deleted   int64                 `json:"deleted"`
+	Policies  []RetentionPolicyStat `json:"policies"`
+	Error     string                `json:"error,omitempty"`
+}
+
+// RetentionPolicyStat dice quanti eventi segue una politica e quanti sono scaduti
+type RetentionPolicyStat struct {
+	Name    string                 `json:"name"`
+	Action  models.RetentionAction `json:"action"`
+	Matched int64                  `json:"matched"`
+	Expired int64                  `json:"expired"`
+}
+
+// Legge le politiche da RETENTION_POLICIES (array JSON), altrimenti usa quelle di default.
+// A differenza delle altre variabili, qui un valore sbagliato blocca l'avvio:
+// una politica scritta male potrebbe archiviare o cancellare gli eventi sbagliati.
+func newRetentionFromEnv() (*Retention, error) {
+	policies := models.DefaultRetentionPolicies()
+	if raw := os.Getenv("RETENTION_POLICIES"); raw != "" {
+		policies = nil
+		if err := json.Unmarshal([]byte(raw), &policies); err != nil {
+			return nil, fmt.Errorf("RETENTION_POLICIES non valido: %w", err)
+		}
+	}
+	if err := models.ValidateRetentionPolicies(policies); err != nil {
+		return nil, fmt.Errorf("RETENTION_POLICIES non valido: %w", err)
+	}
+	return &Retention{
+		Policies: policies,
+		Interval: envDuration("RETENTION_INTERVAL", time.Hour),
+	}, nil
+}
+
+// Esegue il giro periodico: uno subito e poi uno ogni Interval, finché ctx non viene annullato
+func (r *Retention) Loop(ctx context.Context, store EventStore) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		report, err := r.Run(ctx, store)
+		switch {
+		case ctx.Err() != nil:
+			//Arresto del server: il giro interrotto riprende al prossimo avvio
+			return
+		case err != nil:
+			log.Printf("CONSERVAZIONE errore: %v", err)
+		case report.Archived > 0 || report.Deleted > 0:
+			log.Printf("CONSERVAZIONE %d eventi esaminati, %d archiviati, %d cancellati",
+				report.Scanned, report.Archived, report.Deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run esegue un giro completo delle politiche sul catalogo attuale.
+// Prima leggiamo tutto il catalogo con Stream e decidiamo cosa fare di ogni evento,
+// poi applichiamo le azioni a blocchi: così non modifichiamo lo store mentre lo leggiamo.
+func (r *Retention) Run(ctx context.Context, store EventStore) (RetentionReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := time.Now()
+	report := RetentionReport{StartedAt: start.UTC()}
+	stats := make(map[string]*RetentionPolicyStat, len(r.Policies))
+	for _, p := range r.Policies {
+		report.Policies = append(report.Policies, RetentionPolicyStat{Name: p.Name, Action: p.Action})
+	}
+	for i := range report.Policies {
+		stats[report.Policies[i].Name] = &report.Policies[i]
+	}
+
+	//Le origini di un evento logico seguono la decisione presa per l'origine preferita,
+	//così un evento non resta nel catalogo senza la sua preferita (o viceversa)
+	var toArchive, toDelete []string
+	decisions := map[string]models.RetentionAction{} // Evento logico -> azione decisa per la preferita ("" = resta)
+	secondary := map[string][]string{}               // Evento logico -> origini non preferite
+	fallback := map[string]models.RetentionAction{}  // Origine non preferita -> azione decisa per lei
+	err := store.Stream(ctx, models.EventFilter{Sort: models.SortTimeAsc}, 0, func(ev models.Earthquake) error {
+		report.Scanned++
+		var action models.RetentionAction
+		if p := models.MatchRetentionPolicy(r.Policies, ev); p != nil {
+			stat := stats[p.Name]
+			stat.Matched++
+			if p.Expired(ev, start) {
+				stat.Expired++
+				action = p.Action
+			}
+		}
+		switch {
+		case ev.Secondary && ev.LogicalID != "":
+			secondary[ev.LogicalID] = append(secondary[ev.LogicalID], ev.ID)
+			fallback[ev.ID] = action
+			return nil
+		case ev.LogicalID != "":
+			decisions[ev.LogicalID] = action
+		}
+		toArchive, toDelete = appendAction(toArchive, toDelete, action, ev.ID)
+		return nil
+	})
+	for logicalID, ids := range secondary {
+		for _, id := range ids {
+			action, ok := decisions[logicalID]
+			if !ok {
+				//La preferita non c'è più: vale la decisione presa per l'origine
+				action = fallback[id]
+			}
+			toArchive, toDelete = appendAction(toArchive, toDelete, action, id)
+		}
+	}
+
+	if err == nil {
+		report.Archived, err = applyInChunks(ctx, store.Archive, toArchive)
+	}
+	if err == nil {
+		report.Deleted, err = applyInChunks(ctx, store.Delete, toDelete)
+	}
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	r.last.Store(&report)
+	return report, err
+}
+
+// Aggiunge l'ID all'elenco dell'azione indicata
+func appendAction(toArchive, toDelete []string, action models.RetentionAction, id string) ([]string, []string) {
+	switch action {
+	case models.RetentionArchive:
+		toArchive = append(toArchive, id)
+	case models.RetentionDelete:
+		toDelete = append(toDelete, id)
+	}
+	return toArchive, toDelete
+}
+
+// Ultimo giro eseguito (nil se non ne è ancora partito nessuno)
+func (r *Retention) Last() *RetentionReport {
+	return r.last.Load()
+}
+
+// Chiama action sugli ID a blocchi di retentionChunk e somma i risultati
+func applyInChunks(ctx context.Context, action func(context.Context, []string) (int64, error), ids []string) (int64, error) {
+	var total int64
+	for len(ids) > 0 {
+		n := min(len(ids), retentionChunk)
+		count, err := action(ctx, ids[:n])
+		total += count
+		if err != nil {
+			return total, err
+		}
+		ids = ids[n:]
+	}
+	return total, nil
+}
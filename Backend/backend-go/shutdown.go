@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//SPEGNIMENTO ORDINATO
+//Con SIGTERM (docker-compose down) o Ctrl+C il server smette di accettare eventi,
+//ferma le attività in background, chiude il canale e aspetta che i worker
+//scrivano quello che hanno in coda, prima di chiudere WAL e database.
+
+// Il server si sta spegnendo e non accetta più eventi
+var errShuttingDown = errors.New("server in arresto")
+
+// Stato del ciclo di vita dell'applicazione
+type lifecycle struct {
+	closing atomic.Bool  // Impostato all'inizio dello spegnimento: enqueue rifiuta i nuovi eventi
+	sendMu  sync.RWMutex // Chi scrive nel canale tiene il lock in lettura, la chiusura lo prende in scrittura
+
+	//Le attività in background (poller, conservazione, spill) ricevono bgCtx
+	//e vengono aspettate con bgWG prima di chiudere il canale
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+	bgWG     sync.WaitGroup
+
+	//Il dispatcher delle notifiche riceve gli esiti fino all'ultimo blocco dei worker:
+	//viene chiuso dopo di loro e aspettato con notifyWG
+	notifyWG sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	l := &lifecycle{}
+	l.bgCtx, l.bgCancel = context.WithCancel(context.Background())
+	return l
+}
+
+// Avvia un'attività in background che termina quando il server si spegne
+func (app *App) background(fn func(ctx context.Context)) {
+	app.life.bgWG.Add(1)
+	go func() {
+		defer app.life.bgWG.Done()
+		fn(app.life.bgCtx)
+	}()
+}
+
+// Avvia la goroutine che consegna le notifiche; shutdown la chiude e la aspetta
+func (app *App) startNotifier() {
+	app.life.notifyWG.Add(1)
+	go func() {
+		defer app.life.notifyWG.Done()
+		app.Fetches.notify.run()
+	}()
+}
+
+// Spegne il server in ordine, entro timeout:
+//  1. chiude le connessioni HTTP (le richieste in corso vengono completate)
+//  2. ferma poller, conservazione e spill
+//  3. chiude il canale e aspetta che i worker scrivano gli ultimi blocchi
+//  4. associa le ultime origini salvate
+//  5. chiude come interrotti i fetch rimasti aperti e consegna le ultime notifiche
+//  6. chiude il WAL e lo store
+//
+// Gli eventi non salvati in tempo restano nel WAL e vengono riprocessati al prossimo avvio.
+func (app *App) shutdown(srv *http.Server, timeout time.Duration) {
+	log.Printf("Arresto in corso (al massimo %s)...", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	app.life.closing.Store(true)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Arresto del server HTTP: %v", err)
+	}
+
+	app.life.bgCancel()
+	app.life.bgWG.Wait()
+
+	//Da qui nessuno può più scrivere nel canale: chiudendolo i worker
+	//scrivono il blocco che stanno raccogliendo ed escono
+	app.life.sendMu.Lock()
+	buffered := app.backlog()
+	written, writeErrors := app.Queue.written.Load(), app.Queue.writeErrors.Load()
+	close(app.EventChannel)
+	app.life.sendMu.Unlock()
+	log.Printf("Arresto: %d eventi in coda da salvare", buffered)
+
+	done := make(chan struct{})
+	go func() {
+		app.WG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Arresto: i worker non hanno finito in tempo")
+	}
+
+	flushed := app.Queue.written.Load() - written
+	if app.WAL != nil {
+		abandoned := app.WAL.Pending()
+		if err := app.WAL.Close(); err != nil {
+			log.Printf("Arresto: chiusura WAL: %v", err)
+		}
+		log.Printf("Arresto: %d eventi salvati, %d non salvati (restano nel WAL per il prossimo avvio)", flushed, abandoned)
+	} else {
+		abandoned := int64(app.backlog()) + app.Queue.writeErrors.Load() - writeErrors
+		log.Printf("Arresto: %d eventi salvati, %d persi (WAL disattivato)", flushed, abandoned)
+	}
+
+	//Le origini salvate dagli ultimi blocchi vengono ancora associate
+	if q := app.associations; q != nil {
+		q.close()
+		assocCtx, assocCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer assocCancel()
+		select {
+		case <-q.done:
+		case <-assocCtx.Done():
+			log.Println("Arresto: associazione delle ultime origini non completata (verranno riassociate alla prossima modifica)")
+		}
+	}
+
+	//I fetch con eventi non salvati non si chiuderebbero più: li chiudiamo come
+	//interrotti e aspettiamo che le notifiche in coda (webhook compresi) vengano consegnate
+	if n := app.Fetches.interrupt(); n > 0 {
+		log.Printf("Arresto: %d fetch interrotti", n)
+	}
+	app.Fetches.notify.close()
+	notified := make(chan struct{})
+	go func() {
+		app.life.notifyWG.Wait()
+		close(notified)
+	}()
+	//Come per lo store, qualche secondo anche se il timeout è già scaduto
+	notifyCtx, notifyCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer notifyCancel()
+	select {
+	case <-notified:
+	case <-notifyCtx.Done():
+		log.Println("Arresto: le notifiche in coda non sono state consegnate in tempo")
+	}
+
+	//Lo store si chiude per ultimo, con un po' di tempo anche se il timeout è già scaduto
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer closeCancel()
+	if err := app.Store.Close(closeCtx); err != nil {
+		log.Printf("Arresto: chiusura dello store: %v", err)
+	}
+	log.Println("Arresto completato")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"backend-go/models"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//VALIDAZIONE DEGLI EVENTI IN INGRESSO
+//Ogni evento che arriva (ingest singolo, a blocchi o dal feed) passa da qui prima
+//di entrare nella coda dei worker. Gli eventi impossibili vengono scartati,
+//quelli sospetti seguono la politica INGEST_SUSPECT_POLICY.
+
+// Esiti della validazione di un evento
+const (
+	statusAccepted    = "accepted"
+	statusRejected    = "rejected"
+	statusQuarantined = "quarantined"
+)
+
+// Cosa fare degli eventi sospetti (problemi con severità "suspect")
+const (
+	suspectReject     = "reject"     // Scartati come quelli non validi
+	suspectQuarantine = "quarantine" // Messi in quarantena, consultabili da /api/quarantine
+	suspectAccept     = "accept"     // Salvati comunque, i problemi vengono solo segnalati
+)
+
+// Legge INGEST_SUSPECT_POLICY; un valore sconosciuto viene segnalato e si usa il default.
+// Di default gli eventi sospetti vanno in quarantena: un sospetto può essere un evento
+// vero (es. una microscossa di magnitudo 0.0, o mag null nel feed USGS) e scartarlo
+// lo perderebbe senza che nessuno possa rivederlo.
+func suspectPolicyFromEnv() string {
+	policy := envString("INGEST_SUSPECT_POLICY", suspectQuarantine)
+	switch policy {
+	case suspectReject, suspectQuarantine, suspectAccept:
+		return policy
+	}
+	log.Printf("Valore non valido per INGEST_SUSPECT_POLICY (%q), uso il default %s", policy, suspectQuarantine)
+	return suspectQuarantine
+}
+
+// Valida un evento e decide cosa farne. Se l'esito è quarantined l'evento
+// è già stato salvato in quarantena; se è accepted il chiamante deve metterlo in coda.
+// I problemi vengono restituiti in ogni caso, anche per gli eventi accettati.
+func (app *App) screenEvent(ctx context.Context, ev models.Earthquake, source string) (string, models.ValidationErrors, error) {
+	problems := ev.Validate(time.Now())
+	switch {
+	case len(problems) == 0:
+		return statusAccepted, nil, nil
+	case problems.HasErrors():
+		return statusRejected, problems, nil
+	}
+
+	//Ci sono solo problemi sospetti
+	switch app.SuspectPolicy {
+	case suspectAccept:
+		return statusAccepted, problems, nil
+	case suspectQuarantine:
+		err := app.Store.Quarantine(ctx, models.QuarantinedEvent{
+			Event:         ev,
+			Problems:      problems,
+			Source:        source,
+			QuarantinedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			return "", problems, fmt.Errorf("quarantena evento %s: %w", ev.ID, err)
+		}
+		return statusQuarantined, problems, nil
+	default:
+		return statusRejected, problems, nil
+	}
+}
+
+// Ordina la quarantena dalla più recente (a parità, per ID) e applica il limite
+func sortQuarantine(list []models.QuarantinedEvent, limit int64) []models.QuarantinedEvent {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].QuarantinedAt != list[j].QuarantinedAt {
+			return list[i].QuarantinedAt > list[j].QuarantinedAt
+		}
+		return list[i].Event.ID < list[j].Event.ID
+	})
+	if limit > 0 && int64(len(list)) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// Elenca gli eventi in quarantena, con i problemi trovati
+func (app *App) getQuarantine(c *gin.Context) {
+	limit, err := optionalIntQuery(c, "limit")
+	if err != nil || (limit != nil && *limit < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "parametro limit non valido"})
+		return
+	}
+	var n int64
+	if limit != nil {
+		n = *limit
+	}
+	list, err := app.Store.ListQuarantine(c.Request.Context(), n)
+	if err != nil {
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+	c.JSON(200, list)
+}
+
+// Rilascia un evento dalla quarantena: dopo la revisione manuale
+// viene messo nella coda dei worker come un evento normale
+func (app *App) releaseQuarantined(c *gin.Context) {
+	q, ok, err := app.Store.TakeQuarantined(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "evento non presente in quarantena"})
+		return
+	}
+	queued, err := app.enqueue(c.Request.Context(), []models.Earthquake{q.Event}, noWait, nil)
+	if err == nil && queued[0] {
+		c.JSON(http.StatusOK, gin.H{"status": "queued", "id": q.Event.ID})
+		return
+	}
+	//Coda piena o WAL non scrivibile: lo rimettiamo in quarantena, così non va perso
+	if err := app.Store.Quarantine(c.Request.Context(), q); err != nil {
+		log.Printf("Evento %s perso rilasciandolo dalla quarantena: %v", q.Event.ID, err)
+	}
+	app.queueFull(c, gin.H{"status": "queue_full"})
+}
+
+// Scarta definitivamente un evento in quarantena
+func (app *App) discardQuarantined(c *gin.Context) {
+	_, ok, err := app.Store.TakeQuarantined(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"Errore nel DB": "Non sono riuscito a connettermi"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "evento non presente in quarantena"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "discarded", "id": c.Param("id")})
+}
@@ -0,0 +1,340 @@
+// Package wal è un write-ahead log su disco per gli eventi in attesa di essere salvati.
+// Un evento viene scritto nel log (con fsync) prima di rispondere "queued" al client
+// e viene segnato come completato quando un worker lo ha salvato nello store.
+// Al riavvio gli eventi non completati vengono restituiti per essere riprocessati.
+//
+// Il file è in formato JSON lines, una riga per record:
+//
+//	{"op":"put","seq":1,"event":{...}}
+//	{"op":"done","seqs":[1,2,3]}
+//
+// Quando il file supera la dimensione massima e la maggior parte del file è fatta di
+// record ormai inutili (eventi completati e i loro "done") viene riscritto con i soli
+// eventi ancora in sospeso (compattazione).
+package wal
+
+import (
+	"backend-go/models"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Quota di byte morti oltre la quale un file più grande di maxSize viene compattato.
+// Se in sospeso c'è ancora più della metà del file, riscriverlo libererebbe poco:
+// senza questa soglia, con una coda lunga, si riscriverebbe l'intero file ad ogni Done.
+const compactDeadFraction = 0.5
+
+// ErrClosed viene restituito dopo Close
+var ErrClosed = errors.New("wal: log chiuso")
+
+// Entry è un evento del log con il suo numero di sequenza
+type Entry struct {
+	Seq   uint64
+	Event models.Earthquake
+}
+
+// Record è una riga del file
+type record struct {
+	Op    string             `json:"op"` // put o done
+	Seq   uint64             `json:"seq,omitempty"`
+	Seqs  []uint64           `json:"seqs,omitempty"`
+	Event *models.Earthquake `json:"event,omitempty"`
+}
+
+// Log è il write-ahead log. È sicuro da usare da più goroutine.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	maxSize int64
+	nextSeq uint64
+	//Eventi scritti ma non ancora completati: servono per la compattazione
+	pending map[uint64]pendingEvent
+	live    int64 // Byte dei record "put" ancora in sospeso; size-live sono byte morti
+}
+
+// Un evento in sospeso e la dimensione del suo record nel file
+type pendingEvent struct {
+	event models.Earthquake
+	size  int64
+}
+
+// Open apre (o crea) il log e restituisce gli eventi rimasti in sospeso,
+// in ordine di sequenza. Se l'ultima riga è incompleta (crash a metà scrittura)
+// viene ignorata: quell'evento non era ancora stato confermato al client.
+// maxSize è la dimensione oltre la quale il file viene compattato
+// (se almeno metà dei byte appartiene a record non più necessari).
+func Open(path string, maxSize int64) (*Log, []Entry, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, nil, err
+		}
+	}
+	l := &Log{path: path, maxSize: maxSize, nextSeq: 1, pending: make(map[uint64]pendingEvent)}
+
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+	//All'apertura riscriviamo subito il file con i soli eventi in sospeso
+	if err := l.rewrite(); err != nil {
+		return nil, nil, err
+	}
+	return l, l.entries(), nil
+}
+
+// Legge il file esistente e ricostruisce gli eventi in sospeso
+func (l *Log) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	//Una riga contiene un solo evento, ma un "done" può contenere molte sequenze
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			//Riga troncata: la saltiamo e andiamo avanti
+			continue
+		}
+		switch r.Op {
+		case "put":
+			if r.Event != nil {
+				//Il conteggio dei byte ripartirà dalla riscrittura che segue il caricamento
+				l.pending[r.Seq] = pendingEvent{event: *r.Event}
+			}
+			if r.Seq >= l.nextSeq {
+				l.nextSeq = r.Seq + 1
+			}
+		case "done":
+			for _, seq := range r.Seqs {
+				delete(l.pending, seq)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("lettura WAL %s (riga %d): %w", l.path, line, err)
+	}
+	return nil
+}
+
+// Riscrive il file con i soli eventi in sospeso: prima su un file temporaneo,
+// poi con una rename, così un crash a metà lascia intatto il file precedente
+func (l *Log) rewrite() error {
+	if l.f != nil {
+		if err := l.w.Flush(); err != nil {
+			return err
+		}
+		l.f.Close()
+		l.f = nil
+	}
+
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	for _, e := range l.entries() {
+		n, err := writeRecord(w, record{Op: "put", Seq: e.Seq, Event: &e.Event})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		l.pending[e.Seq] = pendingEvent{event: e.Event, size: n}
+		size += n
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	l.f, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	l.w = bufio.NewWriter(l.f)
+	l.size = size
+	l.live = size
+	return nil
+}
+
+// Append scrive gli eventi nel log e aspetta che siano su disco (fsync).
+// Restituisce i numeri di sequenza, nello stesso ordine degli eventi.
+func (l *Log) Append(events []models.Earthquake) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil, ErrClosed
+	}
+
+	//Prima codifichiamo tutti i record: un evento non serializzabile (es. una
+	//magnitudo NaN) fa fallire la chiamata senza scrivere nulla
+	lines := make([][]byte, len(events))
+	for i := range events {
+		line, err := encodeRecord(record{Op: "put", Seq: l.nextSeq + uint64(i), Event: &events[i]})
+		if err != nil {
+			return nil, err
+		}
+		lines[i] = line
+	}
+	//Le sequenze vengono consumate tutte anche se la scrittura si ferma a metà:
+	//un record scritto in parte non deve avere lo stesso numero di uno successivo
+	first := l.nextSeq
+	l.nextSeq += uint64(len(events))
+
+	seqs := make([]uint64, 0, len(events))
+	for i, line := range lines {
+		n, err := l.w.Write(line)
+		l.size += int64(n)
+		if err != nil {
+			//Gli eventi già scritti non vanno lasciati in sospeso: il client riceve
+			//un errore, e non essendo mai completati bloccherebbero la compattazione
+			l.forget(seqs)
+			return nil, err
+		}
+		seq := first + uint64(i)
+		l.live += int64(n)
+		l.pending[seq] = pendingEvent{event: events[i], size: int64(n)}
+		seqs = append(seqs, seq)
+	}
+	if err := l.sync(); err != nil {
+		//Il client riceverà un errore: gli eventi non vanno riprocessati al riavvio
+		l.forget(seqs)
+		return nil, err
+	}
+	return seqs, nil
+}
+
+// Done segna gli eventi come completati (salvati nello store o rifiutati dalla coda).
+// Non serve l'fsync: se il record va perso, al riavvio l'evento viene
+// riprocessato e l'upsert lo scrive di nuovo senza effetti.
+func (l *Log) Done(seqs []uint64) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return ErrClosed
+	}
+
+	n, err := writeRecord(l.w, record{Op: "done", Seqs: seqs})
+	if err != nil {
+		return err
+	}
+	l.size += n
+	l.forget(seqs)
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if l.needsCompaction() {
+		return l.rewrite()
+	}
+	return nil
+}
+
+// Il file va compattato se supera maxSize e i byte morti sono almeno
+// compactDeadFraction del totale (chiamare con il lock preso)
+func (l *Log) needsCompaction() bool {
+	if l.maxSize <= 0 || l.size <= l.maxSize {
+		return false
+	}
+	dead := l.size - l.live
+	return float64(dead) >= compactDeadFraction*float64(l.size)
+}
+
+// Toglie gli eventi da quelli in sospeso (chiamare con il lock preso)
+func (l *Log) forget(seqs []uint64) {
+	for _, seq := range seqs {
+		if p, ok := l.pending[seq]; ok {
+			l.live -= p.size
+			delete(l.pending, seq)
+		}
+	}
+}
+
+// Pending restituisce il numero di eventi in sospeso
+func (l *Log) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.pending)
+}
+
+// Close scrive su disco quello che resta e chiude il file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// Svuota il buffer e forza la scrittura su disco
+func (l *Log) sync() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Eventi in sospeso in ordine di sequenza (chiamare con il lock preso)
+func (l *Log) entries() []Entry {
+	entries := make([]Entry, 0, len(l.pending))
+	for seq, p := range l.pending {
+		entries = append(entries, Entry{Seq: seq, Event: p.event})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+// Scrive un record come riga JSON e restituisce i byte scritti
+func writeRecord(w *bufio.Writer, r record) (int64, error) {
+	raw, err := encodeRecord(r)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(raw)
+	return int64(n), err
+}
+
+// Codifica un record come riga JSON
+func encodeRecord(r record) ([]byte, error) {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(raw, '\n'), nil
+}
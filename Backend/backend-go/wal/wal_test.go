@@ -0,0 +1,251 @@
+package wal
+
+import (
+	"backend-go/models"
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEvents(n int) []models.Earthquake {
+	events := make([]models.Earthquake, n)
+	for i := range events {
+		events[i] = models.Earthquake{
+			ID:          fmt.Sprintf("us1000w%03d", i),
+			Place:       "10km N of Test",
+			Magnitude:   2.5,
+			Time:        1722560523000,
+			Coordinates: []float64{13.5, 43.6, 8.1},
+		}
+	}
+	return events
+}
+
+func openLog(t *testing.T, path string, maxSize int64) (*Log, []Entry) {
+	t.Helper()
+	l, entries, err := Open(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, entries
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestReplayPendingEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.wal")
+	l, entries := openLog(t, path, 0)
+	if len(entries) != 0 {
+		t.Fatalf("log nuovo con %d eventi in sospeso", len(entries))
+	}
+	events := testEvents(4)
+	seqs, err := l.Append(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Done([]uint64{seqs[0], seqs[2]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Al riavvio tornano solo gli eventi non completati, in ordine di sequenza
+	l, entries = openLog(t, path, 0)
+	if len(entries) != 2 || entries[0].Seq != seqs[1] || entries[1].Seq != seqs[3] {
+		t.Fatalf("eventi in sospeso: %+v", entries)
+	}
+	if entries[0].Event.ID != events[1].ID || entries[1].Event.ID != events[3].ID {
+		t.Fatalf("eventi ripresi: %s, %s", entries[0].Event.ID, entries[1].Event.ID)
+	}
+	//La numerazione continua da dove si era fermata
+	next, err := l.Append(testEvents(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next[0] != seqs[3]+1 {
+		t.Fatalf("sequenza %d dopo il riavvio, attesa %d", next[0], seqs[3]+1)
+	}
+}
+
+func TestTruncatedOrCorruptTail(t *testing.T) {
+	for name, tail := range map[string]string{
+		"troncata": `{"op":"put","seq":3,"event":{"id":"us10`,
+		"corrotta": "\x00\x00\x00\x00",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.wal")
+			l, _ := openLog(t, path, 0)
+			if _, err := l.Append(testEvents(2)); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			//Un crash a metà scrittura lascia l'ultima riga incompleta
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteString(tail); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			l, entries := openLog(t, path, 0)
+			if len(entries) != 2 || entries[0].Seq != 1 || entries[1].Seq != 2 {
+				t.Fatalf("eventi in sospeso: %+v", entries)
+			}
+			//La riga incompleta sparisce con la riscrittura all'apertura
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(raw), tail) {
+				t.Fatalf("la riga incompleta è rimasta nel file:\n%s", raw)
+			}
+			if next, err := l.Append(testEvents(1)); err != nil || next[0] != 3 {
+				t.Fatalf("sequenza %v, %v: attesa 3", next, err)
+			}
+		})
+	}
+}
+
+func TestCompactionNeedsMostlyDeadRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.wal")
+	l, _ := openLog(t, path, 1)
+	seqs, err := l.Append(testEvents(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Meno della metà del file è morta: niente compattazione anche oltre maxSize
+	if err := l.Done(seqs[:4]); err != nil {
+		t.Fatal(err)
+	}
+	before := fileSize(t, path)
+	if l.size != before || float64(l.size-l.live) >= compactDeadFraction*float64(l.size) {
+		t.Fatalf("size %d (file %d), live %d", l.size, before, l.live)
+	}
+
+	//Con la maggior parte dei byte morti il file viene riscritto con i soli eventi in sospeso
+	if err := l.Done(seqs[4:8]); err != nil {
+		t.Fatal(err)
+	}
+	after := fileSize(t, path)
+	if after >= before || l.size != after || l.live != after {
+		t.Fatalf("file da %d a %d byte, size %d, live %d", before, after, l.size, l.live)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(raw), "\n"); lines != 2 {
+		t.Fatalf("dopo la compattazione %d righe, attese 2:\n%s", lines, raw)
+	}
+	if l.Pending() != 2 {
+		t.Fatalf("%d eventi in sospeso, attesi 2", l.Pending())
+	}
+}
+
+func TestDoneBookkeeping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.wal")
+	l, _ := openLog(t, path, 0)
+	seqs, err := l.Append(testEvents(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Pending() != 3 || l.live != l.size {
+		t.Fatalf("pending %d, live %d, size %d", l.Pending(), l.live, l.size)
+	}
+	//Una sequenza completata due volte, o mai scritta, non altera i conteggi
+	for _, done := range [][]uint64{{seqs[0]}, {seqs[0], 99}, nil} {
+		if err := l.Done(done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l.Pending() != 2 {
+		t.Fatalf("%d eventi in sospeso, attesi 2", l.Pending())
+	}
+	if err := l.Done(seqs[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if l.Pending() != 0 || l.live != 0 {
+		t.Fatalf("pending %d, live %d", l.Pending(), l.live)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Append(testEvents(1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Append dopo Close: %v", err)
+	}
+}
+
+func TestAppendInvalidEventWritesNothing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.wal")
+	l, _ := openLog(t, path, 0)
+	events := testEvents(3)
+	events[1].Magnitude = math.NaN()
+	if _, err := l.Append(events); err == nil {
+		t.Fatal("un evento con magnitudo NaN non è serializzabile")
+	}
+	if l.Pending() != 0 || l.live != 0 {
+		t.Fatalf("pending %d, live %d", l.Pending(), l.live)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//Nemmeno il primo evento del blocco deve tornare al riavvio
+	if _, entries := openLog(t, path, 0); len(entries) != 0 {
+		t.Fatalf("eventi in sospeso dopo il riavvio: %+v", entries)
+	}
+}
+
+// Writer che accetta solo i primi n byte
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, errors.New("disco pieno")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestAppendWriteErrorForgetsWrittenEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.wal")
+	l, _ := openLog(t, path, 0)
+	line, err := encodeRecord(record{Op: "put", Seq: 1, Event: &testEvents(1)[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Il primo record entra, il secondo no: con un buffer più piccolo delle righe
+	//bufio scrive direttamente sul writer sottostante
+	l.w = bufio.NewWriterSize(&failingWriter{n: len(line) + 10}, 16)
+	if _, err := l.Append(testEvents(3)); err == nil {
+		t.Fatal("attesa la scrittura fallita")
+	}
+	//Il primo evento non resta in sospeso e non blocca la compattazione
+	if l.Pending() != 0 || l.live != 0 {
+		t.Fatalf("pending %d, live %d", l.Pending(), l.live)
+	}
+	if l.nextSeq != 4 {
+		t.Fatalf("prossima sequenza %d, attesa 4", l.nextSeq)
+	}
+}
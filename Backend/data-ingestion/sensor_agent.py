@@ -70,23 +70,23 @@ class SeismicSensorAgent:
                 
                 print(f"Fetch {mode_label} : Trovati {len(features)} eventi.")
 
-                count = 0
+                events: List[Dict[str, Any]] = []
                 #Cicliamo su tutti i terremoti della lista
                 for feature in features:
                     #Proviamo a processare, gestiamo l'errore se i dati sono malformati.
                     try:
                         #DA COMMENTARE QUI
                         processed_event = self._process_feature(feature)
-                        #Se l'evento è valido lo mando al backend e incremento il contatore
+                        #Se l'evento è valido lo aggiungo al blocco da inviare
                         if processed_event:
-                            self._send_to_backend(session, processed_event)
-                            count += 1
+                            events.append(processed_event)
                     except (ValueError, KeyError) as e:
                         #Se nel processamento di un terremoto mancano dati o non sono completi
                         #passiamo al prossimo invece di interrompere il fetch
                         print(f"Errore processamento evento {feature.get('id', '?')}: {e}")
 
-                return count
+                #Invece di una POST per ogni terremoto, mandiamo tutto il blocco in una sola chiamata
+                return self._send_batch_to_backend(session, events)
 
             #Qui catturo gli errori di rete (generati da session o raise_for_status
             except requests.RequestException as e:
@@ -139,6 +139,47 @@ class SeismicSensorAgent:
         except requests.RequestException as e:
             print(f"Errore invio evento {payload['id']}: {e}")
 
+    #Invia tutti gli eventi in una sola chiamata a /api/ingest/batch
+    #Go risponde con l'esito di ogni evento: accettato, scartato o coda piena
+    #Gli eventi rifiutati per coda piena vengono rimandati dopo il Retry-After
+    #indicato dal backend, così durante i backfill grandi non si perde nulla
+    #Torna il numero di eventi accettati dal backend
+    def _send_batch_to_backend(self, session: requests.Session, events: List[Dict[str, Any]]) -> int:
+        accepted = 0
+        for attempt in range(MAX_BATCH_ATTEMPTS):
+            if not events:
+                break
+            try:
+                response = session.post(f"{self.backend_url}/batch", json=events, timeout=30)
+                result = response.json()
+            except (requests.RequestException, ValueError) as e:
+                print(f"Errore invio blocco di {len(events)} eventi: {e}")
+                return accepted
+
+            accepted += int(result.get("accepted", 0))
+            if result.get("rejected"):
+                print(f"Blocco inviato: {result['rejected']} eventi scartati")
+
+            #Rimandiamo solo gli elementi rifiutati per coda piena (items ha l'indice nel blocco)
+            retry = [events[item["index"]] for item in result.get("items", []) if item.get("status") == "queue_full"]
+            if not retry:
+                break
+            wait = self._retry_after(response)
+            print(f"Coda del backend piena: rimando {len(retry)} eventi tra {wait} secondi")
+            time.sleep(wait)
+            events = retry
+        else:
+            print(f"{len(events)} eventi non accodati dopo {MAX_BATCH_ATTEMPTS} tentativi")
+        return accepted
+
+    #Legge l'header Retry-After (in secondi), con un default se manca
+    @staticmethod
+    def _retry_after(response: requests.Response) -> int:
+        try:
+            return max(1, min(int(response.headers.get("Retry-After", "")), 300))
+        except ValueError:
+            return 5
+
     #Questa funzione mi serve per assicurarmi che sto passando un time_range corretto
     #in modo da tornare l'URL corretto del dizionario
     def get_url_by_range(self, time_range: str) -> Optional[str]:
@@ -173,6 +214,8 @@ class SeismicSensorAgent:
 #Istanziazione della classe 
 #Recupero configurazione da variabili d'ambiente 
 BACKEND_URL_ENV = os.getenv("BACKEND_URL", "http://backend-go:8080/api/ingest")
+#Quante volte rimandare gli eventi rifiutati perché la coda del backend è piena
+MAX_BATCH_ATTEMPTS = int(os.getenv("MAX_BATCH_ATTEMPTS", "10"))
 sensor_agent = SeismicSensorAgent(BACKEND_URL_ENV)
 
 #DEFINIZIO ENDPOINT API CON FLASK
@@ -29,7 +29,7 @@ namespace EarthquakeMonitor
             try
             {
                 // Costruisce l'URL dinamico tramite interpolazione di stringhe ($)
-                var url = $"{GO_API}/events?min_mag={minMag}&place={place}";
+                string? url = $"{GO_API}/events?min_mag={minMag}&place={place}";
 
                 
                 if (limit > 0)
@@ -37,18 +37,27 @@ namespace EarthquakeMonitor
                     url += $"&limit={limit}";
                 }
 
-                // Esegue la chiamata GET asincrona. 'await' sospende l'esecuzione di questo metodo (ma non di tutta l'app) finché non arrivano i dati.
+                // Configurazione per ignorare le maiuscole/minuscole nel JSON
+                var options = new JsonSerializerOptions { PropertyNameCaseInsensitive = true };
+                var events = new List<Earthquake>();
 
-                var response = await _client.GetAsync(url);
-                response.EnsureSuccessStatusCode(); // Lancia un'eccezione se il codice HTTP è di errore (es. 404).
+                // Il server risponde a pagine: senza limit seguiamo l'header Link (rel="next")
+                // finché non manca, così riceviamo tutti gli eventi come prima.
+                while (url != null)
+                {
+                    // Esegue la chiamata GET asincrona. 'await' sospende l'esecuzione di questo metodo (ma non di tutta l'app) finché non arrivano i dati.
+                    var response = await _client.GetAsync(url);
+                    response.EnsureSuccessStatusCode(); // Lancia un'eccezione se il codice HTTP è di errore (es. 404).
 
-                // Legge il corpo della risposta come stringa (è un lungo testo JSON).
-                var json = await response.Content.ReadAsStringAsync();
+                    // Legge il corpo della risposta come stringa (è un lungo testo JSON).
+                    var json = await response.Content.ReadAsStringAsync();
 
-                // Configurazione per ignorare le maiuscole/minuscole nel JSON
-                var options = new JsonSerializerOptions { PropertyNameCaseInsensitive = true };
-                // Trasforma la stringa JSON in una Lista di oggetti Earthquake veri e propri.
-                return JsonSerializer.Deserialize<List<Earthquake>>(json, options);
+                    // Trasforma la stringa JSON in una Lista di oggetti Earthquake veri e propri.
+                    events.AddRange(JsonSerializer.Deserialize<List<Earthquake>>(json, options) ?? new List<Earthquake>());
+
+                    url = limit > 0 ? null : NextPageUrl(response);
+                }
+                return events;
             }
             catch (Exception ex)
             {
@@ -57,6 +66,26 @@ namespace EarthquakeMonitor
             }
         }
 
+        // Legge dall'header Link l'indirizzo della pagina successiva: <...>; rel="next".
+        // Restituisce null se siamo all'ultima pagina.
+        private static string? NextPageUrl(HttpResponseMessage response)
+        {
+            if (!response.Headers.TryGetValues("Link", out var values))
+            {
+                return null;
+            }
+            foreach (var value in values)
+            {
+                int start = value.IndexOf('<'), end = value.IndexOf('>');
+                if (start >= 0 && end > start && value.Contains("rel=\"next\""))
+                {
+                    // Il link è relativo al server (/api/events?...): lo completiamo con l'indirizzo di GO_API
+                    return new Uri(new Uri(GO_API), value.Substring(start + 1, end - start - 1)).ToString();
+                }
+            }
+            return null;
+        }
+
         public async Task<StatsData> GetStatsAsync(string place = "", string timeRange = "day")
         {
             try